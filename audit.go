@@ -0,0 +1,336 @@
+package watchdog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Outcomes of audited actions
+const (
+	auditOutcomePlanned = "planned"
+	auditOutcomeSuccess = "success"
+	auditOutcomeFailure = "failure"
+	auditOutcomeSkipped = "skipped"
+)
+
+// Records a decision to start or stop an instance, why it was made, and how carrying it out went
+type AuditEvent struct {
+	Time           time.Time `json:"time"`
+	CorrelationID  string    `json:"correlation_id,omitempty"`
+	Repository     string    `json:"repository,omitempty"`
+	Action         string    `json:"action"`
+	Instance       string    `json:"instance"`
+	Zone           string    `json:"zone"`
+	Runner         string    `json:"runner"`
+	PreviousStatus string    `json:"previous_status"`
+	Reason         string    `json:"reason"`
+	Outcome        string    `json:"outcome"`
+	Error          string    `json:"error,omitempty"`
+}
+
+func newAuditEvent(ctx context.Context, repository string, action string, instance OnDemandInstance, reason string) AuditEvent {
+
+	correlationID, _ := GetLogger(ctx).fields[logFieldCorrelationID].(string)
+
+	return AuditEvent{
+		Time:           time.Now().UTC(),
+		CorrelationID:  correlationID,
+		Repository:     repository,
+		Action:         action,
+		Instance:       instance.InstanceName,
+		Zone:           instance.Zone,
+		Runner:         instance.RunnerName,
+		PreviousStatus: instance.Status,
+		Reason:         reason,
+		Outcome:        auditOutcomePlanned,
+	}
+}
+
+// Explains which job an instance is started for; jobs that can run now take precedence over jobs being pre-warmed for
+func getStartReason(instance OnDemandInstance, demands []jobDemand, failovers []Failover) string {
+
+	var matchingDemands []jobDemand
+	for _, demand := range demands {
+		if demand.RunsOn.MatchesRunner(instance.RunnerName, instance.RunnerGroup) {
+			matchingDemands = append(matchingDemands, demand)
+		}
+	}
+
+	var reason string
+	if len(matchingDemands) == 0 {
+		reason = fmt.Sprintf("Runner %v is required", instance.RunnerName)
+	} else {
+		demand := matchingDemands[0]
+		for _, matchingDemand := range matchingDemands {
+			if !matchingDemand.PreWarm {
+				demand = matchingDemand
+				break
+			}
+		}
+
+		if demand.PreWarm {
+			reason = fmt.Sprintf("Pre-warming for job %v of workflow run %v (%v), which will soon require runs-on %v", demand.Job, demand.RunID, demand.WorkflowPath, formatRunsOn(demand.RunsOn))
+		} else {
+			reason = fmt.Sprintf("Job %v of workflow run %v (%v) requires runs-on %v", demand.Job, demand.RunID, demand.WorkflowPath, formatRunsOn(demand.RunsOn))
+		}
+		if len(matchingDemands) > 1 {
+			reason += fmt.Sprintf(", as do %v other job(s)", len(matchingDemands)-1)
+		}
+	}
+
+	for _, failover := range failovers {
+		if failover.ReplacementInstance != nil && *failover.ReplacementInstance == instance {
+			reason = fmt.Sprintf("Replaces %v: %v; %v", failover.FailedInstance.InstanceName, failover.Reason, reason)
+		}
+	}
+
+	return reason
+}
+
+// Explains why an instance is considered idle
+func getStopReason(instance OnDemandInstance, idleSince map[string]time.Time, gracePeriod time.Duration) string {
+
+	reason := fmt.Sprintf("No queued or in-progress job requires runner %v", instance.RunnerName)
+	if since, exists := idleSince[getInstanceKey(instance.Zone, instance.InstanceName)]; exists {
+		reason += fmt.Sprintf("; idle since %v, which exceeds the grace period of %v", since.UTC().Format(time.RFC3339), gracePeriod)
+	}
+
+	return reason
+}
+
+// Collects the audit events of one reconcile cycle, while the planned actions are being carried out
+type auditTrail struct {
+	mutex  sync.Mutex
+	events []AuditEvent
+}
+
+func newAuditTrail(plannedEvents []AuditEvent) *auditTrail {
+	return &auditTrail{events: append([]AuditEvent{}, plannedEvents...)}
+}
+
+type auditTrailContextKey struct{}
+
+// Attaches an audit trail to the context; instance operations further down the call chain record their outcome in it
+func withAuditTrail(ctx context.Context, trail *auditTrail) context.Context {
+	return context.WithValue(ctx, auditTrailContextKey{}, trail)
+}
+
+func getAuditTrail(ctx context.Context) *auditTrail {
+
+	trail, _ := ctx.Value(auditTrailContextKey{}).(*auditTrail)
+	return trail
+}
+
+// Adds an action that was decided on while carrying out other actions, such as starting a replacement instance
+func planAuditEvent(ctx context.Context, action string, instance OnDemandInstance, reason string) {
+
+	trail := getAuditTrail(ctx)
+	if trail == nil {
+		return
+	}
+
+	trail.mutex.Lock()
+	defer trail.mutex.Unlock()
+
+	var repository string
+	if len(trail.events) != 0 {
+		repository = trail.events[0].Repository
+	}
+	trail.events = append(trail.events, newAuditEvent(ctx, repository, action, instance, reason))
+}
+
+// Records the outcome of an operation on an instance, in the event that was planned for the instance
+// The action is updated as well, since e.g. an instance that was stopping when planned is resumed rather than started
+func recordAuditOutcome(ctx context.Context, action string, instance OnDemandInstance, err error) {
+
+	trail := getAuditTrail(ctx)
+	if trail == nil {
+		return
+	}
+
+	trail.mutex.Lock()
+	defer trail.mutex.Unlock()
+
+	for index := range trail.events {
+		event := &trail.events[index]
+		if event.Instance != instance.InstanceName || event.Zone != instance.Zone || event.Outcome != auditOutcomePlanned {
+			continue
+		}
+
+		event.Action = action
+		event.Time = time.Now().UTC()
+		if err != nil {
+			event.Outcome = auditOutcomeFailure
+			event.Error = err.Error()
+		} else {
+			event.Outcome = auditOutcomeSuccess
+		}
+		return
+	}
+}
+
+// Marks planned actions that were never carried out as skipped, and returns all events
+func (trail *auditTrail) finish(err error) []AuditEvent {
+
+	trail.mutex.Lock()
+	defer trail.mutex.Unlock()
+
+	for index := range trail.events {
+		event := &trail.events[index]
+		if event.Outcome != auditOutcomePlanned {
+			continue
+		}
+
+		event.Outcome = auditOutcomeSkipped
+		if err != nil {
+			event.Error = err.Error()
+		}
+	}
+
+	return append([]AuditEvent{}, trail.events...)
+}
+
+// Destination for audit events
+type AuditSink interface {
+	WriteAuditEvents(ctx context.Context, events []AuditEvent) error
+}
+
+// Supported audit sinks
+const (
+	AuditSinkStdout = "stdout"
+	AuditSinkFile   = "file"
+	AuditSinkHTTP   = "http"
+)
+
+func encodeAuditEvents(events []AuditEvent) ([]byte, error) {
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return nil, errors.Wrapf(err, "Error while marshalling audit event to json: %v", event)
+		}
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// Writes one JSON object per event and line
+type jsonLinesAuditSink struct {
+	mutex  sync.Mutex
+	output io.Writer
+}
+
+func (sink *jsonLinesAuditSink) WriteAuditEvents(ctx context.Context, events []AuditEvent) error {
+
+	content, err := encodeAuditEvents(events)
+	if err != nil {
+		return err
+	}
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	if _, err := sink.output.Write(content); err != nil {
+		return errors.Wrap(err, "Error while writing audit events")
+	}
+	return nil
+}
+
+var stdoutAuditSink = &jsonLinesAuditSink{output: os.Stdout}
+
+// An unresponsive collector must not hold up the reconcile cycle indefinitely
+var auditHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// Appends one JSON object per event and line to a file
+type fileAuditSink struct {
+	path string
+}
+
+func (sink *fileAuditSink) WriteAuditEvents(ctx context.Context, events []AuditEvent) error {
+
+	content, err := encodeAuditEvents(events)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(sink.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Error while opening audit log %v", sink.path)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(content); err != nil {
+		return errors.Wrapf(err, "Error while writing to audit log %v", sink.path)
+	}
+	return nil
+}
+
+// Posts the events as newline-delimited JSON to a collector
+type httpAuditSink struct {
+	url    string
+	client *http.Client
+}
+
+func (sink *httpAuditSink) WriteAuditEvents(ctx context.Context, events []AuditEvent) error {
+
+	content, err := encodeAuditEvents(events)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", sink.url, bytes.NewReader(content))
+	if err != nil {
+		return errors.Wrapf(err, "http.NewRequest(POST, %v) failed", sink.url)
+	}
+	request.Header.Set("Content-Type", "application/x-ndjson")
+
+	response, err := sink.client.Do(request)
+	if err != nil {
+		return errors.Wrapf(err, "HTTP POST %v failed", sink.url)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return errors.Errorf("HTTP POST %v returned status code %v", sink.url, response.Status)
+	}
+	return nil
+}
+
+// Returns the sink selected by the configuration, or nil if audit events are only included in results
+func newAuditSink(config AuditConfig) AuditSink {
+
+	switch config.Sink {
+	case AuditSinkStdout:
+		return stdoutAuditSink
+	case AuditSinkFile:
+		return &fileAuditSink{path: config.Path}
+	case AuditSinkHTTP:
+		return &httpAuditSink{url: config.URL, client: auditHTTPClient}
+	default:
+		return nil
+	}
+}
+
+// Writes audit events to the configured sink
+// Failing to do so does not fail the reconcile cycle, since the instances have already been started or stopped
+func writeAuditEvents(ctx context.Context, config AuditConfig, events []AuditEvent) {
+
+	sink := newAuditSink(config)
+	if sink == nil || len(events) == 0 {
+		return
+	}
+
+	if err := sink.WriteAuditEvents(ctx, events); err != nil {
+		GetLogger(ctx).Errorf("Unable to write %v audit event(s) to %v sink: %+v", len(events), config.Sink, err)
+	}
+}
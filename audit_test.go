@@ -0,0 +1,205 @@
+package watchdog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+func TestGetStartAndStopReasons(t *testing.T) {
+
+	instance := OnDemandInstance{InstanceName: "build-agent", Zone: "europe-west1-b", RunnerName: "build_agent"}
+
+	demands := []jobDemand{
+		{RunID: 1, WorkflowPath: ".github/workflows/nightly.yaml", Job: "package", RunsOn: RunsOn{Labels: []string{"build_agent"}}, PreWarm: true},
+		{RunID: 2, WorkflowPath: ".github/workflows/build.yaml", Job: "compile", RunsOn: RunsOn{Labels: []string{"build_agent"}}},
+		{RunID: 2, WorkflowPath: ".github/workflows/build.yaml", Job: "test", RunsOn: RunsOn{Labels: []string{"test_agent"}}},
+	}
+
+	t.Run("Jobs that can run now take precedence over jobs being pre-warmed for", func(t *testing.T) {
+		expectedReason := "Job compile of workflow run 2 (.github/workflows/build.yaml) requires runs-on build_agent, as do 1 other job(s)"
+		if reason := getStartReason(instance, demands, nil); reason != expectedReason {
+			t.Fatalf("Start reason expected: %v, actual: %v", expectedReason, reason)
+		}
+	})
+
+	t.Run("Pre-warming", func(t *testing.T) {
+		expectedReason := "Pre-warming for job package of workflow run 1 (.github/workflows/nightly.yaml), which will soon require runs-on build_agent"
+		if reason := getStartReason(instance, demands[:1], nil); reason != expectedReason {
+			t.Fatalf("Start reason expected: %v, actual: %v", expectedReason, reason)
+		}
+	})
+
+	t.Run("Replacement instances mention the instance they replace", func(t *testing.T) {
+		failovers := []Failover{{FailedInstance: OnDemandInstance{InstanceName: "spot-agent"}, ReplacementInstance: &instance, Reason: "preempted 3 times"}}
+		if reason := getStartReason(instance, demands[1:2], failovers); !strings.HasPrefix(reason, "Replaces spot-agent: preempted 3 times; Job compile") {
+			t.Fatalf("Start reason should begin with the failover, actual: %v", reason)
+		}
+	})
+
+	t.Run("Idle instances", func(t *testing.T) {
+		idleSince := map[string]time.Time{"europe-west1-b/build-agent": time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)}
+		expectedReason := "No queued or in-progress job requires runner build_agent; idle since 2021-03-01T12:00:00Z, which exceeds the grace period of 5m0s"
+		if reason := getStopReason(instance, idleSince, 5*time.Minute); reason != expectedReason {
+			t.Fatalf("Stop reason expected: %v, actual: %v", expectedReason, reason)
+		}
+	})
+}
+
+func TestStopInstancesRecordsAuditOutcomes(t *testing.T) {
+
+	httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path == "/compute/v1/projects/my-project/zones/europe-west1-b/instances/broken-agent/stop" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, `{ "error": { "code": 400, "message": "Bad request" } }`)
+			return
+		}
+		fmt.Fprintln(w, `{ "name": "operation-1", "status": "DONE" }`)
+	}))
+	defer teardown()
+
+	ctx := context.Background()
+
+	computeService, err := compute.NewService(ctx, option.WithHTTPClient(httpClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instancesToStop := []OnDemandInstance{
+		{InstanceName: "suspended-agent", Zone: "europe-west1-b", RunnerName: "agent1", Status: "RUNNING", StopMode: StopModeSuspend},
+		{InstanceName: "broken-agent", Zone: "europe-west1-b", RunnerName: "agent2", Status: "RUNNING", StopMode: StopModeStop},
+		{InstanceName: "other-agent", Zone: "europe-west1-b", RunnerName: "agent3", Status: "RUNNING", StopMode: StopModeStop},
+	}
+
+	var plannedEvents []AuditEvent
+	for _, instance := range instancesToStop {
+		plannedEvents = append(plannedEvents, newAuditEvent(ctx, "MyOrg/MyRepo", getStopOperationName(instance), instance, "idle"))
+	}
+
+	trail := newAuditTrail(plannedEvents)
+	err = stopInstances(withAuditTrail(ctx, trail), computeService, "my-project", instancesToStop)
+	if err == nil {
+		t.Fatal("Stopping broken-agent should fail")
+	}
+	events := trail.finish(err)
+
+	expectedOutcomes := []string{"suspend success", "stop failure", "stop skipped"}
+	for index, expectedOutcome := range expectedOutcomes {
+		if outcome := events[index].Action + " " + events[index].Outcome; outcome != expectedOutcome {
+			t.Fatalf("Outcome of %v expected: %v, actual: %v", events[index].Instance, expectedOutcome, outcome)
+		}
+	}
+
+	if events[0].PreviousStatus != "RUNNING" || events[0].Reason != "idle" || events[0].Error != "" {
+		t.Fatalf("Event should keep the previous status and reason and have no error, actual: %+v", events[0])
+	}
+
+	if !strings.Contains(events[1].Error, "Bad request") {
+		t.Fatalf("Error of failed stop should be recorded, actual: %v", events[1].Error)
+	}
+}
+
+func TestAuditSinks(t *testing.T) {
+
+	events := []AuditEvent{
+		{Action: "start", Instance: "instance1", Zone: "europe-west1-b", Runner: "agent1", Reason: "needed", Outcome: auditOutcomeSuccess},
+		{Action: "stop", Instance: "instance2", Zone: "europe-west1-b", Runner: "agent2", Reason: "idle", Outcome: auditOutcomeFailure, Error: "failed"},
+	}
+
+	parseEvents := func(t *testing.T, content string) []AuditEvent {
+
+		var parsedEvents []AuditEvent
+		scanner := bufio.NewScanner(strings.NewReader(content))
+		for scanner.Scan() {
+			var event AuditEvent
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				t.Fatalf("Line is not a valid audit event: %v, error: %v", scanner.Text(), err)
+			}
+			parsedEvents = append(parsedEvents, event)
+		}
+		return parsedEvents
+	}
+
+	t.Run("File sink appends one event per line", func(t *testing.T) {
+
+		directory, err := ioutil.TempDir("", "audit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(directory)
+
+		path := filepath.Join(directory, "audit.jsonl")
+		sink := newAuditSink(AuditConfig{Sink: AuditSinkFile, Path: path})
+
+		for iteration := 0; iteration < 2; iteration++ {
+			if err := sink.WriteAuditEvents(context.Background(), events); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsedEvents := parseEvents(t, string(content))
+		if len(parsedEvents) != 4 || parsedEvents[3].Instance != "instance2" || parsedEvents[3].Error != "failed" {
+			t.Fatalf("Both writes should be in the file, actual: %+v", parsedEvents)
+		}
+	})
+
+	t.Run("HTTP sink posts newline-delimited JSON", func(t *testing.T) {
+
+		var contentType string
+		var body []byte
+		httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contentType = r.Header.Get("Content-Type")
+			body, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer teardown()
+
+		sink := &httpAuditSink{url: "https://collector.example.com/audit", client: httpClient}
+		if err := sink.WriteAuditEvents(context.Background(), events); err != nil {
+			t.Fatal(err)
+		}
+
+		if contentType != "application/x-ndjson" {
+			t.Fatalf("Content type expected: %v, actual: %v", "application/x-ndjson", contentType)
+		}
+		if parsedEvents := parseEvents(t, string(body)); len(parsedEvents) != 2 {
+			t.Fatalf("Events posted expected: %v, actual: %v", 2, len(parsedEvents))
+		}
+	})
+
+	t.Run("HTTP sink reports rejected events", func(t *testing.T) {
+
+		httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer teardown()
+
+		sink := &httpAuditSink{url: "https://collector.example.com/audit", client: httpClient}
+		if err := sink.WriteAuditEvents(context.Background(), events); err == nil {
+			t.Fatal("Should have failed")
+		}
+	})
+
+	t.Run("No sink by default", func(t *testing.T) {
+		if sink := newAuditSink(AuditConfig{}); sink != nil {
+			t.Fatalf("No sink expected, actual: %v", sink)
+		}
+	})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	watchdog "github.com/falldamagestudio/UE4-GHA-BuildAgentWatchdog"
+)
+
+const usage = `Usage: cli <command> [flags] [arguments]
+
+Commands:
+  plan            Print which instances would be started and stopped
+  apply           Start and stop instances, just like the watchdog does when triggered
+  status          Print all on-demand instances, and whether they are currently needed
+  start <runner>  Start the instance(s) serving a runner
+  stop <runner>   Stop the instance(s) serving a runner
+  validate-config Check the configuration, and report all problems found
+
+Configuration is read from the file given by -config (default: WATCHDOG_CONFIG),
+then overridden by the same environment variables that the watchdog function uses,
+and finally by flags.
+Run "cli <command> -h" for the list of flags.
+`
+
+type configFlags struct {
+	configPath         string
+	project            string
+	zones              string
+	gitHubOrganization string
+	gitHubRepository   string
+}
+
+func addConfigFlags(flagSet *flag.FlagSet) *configFlags {
+	flags := &configFlags{}
+	flagSet.StringVar(&flags.configPath, "config", os.Getenv("WATCHDOG_CONFIG"), "Configuration file, YAML or JSON (WATCHDOG_CONFIG)")
+	flagSet.StringVar(&flags.project, "project", "", "Google Cloud project that contains the build agent VMs (GOOGLE_CLOUD_PROJECT)")
+	flagSet.StringVar(&flags.zones, "zones", "", "Comma-separated list of zones where the build agent VMs reside; all zones if empty (GCE_ZONE)")
+	flagSet.StringVar(&flags.gitHubOrganization, "organization", "", "GitHub organization containing the game project (GITHUB_ORGANIZATION)")
+	flagSet.StringVar(&flags.gitHubRepository, "repository", "", "GitHub repository containing the game project (GITHUB_REPOSITORY)")
+	return flags
+}
+
+// Loads the configuration file and environment variables, and then applies overrides from flags
+func (flags *configFlags) loadConfig() (watchdog.Config, error) {
+
+	config, err := watchdog.LoadConfig(flags.configPath)
+	if err != nil {
+		return watchdog.Config{}, err
+	}
+
+	if flags.project != "" {
+		config.Project = flags.project
+	}
+	if flags.zones != "" {
+		config.Zones = strings.Split(flags.zones, ",")
+	}
+	if flags.gitHubOrganization != "" || flags.gitHubRepository != "" {
+		repository := watchdog.RepositoryConfig{Organization: flags.gitHubOrganization, Repository: flags.gitHubRepository}
+		if len(config.Repositories) == 1 {
+			if repository.Organization == "" {
+				repository.Organization = config.Repositories[0].Organization
+			}
+			if repository.Repository == "" {
+				repository.Repository = config.Repositories[0].Repository
+			}
+		}
+		config.Repositories = []watchdog.RepositoryConfig{repository}
+	}
+
+	return config, nil
+}
+
+func runValidateConfig(config watchdog.Config) error {
+
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	zones := "all zones"
+	if len(config.Zones) != 0 {
+		zones = "zones " + strings.Join(config.Zones, ", ")
+	}
+
+	fmt.Printf("Configuration is valid: project %s, %s, %d repositories, %d pools\n", config.Project, zones, len(config.Repositories), len(config.Pools))
+	return nil
+}
+
+func formatRunners(runners []watchdog.RunsOn) string {
+
+	var formatted []string
+	for _, runner := range runners {
+		labels := strings.Join(runner.Labels, ", ")
+		if runner.Group != "" {
+			formatted = append(formatted, fmt.Sprintf("group %s: [%s]", runner.Group, labels))
+		} else {
+			formatted = append(formatted, fmt.Sprintf("[%s]", labels))
+		}
+	}
+
+	if len(formatted) == 0 {
+		return "(none)"
+	}
+	return strings.Join(formatted, ", ")
+}
+
+func printInstances(heading string, instances []watchdog.OnDemandInstance) {
+
+	fmt.Printf("%s:\n", heading)
+	if len(instances) == 0 {
+		fmt.Println("  (none)")
+	}
+	for _, instance := range instances {
+		fmt.Printf("  %s in %s (runner %s, %s)\n", instance.InstanceName, instance.Zone, instance.RunnerName, instance.Status)
+	}
+}
+
+func runPlan(ctx context.Context, config watchdog.Config) error {
+
+	result, err := watchdog.ReconcileDryRun(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Runners required: %s\n", formatRunners(result.RunnersRequired))
+	fmt.Printf("Runners to pre-warm: %s\n", formatRunners(result.RunnersPreWarmed))
+	printInstances("Instances to start", result.StartedInstances)
+	printInstances("Instances to stop", result.StoppedInstances)
+
+	for _, event := range result.AuditEvents {
+		if event.Outcome == "skipped" {
+			fmt.Printf("Will not %s %s: %s\n", event.Action, event.Instance, event.Reason)
+		} else {
+			fmt.Printf("Reason to %s %s: %s\n", event.Action, event.Instance, event.Reason)
+		}
+	}
+
+	for _, instanceGroup := range result.InstanceGroups {
+		fmt.Printf("Instance group %s in %s (pool %s): size %d -> %d\n", instanceGroup.InstanceGroup, instanceGroup.Zone, instanceGroup.Pool, instanceGroup.CurrentSize, instanceGroup.TargetSize)
+	}
+
+	for _, stuckInstance := range result.StuckInstances {
+		fmt.Printf("Warning: instance %s in %s has been %s since %s\n", stuckInstance.InstanceName, stuckInstance.Zone, stuckInstance.Status, stuckInstance.StatusSince.Format(time.RFC3339))
+	}
+
+	for _, unhealthyInstance := range result.UnhealthyInstances {
+		fmt.Printf("Warning: instance %s in %s has been running since %s, but its runner is %s in GitHub (action: %s)\n", unhealthyInstance.InstanceName, unhealthyInstance.Zone, unhealthyInstance.RunningSince.Format(time.RFC3339), unhealthyInstance.RunnerStatus, unhealthyInstance.Action)
+	}
+
+	for _, staleRun := range result.StaleRuns {
+		fmt.Printf("Warning: job %s of workflow run %v (%s) has kept instance %s running since %s\n", staleRun.Job, staleRun.RunID, staleRun.WorkflowPath, staleRun.Instance, staleRun.RunningSince.Format(time.RFC3339))
+	}
+
+	for _, warning := range result.Warnings {
+		fmt.Printf("Warning: workflow run %v (%s): %s\n", warning.RunID, warning.WorkflowPath, warning.Message)
+	}
+
+	return nil
+}
+
+func runApply(ctx context.Context, config watchdog.Config) error {
+
+	result, err := watchdog.Reconcile(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
+
+func runStatus(ctx context.Context, config watchdog.Config) error {
+
+	result, err := watchdog.ReconcileDryRun(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "INSTANCE\tZONE\tRUNNER\tGROUP\tSTATUS\tSTATE")
+
+	for _, instance := range result.OnDemandInstances {
+		state := "idle"
+		if result.IsInstanceRequired(instance) {
+			state = "required"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", instance.InstanceName, instance.Zone, instance.RunnerName, instance.RunnerGroup, instance.Status, state)
+	}
+
+	return writer.Flush()
+}
+
+func runStartStop(ctx context.Context, config watchdog.Config, command string, runnerName string) error {
+
+	operation := watchdog.StartRunner
+	verb := "Started"
+	if command == "stop" {
+		operation = watchdog.StopRunner
+		verb = "Stopped"
+	}
+
+	instances, err := operation(ctx, config, runnerName)
+	if err != nil {
+		return err
+	}
+
+	for _, instance := range instances {
+		fmt.Printf("%s instance %s in %s (runner %s)\n", verb, instance.InstanceName, instance.Zone, instance.RunnerName)
+	}
+
+	return nil
+}
+
+func main() {
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	command := os.Args[1]
+
+	flagSet := flag.NewFlagSet(command, flag.ExitOnError)
+	flags := addConfigFlags(flagSet)
+	flagSet.Parse(os.Args[2:])
+
+	config, err := flags.loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+
+	switch command {
+	case "validate-config":
+		err = runValidateConfig(config)
+	case "plan":
+		err = runPlan(ctx, config)
+	case "apply":
+		err = runApply(ctx, config)
+	case "status":
+		err = runStatus(ctx, config)
+	case "start", "stop":
+		if flagSet.NArg() != 1 {
+			fmt.Fprintf(os.Stderr, "Usage: cli %s [flags] <runner>\n", command)
+			os.Exit(2)
+		}
+		err = runStartStop(ctx, config, command, flagSet.Arg(0))
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -1,15 +1,87 @@
 package main
 
 import (
-	"log"
+	"context"
+	"flag"
+	"math/rand"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/GoogleCloudPlatform/functions-framework-go/funcframework"
 	watchdog "github.com/falldamagestudio/UE4-GHA-BuildAgentWatchdog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+var logger = watchdog.GetLogger(context.Background())
+
+// Logs the error and exits; the logger writes JSON entries so that Cloud Logging picks up the severity
+func fatalf(format string, params ...interface{}) {
+	logger.Errorf(format, params...)
+	os.Exit(1)
+}
+
+// Returns the interval until the next scheduled reconcile cycle, with a random amount of jitter added
+func nextInterval(interval time.Duration, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Int63n(int64(jitter)))
+}
+
+// Runs reconcile cycles on a schedule, while also serving the HTTP endpoint for manual triggers
+// On SIGTERM/SIGINT, no further cycles are started; any in-flight cycle (scheduled or HTTP-triggered)
+// is allowed to finish its start/stop operations before the process exits
+func runDaemon(config watchdog.Config, port string, interval time.Duration, jitter time.Duration) {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", watchdog.RunWatchdogInDaemonMode)
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: ":" + port, Handler: mux}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fatalf("http.Server.ListenAndServe: %v", err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	logger.Infof("Daemon mode: reconciling every %v (+ up to %v jitter), listening on port %v", interval, jitter, port)
+
+	timer := time.NewTimer(0)
+
+	for {
+		select {
+		case sig := <-signals:
+			logger.Infof("Received %v, shutting down", sig)
+			timer.Stop()
+
+			if err := server.Shutdown(context.Background()); err != nil {
+				logger.Errorf("http.Server.Shutdown: %v", err)
+			}
+			if err := watchdog.ShutdownTracing(context.Background()); err != nil {
+				logger.Errorf("watchdog.ShutdownTracing: %v", err)
+			}
+			return
+
+		case <-timer.C:
+			if _, err := watchdog.Reconcile(context.Background(), config); err != nil {
+				logger.Errorf("Reconcile failed: %+v", err)
+			}
+			timer.Reset(nextInterval(interval, jitter))
+		}
+	}
+}
+
 func main() {
-	funcframework.RegisterHTTPFunction("/", watchdog.RunWatchdog)
+	daemon := flag.Bool("daemon", false, "Run reconcile cycles on a schedule instead of only when triggered via HTTP")
+	interval := flag.Duration("interval", time.Minute, "Time between reconcile cycles in daemon mode")
+	jitter := flag.Duration("jitter", 10*time.Second, "Maximum random delay added to each interval in daemon mode")
+	flag.Parse()
 
 	// Use PORT environment variable, or default to 8080.
 	port := "8080"
@@ -17,7 +89,27 @@ func main() {
 		port = envPort
 	}
 
+	if *daemon {
+		// Configuration problems are reported at startup, rather than on every scheduled cycle
+		config, err := watchdog.LoadConfigFromEnvironment()
+		if err != nil {
+			fatalf("%v", err)
+		}
+		if err := config.ValidateForRunMode(watchdog.RunModeDaemon); err != nil {
+			fatalf("%v", err)
+		}
+
+		rand.Seed(time.Now().UnixNano())
+		runDaemon(config, port, *interval, *jitter)
+		return
+	}
+
+	funcframework.RegisterHTTPFunction("/", watchdog.RunWatchdog)
+
+	// The functions framework serves http.DefaultServeMux
+	http.Handle("/metrics", promhttp.Handler())
+
 	if err := funcframework.Start(port); err != nil {
-		log.Fatalf("funcframework.Start: %v\n", err)
+		fatalf("funcframework.Start: %v", err)
 	}
 }
@@ -0,0 +1,597 @@
+package watchdog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Duration can be written as a Go duration string ("90s", "5m", "1h30m") in the configuration file
+type Duration time.Duration
+
+// Implements the Unmarshaler interface of the yaml pkg.
+func (duration *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+
+	var durationString string
+	if err := unmarshal(&durationString); err != nil {
+		return errors.New("Unable to deserialize duration; it should be a string such as \"5m\"")
+	}
+
+	parsedDuration, err := time.ParseDuration(durationString)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to deserialize duration \"%v\"", durationString)
+	}
+
+	*duration = Duration(parsedDuration)
+	return nil
+}
+
+func (duration Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(duration).String(), nil
+}
+
+type RepositoryConfig struct {
+	Organization string `yaml:"organization"`
+	Repository   string `yaml:"repository"`
+}
+
+func (repository RepositoryConfig) String() string {
+	return fmt.Sprintf("%s/%s", repository.Organization, repository.Repository)
+}
+
+const (
+	// Each runner is served by individually named VMs, which are started and stopped
+	PoolTypeInstances = "instances"
+
+	// Runners are served by a pool of identical VMs in a Managed Instance Group, which is resized
+	PoolTypeManagedInstanceGroup = "managed-instance-group"
+)
+
+// A group of runners that share policies
+// Policies that are not set for a pool are inherited from the top level of the configuration
+type PoolConfig struct {
+	Name            string    `yaml:"name"`
+	Type            string    `yaml:"type,omitempty"`
+	Runners         []string  `yaml:"runners"`
+	IdleGracePeriod *Duration `yaml:"idle-grace-period,omitempty"`
+
+	// Whether idle instances are stopped or suspended; the stop-mode metadata key or label of an instance takes precedence
+	StopMode string `yaml:"stop-mode,omitempty"`
+
+	// Settings for pools of type managed-instance-group
+	InstanceGroup string `yaml:"instance-group,omitempty"`
+	Zone          string `yaml:"zone,omitempty"`
+	RunnerGroup   string `yaml:"runner-group,omitempty"`
+	MinSize       int64  `yaml:"min-size,omitempty"`
+	MaxSize       int64  `yaml:"max-size,omitempty"`
+
+	// Time windows during which a minimum number of the pool's instances are kept awake
+	Schedules []ScheduleConfig `yaml:"schedules,omitempty"`
+
+	// Once the pool's estimated spend this month reaches this amount, no more of its instances are started; 0 disables the cap
+	MonthlyBudget float64 `yaml:"monthly-budget,omitempty"`
+
+	// Instances that have been running continuously for longer than this are stopped, even if jobs appear to require them;
+	// 0 disables the limit
+	MaxRuntime Duration `yaml:"max-runtime,omitempty"`
+}
+
+// Keeps instances awake ahead of demand, e.g. during office hours
+type ScheduleConfig struct {
+	// Cron expression (minute hour day-of-month month day-of-week); the schedule is active during every minute it matches
+	Window string `yaml:"window"`
+
+	// IANA time zone that the window is evaluated in; defaults to UTC
+	Timezone string `yaml:"timezone,omitempty"`
+
+	// Number of the pool's instances to keep awake while the schedule is active
+	MinWarm int64 `yaml:"min-warm"`
+}
+
+func (pool PoolConfig) isManagedInstanceGroup() bool {
+	return pool.Type == PoolTypeManagedInstanceGroup
+}
+
+// Selects where audit events are written, in addition to being included in results
+type AuditConfig struct {
+	// One of stdout, file or http; audit events are only included in results when not set
+	Sink string `yaml:"sink"`
+
+	// File that audit events are appended to, for the file sink
+	Path string `yaml:"path"`
+
+	// Collector that audit events are posted to, for the http sink
+	URL string `yaml:"url"`
+}
+
+// A chat channel that notifications are posted to
+type WebhookConfig struct {
+	// One of slack, teams or discord
+	Type string `yaml:"type"`
+	URL  string `yaml:"url"`
+}
+
+// Go text/template templates for notification messages; the defaults are used for templates that are not set
+type NotificationTemplates struct {
+	InstanceStartFailed     string `yaml:"instance-start-failed"`
+	JobWaiting              string `yaml:"job-waiting"`
+	BusyInstanceStopSkipped string `yaml:"busy-instance-stop-skipped"`
+	BusyInstanceStopForced  string `yaml:"busy-instance-stop-forced"`
+}
+
+type NotificationConfig struct {
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+
+	// Jobs that have been queued for longer than this are reported; 0 disables these notifications
+	JobWaitThreshold Duration `yaml:"job-wait-threshold"`
+
+	// The same notification is not posted again within this interval
+	RepeatInterval Duration `yaml:"repeat-interval"`
+
+	Templates NotificationTemplates `yaml:"templates"`
+}
+
+// Prices that runtime costs are estimated from, in any currency, as long as budgets use the same one
+type CostConfig struct {
+	// Price per hour by machine type, e.g. e2-standard-8
+	HourlyPrices map[string]float64 `yaml:"hourly-prices"`
+
+	// Price per hour by machine type for Spot VMs; Spot VMs whose machine type is not listed here use hourly-prices
+	SpotHourlyPrices map[string]float64 `yaml:"spot-hourly-prices"`
+}
+
+type PolicyConfig struct {
+	// When some workflow runs cannot be processed, the runners required are not fully known;
+	// by default, no instances are stopped in that situation
+	StopOnIncompleteRequirements bool `yaml:"stop-on-incomplete-requirements"`
+
+	// Agents for upcoming jobs are started when the jobs they depend on are expected to complete within this time
+	PreWarmLeadTime Duration `yaml:"pre-warm-lead-time"`
+
+	// Instances that remain in a transitional status (such as STAGING or STOPPING) for this long are reported as stuck
+	StuckInstanceThreshold Duration `yaml:"stuck-instance-threshold"`
+
+	// Spot instances that have been preempted this many times within the preemption window are replaced by
+	// equivalent standard instances, where available; 0 disables the fallback
+	SpotPreemptionLimit  int      `yaml:"spot-preemption-limit"`
+	SpotPreemptionWindow Duration `yaml:"spot-preemption-window"`
+
+	// Cancel the workflow runs of in-progress jobs on instances that are stopped for exceeding their pool's max-runtime
+	CancelStaleRuns bool `yaml:"cancel-stale-runs"`
+
+	// Running instances whose runner is not online in GitHub this long after booting are unhealthy; 0 disables the check
+	RunnerBootGracePeriod Duration `yaml:"runner-boot-grace-period"`
+
+	// One of report, reset or restart; defaults to report
+	UnhealthyRunnerAction string `yaml:"unhealthy-runner-action"`
+}
+
+func (policies PolicyConfig) getUnhealthyRunnerAction() string {
+
+	if policies.UnhealthyRunnerAction == "" {
+		return UnhealthyRunnerActionReport
+	}
+	return policies.UnhealthyRunnerAction
+}
+
+type Config struct {
+	Project string `yaml:"project"`
+
+	// Instances are discovered across all zones in the project, unless restricted to this allow-list
+	Zones []string `yaml:"zones"`
+
+	// Server-side filter for instance discovery, in the Compute API filter syntax; defaults to defaultInstanceFilter
+	// An explicitly empty filter lists all instances in the project
+	InstanceFilter string `yaml:"instance-filter"`
+
+	Repositories []RepositoryConfig `yaml:"repositories"`
+	Pools        []PoolConfig       `yaml:"pools"`
+
+	// Running instances are only stopped once they have been idle for at least this long
+	IdleGracePeriod Duration `yaml:"idle-grace-period"`
+
+	Policies PolicyConfig `yaml:"policies"`
+
+	Audit AuditConfig `yaml:"audit"`
+
+	Notifications NotificationConfig `yaml:"notifications"`
+
+	Costs CostConfig `yaml:"costs"`
+}
+
+// Lists all problems found in a configuration
+type ConfigErrors []string
+
+func (configErrors ConfigErrors) Error() string {
+	return fmt.Sprintf("Invalid configuration:\n* %s", strings.Join(configErrors, "\n* "))
+}
+
+// Only instances labelled as on-demand are listed, unless the configuration says otherwise
+const defaultInstanceFilter = "labels.on-demand=true"
+
+func defaultConfig() Config {
+	return Config{
+		InstanceFilter: defaultInstanceFilter,
+		Policies: PolicyConfig{
+			PreWarmLeadTime:        Duration(5 * time.Minute),
+			StuckInstanceThreshold: Duration(15 * time.Minute),
+			SpotPreemptionWindow:   Duration(time.Hour),
+		},
+		Notifications: NotificationConfig{
+			JobWaitThreshold: Duration(15 * time.Minute),
+			RepeatInterval:   Duration(time.Hour),
+		},
+	}
+}
+
+// Parses a configuration file; JSON files are accepted as well, since JSON is a subset of YAML
+func parseConfig(configFile string) (Config, error) {
+
+	config := defaultConfig()
+
+	if err := yaml.UnmarshalStrict([]byte(configFile), &config); err != nil {
+		return Config{}, errors.Wrap(err, "Error while unmarshaling configuration file")
+	}
+
+	return config, nil
+}
+
+// Settings from environment variables take precedence over the configuration file
+// GITHUB_ORGANIZATION + GITHUB_REPOSITORY replace any repositories listed in the file
+func (config *Config) applyEnvironmentOverrides() {
+
+	if project := os.Getenv("GOOGLE_CLOUD_PROJECT"); project != "" {
+		config.Project = project
+	}
+
+	if zone := os.Getenv("GCE_ZONE"); zone != "" {
+		config.Zones = []string{zone}
+	}
+
+	gitHubOrganization := os.Getenv("GITHUB_ORGANIZATION")
+	gitHubRepository := os.Getenv("GITHUB_REPOSITORY")
+	if gitHubOrganization != "" || gitHubRepository != "" {
+		config.Repositories = []RepositoryConfig{{Organization: gitHubOrganization, Repository: gitHubRepository}}
+	}
+}
+
+// Loads the configuration file at the given path (if any), and then applies environment variable overrides
+func LoadConfig(path string) (Config, error) {
+
+	config := defaultConfig()
+
+	if path != "" {
+		configFile, err := ioutil.ReadFile(path)
+		if err != nil {
+			return Config{}, errors.Wrapf(err, "Error while reading configuration file %v", path)
+		}
+
+		if config, err = parseConfig(string(configFile)); err != nil {
+			return Config{}, errors.Wrapf(err, "Error in configuration file %v", path)
+		}
+	}
+
+	config.applyEnvironmentOverrides()
+
+	return config, nil
+}
+
+// Loads the configuration file referenced by WATCHDOG_CONFIG (if set), and then applies environment variable overrides
+func LoadConfigFromEnvironment() (Config, error) {
+	return LoadConfig(os.Getenv("WATCHDOG_CONFIG"))
+}
+
+// How the watchdog is run; this decides which settings can be supported
+type RunMode string
+
+const (
+	// Each reconcile cycle may run in a fresh process, as in Cloud Functions; state kept in memory does not carry over
+	RunModeFunction RunMode = "function"
+
+	// Reconcile cycles run within a long-lived process, so state kept in memory carries over between cycles
+	RunModeDaemon RunMode = "daemon"
+)
+
+// Checks the entire configuration, including the settings that the run mode cannot support, and reports all problems at once
+func (config Config) ValidateForRunMode(mode RunMode) error {
+
+	var problems ConfigErrors
+	if err := config.Validate(); err != nil {
+		problems = append(problems, err.(ConfigErrors)...)
+	}
+
+	if mode != RunModeDaemon {
+		if config.IdleGracePeriod > 0 {
+			problems = append(problems, "idle-grace-period is only supported in daemon mode, where idle time is tracked across reconcile cycles")
+		}
+
+		for index, pool := range config.Pools {
+			if pool.IdleGracePeriod != nil && *pool.IdleGracePeriod > 0 {
+				problems = append(problems, fmt.Sprintf("pools[%d]: idle-grace-period is only supported in daemon mode, where idle time is tracked across reconcile cycles", index))
+			}
+			if pool.MonthlyBudget > 0 {
+				problems = append(problems, fmt.Sprintf("pools[%d]: monthly-budget is only supported in daemon mode, where spend is tracked across reconcile cycles", index))
+			}
+		}
+	}
+
+	if len(problems) != 0 {
+		return problems
+	}
+
+	return nil
+}
+
+// Checks the entire configuration, and reports all problems at once
+// Settings that only some run modes support are checked by ValidateForRunMode
+func (config Config) Validate() error {
+
+	var problems ConfigErrors
+
+	if config.Project == "" {
+		problems = append(problems, "project must be set (or GOOGLE_CLOUD_PROJECT)")
+	}
+
+	zonesEncountered := make(map[string]bool)
+	for index, zone := range config.Zones {
+		if zone == "" {
+			problems = append(problems, fmt.Sprintf("zones[%d]: zone must not be empty", index))
+		} else if zonesEncountered[zone] {
+			problems = append(problems, fmt.Sprintf("zones[%d]: %v is listed more than once", index, zone))
+		}
+		zonesEncountered[zone] = true
+	}
+
+	if len(config.Repositories) == 0 {
+		problems = append(problems, "at least one repository must be listed (or GITHUB_ORGANIZATION + GITHUB_REPOSITORY)")
+	}
+
+	repositoriesEncountered := make(map[string]bool)
+	for index, repository := range config.Repositories {
+		if repository.Organization == "" {
+			problems = append(problems, fmt.Sprintf("repositories[%d]: organization must be set (or GITHUB_ORGANIZATION)", index))
+		}
+		if repository.Repository == "" {
+			problems = append(problems, fmt.Sprintf("repositories[%d]: repository must be set (or GITHUB_REPOSITORY)", index))
+		}
+		if repositoriesEncountered[repository.String()] {
+			problems = append(problems, fmt.Sprintf("repositories[%d]: %v is listed more than once", index, repository))
+		}
+		repositoriesEncountered[repository.String()] = true
+	}
+
+	poolsEncountered := make(map[string]bool)
+	runnersEncountered := make(map[string]string)
+	for index, pool := range config.Pools {
+		if pool.Name == "" {
+			problems = append(problems, fmt.Sprintf("pools[%d]: name must be set", index))
+		} else if poolsEncountered[pool.Name] {
+			problems = append(problems, fmt.Sprintf("pools[%d]: pool name %v is used more than once", index, pool.Name))
+		}
+		poolsEncountered[pool.Name] = true
+
+		if len(pool.Runners) == 0 {
+			problems = append(problems, fmt.Sprintf("pools[%d]: at least one runner must be listed", index))
+		}
+		for _, runner := range pool.Runners {
+			if otherPool, exists := runnersEncountered[runner]; exists {
+				problems = append(problems, fmt.Sprintf("pools[%d]: runner %v is already a member of pool %v", index, runner, otherPool))
+			}
+			runnersEncountered[runner] = pool.Name
+		}
+
+		if pool.IdleGracePeriod != nil && *pool.IdleGracePeriod < 0 {
+			problems = append(problems, fmt.Sprintf("pools[%d]: idle-grace-period must not be negative", index))
+		}
+
+		if pool.StopMode != "" && pool.StopMode != StopModeStop && pool.StopMode != StopModeSuspend {
+			problems = append(problems, fmt.Sprintf("pools[%d]: stop-mode must be either %v or %v", index, StopModeStop, StopModeSuspend))
+		}
+
+		for scheduleIndex, schedule := range pool.Schedules {
+			if _, err := parseCronExpression(schedule.Window); err != nil {
+				problems = append(problems, fmt.Sprintf("pools[%d].schedules[%d]: window is invalid: %v", index, scheduleIndex, err))
+			}
+			if _, err := schedule.getLocation(); err != nil {
+				problems = append(problems, fmt.Sprintf("pools[%d].schedules[%d]: timezone is invalid: %v", index, scheduleIndex, err))
+			}
+			if schedule.MinWarm <= 0 {
+				problems = append(problems, fmt.Sprintf("pools[%d].schedules[%d]: min-warm must be greater than zero", index, scheduleIndex))
+			} else if pool.isManagedInstanceGroup() && pool.MaxSize > 0 && schedule.MinWarm > pool.MaxSize {
+				problems = append(problems, fmt.Sprintf("pools[%d].schedules[%d]: min-warm must not be greater than max-size", index, scheduleIndex))
+			}
+		}
+
+		if pool.MonthlyBudget < 0 {
+			problems = append(problems, fmt.Sprintf("pools[%d]: monthly-budget must not be negative", index))
+		} else if pool.MonthlyBudget > 0 && pool.isManagedInstanceGroup() {
+			problems = append(problems, fmt.Sprintf("pools[%d]: monthly-budget is not supported for pools of type %v", index, PoolTypeManagedInstanceGroup))
+		} else if pool.MonthlyBudget > 0 && len(config.Costs.HourlyPrices) == 0 {
+			problems = append(problems, fmt.Sprintf("pools[%d]: monthly-budget requires costs.hourly-prices to be set", index))
+		}
+
+		if pool.MaxRuntime < 0 {
+			problems = append(problems, fmt.Sprintf("pools[%d]: max-runtime must not be negative", index))
+		} else if pool.MaxRuntime > 0 && pool.isManagedInstanceGroup() {
+			problems = append(problems, fmt.Sprintf("pools[%d]: max-runtime is not supported for pools of type %v", index, PoolTypeManagedInstanceGroup))
+		}
+
+		switch pool.Type {
+		case "", PoolTypeInstances:
+			if pool.InstanceGroup != "" || pool.Zone != "" || pool.RunnerGroup != "" || pool.MinSize != 0 || pool.MaxSize != 0 {
+				problems = append(problems, fmt.Sprintf("pools[%d]: instance-group, zone, runner-group, min-size and max-size are only valid for pools of type %v", index, PoolTypeManagedInstanceGroup))
+			}
+		case PoolTypeManagedInstanceGroup:
+			if pool.StopMode != "" {
+				problems = append(problems, fmt.Sprintf("pools[%d]: stop-mode is not supported for pools of type %v", index, PoolTypeManagedInstanceGroup))
+			}
+			if pool.InstanceGroup == "" {
+				problems = append(problems, fmt.Sprintf("pools[%d]: instance-group must be set", index))
+			}
+			if pool.Zone == "" {
+				problems = append(problems, fmt.Sprintf("pools[%d]: zone must be set", index))
+			}
+			if pool.MinSize < 0 {
+				problems = append(problems, fmt.Sprintf("pools[%d]: min-size must not be negative", index))
+			}
+			if pool.MaxSize <= 0 {
+				problems = append(problems, fmt.Sprintf("pools[%d]: max-size must be greater than zero", index))
+			} else if pool.MinSize > pool.MaxSize {
+				problems = append(problems, fmt.Sprintf("pools[%d]: min-size must not be greater than max-size", index))
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("pools[%d]: type must be either %v or %v", index, PoolTypeInstances, PoolTypeManagedInstanceGroup))
+		}
+	}
+
+	if config.IdleGracePeriod < 0 {
+		problems = append(problems, "idle-grace-period must not be negative")
+	}
+
+	if config.Policies.PreWarmLeadTime < 0 {
+		problems = append(problems, "policies.pre-warm-lead-time must not be negative")
+	}
+
+	if config.Policies.RunnerBootGracePeriod < 0 {
+		problems = append(problems, "policies.runner-boot-grace-period must not be negative")
+	}
+
+	switch config.Policies.getUnhealthyRunnerAction() {
+	case UnhealthyRunnerActionReport, UnhealthyRunnerActionReset, UnhealthyRunnerActionRestart:
+	default:
+		problems = append(problems, fmt.Sprintf("policies.unhealthy-runner-action must be one of %v, %v or %v", UnhealthyRunnerActionReport, UnhealthyRunnerActionReset, UnhealthyRunnerActionRestart))
+	}
+
+	if config.Policies.SpotPreemptionLimit < 0 {
+		problems = append(problems, "policies.spot-preemption-limit must not be negative")
+	}
+
+	if config.Policies.SpotPreemptionLimit > 0 && config.Policies.SpotPreemptionWindow <= 0 {
+		problems = append(problems, "policies.spot-preemption-window must be greater than zero")
+	}
+
+	if config.Policies.StuckInstanceThreshold <= 0 {
+		problems = append(problems, "policies.stuck-instance-threshold must be greater than zero")
+	}
+
+	switch config.Audit.Sink {
+	case "", AuditSinkStdout:
+		if config.Audit.Path != "" || config.Audit.URL != "" {
+			problems = append(problems, fmt.Sprintf("audit: path is only valid for the %v sink, and url only for the %v sink", AuditSinkFile, AuditSinkHTTP))
+		}
+	case AuditSinkFile:
+		if config.Audit.Path == "" {
+			problems = append(problems, "audit: path must be set")
+		}
+		if config.Audit.URL != "" {
+			problems = append(problems, fmt.Sprintf("audit: url is only valid for the %v sink", AuditSinkHTTP))
+		}
+	case AuditSinkHTTP:
+		if config.Audit.URL == "" {
+			problems = append(problems, "audit: url must be set")
+		}
+		if config.Audit.Path != "" {
+			problems = append(problems, fmt.Sprintf("audit: path is only valid for the %v sink", AuditSinkFile))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("audit: sink must be one of %v, %v or %v", AuditSinkStdout, AuditSinkFile, AuditSinkHTTP))
+	}
+
+	for index, webhook := range config.Notifications.Webhooks {
+		if webhook.Type != WebhookTypeSlack && webhook.Type != WebhookTypeTeams && webhook.Type != WebhookTypeDiscord {
+			problems = append(problems, fmt.Sprintf("notifications.webhooks[%d]: type must be one of %v, %v or %v", index, WebhookTypeSlack, WebhookTypeTeams, WebhookTypeDiscord))
+		}
+		if webhook.URL == "" {
+			problems = append(problems, fmt.Sprintf("notifications.webhooks[%d]: url must be set", index))
+		}
+	}
+
+	if config.Notifications.JobWaitThreshold < 0 {
+		problems = append(problems, "notifications.job-wait-threshold must not be negative")
+	}
+
+	if config.Notifications.RepeatInterval < 0 {
+		problems = append(problems, "notifications.repeat-interval must not be negative")
+	}
+
+	for _, prices := range []struct {
+		name   string
+		prices map[string]float64
+	}{{"hourly-prices", config.Costs.HourlyPrices}, {"spot-hourly-prices", config.Costs.SpotHourlyPrices}} {
+		var machineTypes []string
+		for machineType := range prices.prices {
+			machineTypes = append(machineTypes, machineType)
+		}
+		sort.Strings(machineTypes)
+
+		for _, machineType := range machineTypes {
+			if prices.prices[machineType] < 0 {
+				problems = append(problems, fmt.Sprintf("costs.%v.%v must not be negative", prices.name, machineType))
+			}
+		}
+	}
+
+	templates := config.Notifications.Templates.byKind()
+	for _, kind := range notificationKinds {
+		if _, err := template.New(kind).Parse(templates[kind]); err != nil {
+			problems = append(problems, fmt.Sprintf("notifications.templates.%v: %v", kind, err))
+		}
+	}
+
+	if len(problems) != 0 {
+		return problems
+	}
+
+	return nil
+}
+
+// Returns the pool that the runner belongs to, or nil if it is not a member of any pool
+func (config Config) poolForRunner(runnerName string) *PoolConfig {
+
+	for index, pool := range config.Pools {
+		for _, runner := range pool.Runners {
+			if runner == runnerName {
+				return &config.Pools[index]
+			}
+		}
+	}
+
+	return nil
+}
+
+// Instances that serve runners in Managed Instance Group pools are not started and stopped individually
+func (config Config) isRunnerInManagedInstanceGroup(runnerName string) bool {
+
+	pool := config.poolForRunner(runnerName)
+	return pool != nil && pool.isManagedInstanceGroup()
+}
+
+// Instances are stopped rather than suspended, unless their pool says otherwise
+func (config Config) stopModeForRunner(runnerName string) string {
+
+	if pool := config.poolForRunner(runnerName); pool != nil && pool.StopMode != "" {
+		return pool.StopMode
+	}
+
+	return StopModeStop
+}
+
+func (config Config) idleGracePeriodForPool(pool *PoolConfig) time.Duration {
+
+	if pool != nil && pool.IdleGracePeriod != nil {
+		return time.Duration(*pool.IdleGracePeriod)
+	}
+
+	return time.Duration(config.IdleGracePeriod)
+}
+
+func (config Config) idleGracePeriodForRunner(runnerName string) time.Duration {
+	return config.idleGracePeriodForPool(config.poolForRunner(runnerName))
+}
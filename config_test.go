@@ -0,0 +1,348 @@
+package watchdog
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+
+	configFile := `
+project: my-project
+zones: [ europe-west1-b, europe-west4-a ]
+repositories:
+  - organization: MyOrg
+    repository: MyRepo
+pools:
+  - name: win64
+    runners: [ build_agent_win64, package_agent_win64 ]
+    idle-grace-period: 15m
+    schedules:
+      - window: "* 8-17 * * mon-fri"
+        timezone: Europe/Stockholm
+        min-warm: 2
+  - name: linux
+    runners: [ build_agent_linux ]
+    stop-mode: suspend
+idle-grace-period: 5m
+policies:
+  stop-on-incomplete-requirements: true
+audit:
+  sink: http
+  url: http://localhost:8090/audit
+`
+
+	config, err := parseConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedRepositories := []RepositoryConfig{{Organization: "MyOrg", Repository: "MyRepo"}}
+	if !reflect.DeepEqual(expectedRepositories, config.Repositories) {
+		t.Fatalf("Repositories expected: %v, actual: %v", expectedRepositories, config.Repositories)
+	}
+
+	if !config.Policies.StopOnIncompleteRequirements {
+		t.Fatal("policies.stop-on-incomplete-requirements should be true")
+	}
+
+	if time.Duration(config.Policies.PreWarmLeadTime) != 5*time.Minute {
+		t.Fatalf("policies.pre-warm-lead-time should default to 5m but is %v", time.Duration(config.Policies.PreWarmLeadTime))
+	}
+
+	if gracePeriod := config.idleGracePeriodForRunner("package_agent_win64"); gracePeriod != 15*time.Minute {
+		t.Fatalf("Idle grace period for package_agent_win64 should be 15m but is %v", gracePeriod)
+	}
+
+	if gracePeriod := config.idleGracePeriodForRunner("build_agent_linux"); gracePeriod != 5*time.Minute {
+		t.Fatalf("Idle grace period for build_agent_linux should be 5m but is %v", gracePeriod)
+	}
+
+	if stopMode := config.stopModeForRunner("build_agent_linux"); stopMode != StopModeSuspend {
+		t.Fatalf("Stop mode for build_agent_linux should be suspend but is %v", stopMode)
+	}
+
+	if stopMode := config.stopModeForRunner("build_agent_win64"); stopMode != StopModeStop {
+		t.Fatalf("Stop mode for build_agent_win64 should be stop but is %v", stopMode)
+	}
+
+	if time.Duration(config.Notifications.JobWaitThreshold) != 15*time.Minute || time.Duration(config.Notifications.RepeatInterval) != time.Hour {
+		t.Fatalf("notifications.job-wait-threshold and repeat-interval should default to 15m and 1h but are %v and %v", time.Duration(config.Notifications.JobWaitThreshold), time.Duration(config.Notifications.RepeatInterval))
+	}
+
+	expectedSchedules := []ScheduleConfig{{Window: "* 8-17 * * mon-fri", Timezone: "Europe/Stockholm", MinWarm: 2}}
+	if !reflect.DeepEqual(expectedSchedules, config.Pools[0].Schedules) {
+		t.Fatalf("Schedules of pool win64 expected: %v, actual: %v", expectedSchedules, config.Pools[0].Schedules)
+	}
+
+	expectedAudit := AuditConfig{Sink: AuditSinkHTTP, URL: "http://localhost:8090/audit"}
+	if config.Audit != expectedAudit {
+		t.Fatalf("Audit configuration expected: %v, actual: %v", expectedAudit, config.Audit)
+	}
+
+	if config.InstanceFilter != "labels.on-demand=true" {
+		t.Fatalf("instance-filter should default to labels.on-demand=true but is \"%v\"", config.InstanceFilter)
+	}
+
+	t.Run("JSON", func(t *testing.T) {
+
+		config, err := parseConfig(`{ "project": "my-project", "zones": [ "europe-west1-b" ], "repositories": [ { "organization": "MyOrg", "repository": "MyRepo" } ] }`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := config.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Empty instance filter", func(t *testing.T) {
+
+		config, err := parseConfig(`instance-filter: ""`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if config.InstanceFilter != "" {
+			t.Fatalf("instance-filter should be empty but is \"%v\"", config.InstanceFilter)
+		}
+	})
+
+	t.Run("Unknown key", func(t *testing.T) {
+
+		if _, err := parseConfig("projcet: my-project"); err == nil {
+			t.Fatal("Should have failed")
+		}
+	})
+
+	t.Run("Invalid duration", func(t *testing.T) {
+
+		if _, err := parseConfig("idle-grace-period: 5 minutes"); err == nil {
+			t.Fatal("Should have failed")
+		}
+	})
+}
+
+func TestValidateIdleGracePeriodRequiresDaemonMode(t *testing.T) {
+
+	configFile := `
+project: my-project
+repositories:
+  - organization: MyOrg
+    repository: MyRepo
+pools:
+  - name: win64
+    runners: [ build_agent_win64 ]
+    idle-grace-period: 15m
+  - name: linux
+    runners: [ build_agent_linux ]
+    idle-grace-period: 0s
+idle-grace-period: 5m
+`
+
+	config, err := parseConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedErrors := ConfigErrors{
+		"idle-grace-period is only supported in daemon mode, where idle time is tracked across reconcile cycles",
+		"pools[0]: idle-grace-period is only supported in daemon mode, where idle time is tracked across reconcile cycles",
+	}
+	if err, ok := config.ValidateForRunMode(RunModeFunction).(ConfigErrors); !ok || !reflect.DeepEqual(expectedErrors, err) {
+		t.Fatalf("Validation errors expected: %v, actual: %v", expectedErrors, err)
+	}
+
+	if err := config.ValidateForRunMode(RunModeDaemon); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateMonthlyBudgetRequiresDaemonMode(t *testing.T) {
+
+	configFile := `
+project: my-project
+repositories:
+  - organization: MyOrg
+    repository: MyRepo
+pools:
+  - name: win64
+    runners: [ build_agent_win64 ]
+    monthly-budget: 500
+costs:
+  hourly-prices:
+    e2-standard-8: 0.4
+`
+
+	config, err := parseConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The CLI validates configurations regardless of where they will be run
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedError := "pools[0]: monthly-budget is only supported in daemon mode, where spend is tracked across reconcile cycles"
+	if err, ok := config.ValidateForRunMode(RunModeFunction).(ConfigErrors); !ok || !reflect.DeepEqual(ConfigErrors{expectedError}, err) {
+		t.Fatalf("Validation error expected: %v, actual: %v", expectedError, err)
+	}
+
+	if err := config.ValidateForRunMode(RunModeDaemon); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateConfigReportsAllProblems(t *testing.T) {
+
+	configFile := `
+zones: [ europe-west1-b, europe-west1-b ]
+repositories:
+  - organization: MyOrg
+  - organization: MyOrg
+pools:
+  - name: win64
+    runners: [ build_agent_win64 ]
+  - name: win64
+    runners: [ build_agent_win64 ]
+  - name: linux
+    type: managed-instance-group
+    runners: [ cook_agent_linux ]
+    min-size: 3
+    max-size: 2
+    monthly-budget: 500
+    max-runtime: 6h
+  - name: mac
+    type: autoscaled
+    runners: [ build_agent_mac ]
+    stop-mode: hibernate
+    monthly-budget: -100
+    max-runtime: -1h
+    schedules:
+      - window: "* 25 * * *"
+        timezone: Mars/Olympus_Mons
+        min-warm: 0
+idle-grace-period: -5m
+policies:
+  runner-boot-grace-period: -10m
+  unhealthy-runner-action: reboot
+audit:
+  sink: file
+  url: http://localhost:8090/audit
+costs:
+  spot-hourly-prices:
+    e2-standard-8: -0.1
+notifications:
+  webhooks:
+    - type: irc
+  templates:
+    job-waiting: "{{.Job"
+`
+
+	config, err := parseConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = config.Validate()
+	if err == nil {
+		t.Fatal("Should have failed")
+	}
+
+	configErrors, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("Error should be of type ConfigErrors, but is %T", err)
+	}
+
+	expectedProblems := []string{
+		"project must be set",
+		"zones[1]: europe-west1-b is listed more than once",
+		"repositories[0]: repository must be set",
+		"repositories[1]: MyOrg/ is listed more than once",
+		"pools[1]: pool name win64 is used more than once",
+		"pools[1]: runner build_agent_win64 is already a member of pool win64",
+		"pools[2]: instance-group must be set",
+		"pools[2]: zone must be set",
+		"pools[2]: min-size must not be greater than max-size",
+		"pools[3]: stop-mode must be either stop or suspend",
+		"pools[3]: type must be either instances or managed-instance-group",
+		"pools[2]: monthly-budget is not supported for pools of type managed-instance-group",
+		"pools[2]: max-runtime is not supported for pools of type managed-instance-group",
+		"pools[3]: monthly-budget must not be negative",
+		"pools[3]: max-runtime must not be negative",
+		"pools[3].schedules[0]: window is invalid:",
+		"pools[3].schedules[0]: timezone is invalid:",
+		"pools[3].schedules[0]: min-warm must be greater than zero",
+		"idle-grace-period must not be negative",
+		"policies.runner-boot-grace-period must not be negative",
+		"policies.unhealthy-runner-action must be one of report, reset or restart",
+		"audit: path must be set",
+		"audit: url is only valid for the http sink",
+		"costs.spot-hourly-prices.e2-standard-8 must not be negative",
+		"notifications.webhooks[0]: type must be one of slack, teams or discord",
+		"notifications.webhooks[0]: url must be set",
+		"notifications.templates.job-waiting:",
+	}
+
+	for _, expectedProblem := range expectedProblems {
+		found := false
+		for _, problem := range configErrors {
+			if strings.HasPrefix(problem, expectedProblem) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected problem \"%v\" to be reported; problems reported: %v", expectedProblem, configErrors)
+		}
+	}
+}
+
+func TestApplyIdleGracePeriods(t *testing.T) {
+
+	config := Config{IdleGracePeriod: Duration(10 * time.Minute)}
+
+	now := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	// Equivalent instances in different zones can share a name; each has its own idle time
+	instances := []OnDemandInstance{
+		{InstanceName: "instance1", Zone: "europe-west1-b", RunnerName: "runner1", Status: "RUNNING"},
+		{InstanceName: "instance1", Zone: "europe-west4-a", RunnerName: "runner1", Status: "RUNNING"},
+	}
+
+	tracker := &idleTracker{idleSince: map[string]time.Time{"europe-west1-b/instance1": now.Add(-15 * time.Minute)}}
+
+	idleSince := tracker.getIdleSince(instances, now)
+
+	instancesToStop := applyIdleGracePeriods(context.Background(), config, instances, idleSince, now)
+
+	expectedInstancesToStop := []OnDemandInstance{instances[0]}
+	if !reflect.DeepEqual(expectedInstancesToStop, instancesToStop) {
+		t.Fatalf("Instances to stop diff. Expected: %v, actual: %v", expectedInstancesToStop, instancesToStop)
+	}
+
+	// Planning, such as during a dry run, does not change what later invocations see
+	if len(tracker.idleSince) != 1 {
+		t.Fatalf("Only recording should update the tracker, but tracker contains %v", tracker.idleSince)
+	}
+
+	tracker.update(instances, instances, now)
+	if since := tracker.idleSince["europe-west4-a/instance1"]; !since.Equal(now) {
+		t.Fatalf("instance1 in europe-west4-a idle since expected: %v, actual: %v", now, since)
+	}
+	if since := tracker.idleSince["europe-west1-b/instance1"]; !since.Equal(now.Add(-15 * time.Minute)) {
+		t.Fatalf("instance1 in europe-west1-b idle since expected: %v, actual: %v", now.Add(-15*time.Minute), since)
+	}
+
+	tracker.update(instances, nil, now)
+	if len(tracker.idleSince) != 0 {
+		t.Fatalf("Instances that are no longer idle should be forgotten, but tracker contains %v", tracker.idleSince)
+	}
+}
@@ -0,0 +1,303 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Estimated cost of an instance's runtime during the current month
+type InstanceCost struct {
+	InstanceName string  `json:"instance_name"`
+	Zone         string  `json:"zone"`
+	Pool         string  `json:"pool,omitempty"`
+	MachineType  string  `json:"machine_type"`
+	HourlyPrice  float64 `json:"hourly_price"`
+	RuntimeHours float64 `json:"runtime_hours"`
+	Cost         float64 `json:"cost"`
+}
+
+// Estimated spend of a pool's instances during the current month, compared to the pool's budget
+type PoolSpend struct {
+	Pool          string  `json:"pool"`
+	Month         string  `json:"month"`
+	Spend         float64 `json:"spend"`
+	MonthlyBudget float64 `json:"monthly_budget,omitempty"`
+	OverBudget    bool    `json:"over_budget"`
+}
+
+// Returns the hourly price of an instance's machine type; Spot VMs use the Spot price when one is listed
+func (costs CostConfig) hourlyPrice(instance OnDemandInstance) (float64, bool) {
+
+	if instance.Spot {
+		if price, exists := costs.SpotHourlyPrices[instance.MachineType]; exists {
+			return price, true
+		}
+	}
+
+	price, exists := costs.HourlyPrices[instance.MachineType]
+	return price, exists
+}
+
+type runningInstance struct {
+	instance     OnDemandInstance
+	accruedUntil time.Time
+}
+
+// Accumulates the runtime cost of each instance during the current month, across invocations
+// Runtime is counted from when an instance is started by the watchdog, or first observed running, until it is stopped
+// by the watchdog, or observed to no longer be running
+// An instance that is already running when first observed is counted from its last start in GCE, when that is known
+type costTracker struct {
+	mutex   sync.Mutex
+	month   time.Time
+	running map[string]*runningInstance
+	costs   map[string]*InstanceCost
+}
+
+var instanceCostTracker = newCostTracker()
+
+func newCostTracker() *costTracker {
+	return &costTracker{running: make(map[string]*runningInstance), costs: make(map[string]*InstanceCost)}
+}
+
+func getMonthStart(now time.Time) time.Time {
+
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Starts a new month when the current one has passed; costs are reported per calendar month (UTC)
+func (tracker *costTracker) rollOver(now time.Time) {
+
+	if monthStart := getMonthStart(now); !monthStart.Equal(tracker.month) {
+		tracker.month = monthStart
+		tracker.costs = make(map[string]*InstanceCost)
+	}
+}
+
+// Adds the cost of running an instance until the given time, counting only time within the current month
+func (tracker *costTracker) accrue(config Config, running *runningInstance, until time.Time) {
+
+	from := running.accruedUntil
+	if from.Before(tracker.month) {
+		from = tracker.month
+	}
+	running.accruedUntil = until
+	if !until.After(from) {
+		return
+	}
+
+	instance := running.instance
+	price, _ := config.Costs.hourlyPrice(instance)
+
+	key := getInstanceKey(instance.Zone, instance.InstanceName)
+	cost, exists := tracker.costs[key]
+	if !exists {
+		cost = &InstanceCost{InstanceName: instance.InstanceName, Zone: instance.Zone, MachineType: instance.MachineType}
+		if pool := config.poolForRunner(instance.RunnerName); pool != nil {
+			cost.Pool = pool.Name
+		}
+		tracker.costs[key] = cost
+	}
+
+	hours := until.Sub(from).Hours()
+	cost.HourlyPrice = price
+	cost.RuntimeHours += hours
+	cost.Cost += hours * price
+}
+
+// Records the status of the given instances; instances that are not listed are left alone
+// Instances that are on their way up count as running
+func (tracker *costTracker) update(config Config, onDemandInstances []OnDemandInstance, now time.Time) {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.rollOver(now)
+
+	for _, instance := range onDemandInstances {
+		key := getInstanceKey(instance.Zone, instance.InstanceName)
+		running, wasRunning := tracker.running[key]
+
+		switch {
+		case isInstanceAwake(instance.Status) && wasRunning:
+			running.instance = instance
+			tracker.accrue(config, running, now)
+		case isInstanceAwake(instance.Status) && !instance.runningSince.IsZero() && instance.runningSince.Before(now):
+			running = &runningInstance{instance: instance, accruedUntil: instance.runningSince}
+			tracker.running[key] = running
+			tracker.accrue(config, running, now)
+		case isInstanceAwake(instance.Status):
+			tracker.running[key] = &runningInstance{instance: instance, accruedUntil: now}
+		case wasRunning:
+			// The instance stopped at some point since it was last observed; assume that it ran until now
+			tracker.accrue(config, running, now)
+			delete(tracker.running, key)
+		}
+	}
+}
+
+// Returns a copy of the tracker with the status of the given instances recorded, leaving the tracker itself unchanged
+func (tracker *costTracker) withUpdate(config Config, onDemandInstances []OnDemandInstance, now time.Time) *costTracker {
+
+	tracker.mutex.Lock()
+	updated := &costTracker{month: tracker.month, running: make(map[string]*runningInstance), costs: make(map[string]*InstanceCost)}
+	for key, running := range tracker.running {
+		runningCopy := *running
+		updated.running[key] = &runningCopy
+	}
+	for key, cost := range tracker.costs {
+		costCopy := *cost
+		updated.costs[key] = &costCopy
+	}
+	tracker.mutex.Unlock()
+
+	updated.update(config, onDemandInstances, now)
+	return updated
+}
+
+// Records that the watchdog has started an instance
+func (tracker *costTracker) recordStarted(instance OnDemandInstance, startedAt time.Time) {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	key := getInstanceKey(instance.Zone, instance.InstanceName)
+	if _, exists := tracker.running[key]; !exists {
+		tracker.running[key] = &runningInstance{instance: instance, accruedUntil: startedAt}
+	}
+}
+
+// Records that the watchdog has stopped an instance
+func (tracker *costTracker) recordStopped(config Config, instance OnDemandInstance, stoppedAt time.Time) {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.rollOver(stoppedAt)
+
+	key := getInstanceKey(instance.Zone, instance.InstanceName)
+	if running, exists := tracker.running[key]; exists {
+		tracker.accrue(config, running, stoppedAt)
+		delete(tracker.running, key)
+	}
+}
+
+// Returns the spend of each pool that has incurred costs or has a budget this month
+func (tracker *costTracker) getPoolSpend(config Config, now time.Time) []PoolSpend {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.rollOver(now)
+
+	spend := make(map[string]float64)
+	for _, cost := range tracker.costs {
+		if cost.Pool != "" {
+			spend[cost.Pool] += cost.Cost
+		}
+	}
+
+	var poolSpend []PoolSpend
+	for _, pool := range config.Pools {
+		if _, exists := spend[pool.Name]; !exists && pool.MonthlyBudget == 0 {
+			continue
+		}
+		poolSpend = append(poolSpend, PoolSpend{
+			Pool:          pool.Name,
+			Month:         tracker.month.Format("2006-01"),
+			Spend:         spend[pool.Name],
+			MonthlyBudget: pool.MonthlyBudget,
+			OverBudget:    pool.MonthlyBudget > 0 && spend[pool.Name] >= pool.MonthlyBudget,
+		})
+	}
+
+	return poolSpend
+}
+
+// Returns the estimated costs of all instances that have run this month, most expensive first
+func (tracker *costTracker) getInstanceCosts(now time.Time) []InstanceCost {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.rollOver(now)
+
+	var instanceCosts []InstanceCost
+	for _, cost := range tracker.costs {
+		instanceCosts = append(instanceCosts, *cost)
+	}
+
+	sort.Slice(instanceCosts, func(i, j int) bool {
+		if instanceCosts[i].Cost != instanceCosts[j].Cost {
+			return instanceCosts[i].Cost > instanceCosts[j].Cost
+		}
+		return getInstanceKey(instanceCosts[i].Zone, instanceCosts[i].InstanceName) < getInstanceKey(instanceCosts[j].Zone, instanceCosts[j].InstanceName)
+	})
+
+	return instanceCosts
+}
+
+// Records the starts and stops that succeeded, so that runtime is counted from and to when they happened
+func (tracker *costTracker) recordAuditEvents(config Config, onDemandInstances []OnDemandInstance, auditEvents []AuditEvent) {
+
+	instances := make(map[string]OnDemandInstance)
+	for _, instance := range onDemandInstances {
+		instances[getInstanceKey(instance.Zone, instance.InstanceName)] = instance
+	}
+
+	for _, event := range auditEvents {
+		instance, exists := instances[getInstanceKey(event.Zone, event.Instance)]
+		if !exists || event.Outcome != auditOutcomeSuccess {
+			continue
+		}
+
+		switch event.Action {
+		case "start", "resume":
+			tracker.recordStarted(instance, event.Time)
+		case "stop", "suspend":
+			tracker.recordStopped(config, instance, event.Time)
+		}
+	}
+}
+
+// Removes instances of pools that have used up their monthly budget from the instances to start
+// The refused starts are returned as skipped audit events
+func applyBudgets(ctx context.Context, config Config, repository string, instancesToStart []OnDemandInstance, poolSpend []PoolSpend) ([]OnDemandInstance, []AuditEvent) {
+
+	overBudget := make(map[string]PoolSpend)
+	for _, spend := range poolSpend {
+		if spend.OverBudget {
+			overBudget[spend.Pool] = spend
+		}
+	}
+
+	var allowedInstances []OnDemandInstance
+	var refusals []AuditEvent
+
+	for _, instance := range instancesToStart {
+		pool := config.poolForRunner(instance.RunnerName)
+		if pool == nil {
+			allowedInstances = append(allowedInstances, instance)
+			continue
+		}
+
+		spend, exists := overBudget[pool.Name]
+		if !exists {
+			allowedInstances = append(allowedInstances, instance)
+			continue
+		}
+
+		reason := fmt.Sprintf("Pool %v has spent an estimated %.2f of its monthly budget of %.2f in %v", pool.Name, spend.Spend, spend.MonthlyBudget, spend.Month)
+		GetLogger(ctx).WithInstance(instance).Warningf("Instance %v will not be started: %v", instance.InstanceName, reason)
+
+		refusal := newAuditEvent(ctx, repository, getStartOperationName(instance), instance, reason)
+		refusal.Outcome = auditOutcomeSkipped
+		refusals = append(refusals, refusal)
+	}
+
+	return allowedInstances, refusals
+}
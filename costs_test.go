@@ -0,0 +1,153 @@
+package watchdog
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCostTracker(t *testing.T) {
+
+	config := Config{
+		Pools: []PoolConfig{
+			{Name: "win64", Runners: []string{"build_agent"}, MonthlyBudget: 10},
+			{Name: "linux", Runners: []string{"cook_agent"}},
+		},
+		Costs: CostConfig{
+			HourlyPrices:     map[string]float64{"e2-standard-8": 2, "n2-standard-4": 1},
+			SpotHourlyPrices: map[string]float64{"n2-standard-4": 0.25},
+		},
+	}
+
+	buildAgent := OnDemandInstance{InstanceName: "build-agent", Zone: "europe-west1-b", RunnerName: "build_agent", MachineType: "e2-standard-8", Status: "TERMINATED"}
+	cookAgent := OnDemandInstance{InstanceName: "cook-agent", Zone: "europe-west1-b", RunnerName: "cook_agent", MachineType: "n2-standard-4", Spot: true, Status: "RUNNING"}
+
+	withStatus := func(instance OnDemandInstance, status string) OnDemandInstance {
+		instance.Status = status
+		return instance
+	}
+
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	tracker := newCostTracker()
+
+	// build-agent is started by the watchdog; cook-agent is found running
+	tracker.update(config, []OnDemandInstance{buildAgent, cookAgent}, start)
+	tracker.recordStarted(buildAgent, start)
+
+	tracker.update(config, []OnDemandInstance{withStatus(buildAgent, "RUNNING"), cookAgent}, start.Add(2*time.Hour))
+
+	// build-agent is stopped by the watchdog; cook-agent is found stopped
+	tracker.recordStopped(config, buildAgent, start.Add(3*time.Hour))
+	tracker.update(config, []OnDemandInstance{buildAgent, withStatus(cookAgent, "TERMINATED")}, start.Add(4*time.Hour))
+
+	t.Run("Runtime is priced by machine type", func(t *testing.T) {
+
+		expectedCosts := []InstanceCost{
+			{InstanceName: "build-agent", Zone: "europe-west1-b", Pool: "win64", MachineType: "e2-standard-8", HourlyPrice: 2, RuntimeHours: 3, Cost: 6},
+			{InstanceName: "cook-agent", Zone: "europe-west1-b", Pool: "linux", MachineType: "n2-standard-4", HourlyPrice: 0.25, RuntimeHours: 4, Cost: 1},
+		}
+		if costs := tracker.getInstanceCosts(start.Add(4 * time.Hour)); !reflect.DeepEqual(expectedCosts, costs) {
+			t.Fatalf("Instance costs expected: %+v, actual: %+v", expectedCosts, costs)
+		}
+	})
+
+	t.Run("Spend is compared to the budget", func(t *testing.T) {
+
+		tracker.recordStarted(buildAgent, start.Add(5*time.Hour))
+		tracker.update(config, []OnDemandInstance{withStatus(buildAgent, "RUNNING")}, start.Add(7*time.Hour))
+
+		expectedSpend := []PoolSpend{
+			{Pool: "win64", Month: "2021-03", Spend: 10, MonthlyBudget: 10, OverBudget: true},
+			{Pool: "linux", Month: "2021-03", Spend: 1},
+		}
+		if spend := tracker.getPoolSpend(config, start.Add(7*time.Hour)); !reflect.DeepEqual(expectedSpend, spend) {
+			t.Fatalf("Pool spend expected: %+v, actual: %+v", expectedSpend, spend)
+		}
+	})
+
+	t.Run("Only runtime within the current month is counted", func(t *testing.T) {
+
+		nextMonth := time.Date(2021, 4, 1, 1, 0, 0, 0, time.UTC)
+		tracker.update(config, []OnDemandInstance{withStatus(buildAgent, "RUNNING")}, nextMonth)
+
+		costs := tracker.getInstanceCosts(nextMonth)
+		if len(costs) != 1 || math.Abs(costs[0].RuntimeHours-1) > 1e-9 {
+			t.Fatalf("One hour of runtime expected in April, actual: %+v", costs)
+		}
+	})
+}
+
+func TestCostTrackerCountsRuntimeSinceLastStart(t *testing.T) {
+
+	config := Config{
+		Pools: []PoolConfig{{Name: "win64", Runners: []string{"build_agent"}, MonthlyBudget: 10}},
+		Costs: CostConfig{HourlyPrices: map[string]float64{"e2-standard-8": 2}},
+	}
+
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	buildAgent := OnDemandInstance{InstanceName: "build-agent", Zone: "europe-west1-b", RunnerName: "build_agent", MachineType: "e2-standard-8", Status: "RUNNING", runningSince: now.Add(-3 * time.Hour)}
+
+	tracker := newCostTracker()
+
+	t.Run("Looking ahead leaves the tracker unchanged", func(t *testing.T) {
+
+		expectedSpend := []PoolSpend{{Pool: "win64", Month: "2021-03", Spend: 6, MonthlyBudget: 10}}
+		if spend := tracker.withUpdate(config, []OnDemandInstance{buildAgent}, now).getPoolSpend(config, now); !reflect.DeepEqual(expectedSpend, spend) {
+			t.Fatalf("Pool spend expected: %+v, actual: %+v", expectedSpend, spend)
+		}
+
+		expectedSpend = []PoolSpend{{Pool: "win64", Month: "2021-03", MonthlyBudget: 10}}
+		if spend := tracker.getPoolSpend(config, now); !reflect.DeepEqual(expectedSpend, spend) {
+			t.Fatalf("Pool spend expected: %+v, actual: %+v", expectedSpend, spend)
+		}
+	})
+
+	t.Run("An instance that is found running is counted from its last start", func(t *testing.T) {
+
+		tracker.update(config, []OnDemandInstance{buildAgent}, now)
+		tracker.update(config, []OnDemandInstance{buildAgent}, now.Add(2*time.Hour))
+
+		expectedSpend := []PoolSpend{{Pool: "win64", Month: "2021-03", Spend: 10, MonthlyBudget: 10, OverBudget: true}}
+		if spend := tracker.getPoolSpend(config, now.Add(2*time.Hour)); !reflect.DeepEqual(expectedSpend, spend) {
+			t.Fatalf("Pool spend expected: %+v, actual: %+v", expectedSpend, spend)
+		}
+	})
+}
+
+func TestApplyBudgets(t *testing.T) {
+
+	config := Config{
+		Pools: []PoolConfig{
+			{Name: "win64", Runners: []string{"build_agent"}, MonthlyBudget: 10},
+			{Name: "linux", Runners: []string{"cook_agent"}, MonthlyBudget: 10},
+		},
+	}
+
+	instancesToStart := []OnDemandInstance{
+		{InstanceName: "build-agent", Zone: "europe-west1-b", RunnerName: "build_agent", Status: "TERMINATED"},
+		{InstanceName: "cook-agent", Zone: "europe-west1-b", RunnerName: "cook_agent", Status: "TERMINATED"},
+		{InstanceName: "other-agent", Zone: "europe-west1-b", RunnerName: "other_agent", Status: "TERMINATED"},
+	}
+
+	poolSpend := []PoolSpend{
+		{Pool: "win64", Month: "2021-03", Spend: 12.5, MonthlyBudget: 10, OverBudget: true},
+		{Pool: "linux", Month: "2021-03", Spend: 2, MonthlyBudget: 10},
+	}
+
+	allowedInstances, refusals := applyBudgets(context.Background(), config, "MyOrg/MyRepo", instancesToStart, poolSpend)
+
+	if expectedInstances := instancesToStart[1:]; !reflect.DeepEqual(expectedInstances, allowedInstances) {
+		t.Fatalf("Instances to start expected: %v, actual: %v", expectedInstances, allowedInstances)
+	}
+
+	if len(refusals) != 1 || refusals[0].Instance != "build-agent" || refusals[0].Outcome != auditOutcomeSkipped {
+		t.Fatalf("A skipped start of build-agent expected, actual: %+v", refusals)
+	}
+
+	expectedReason := "Pool win64 has spent an estimated 12.50 of its monthly budget of 10.00 in 2021-03"
+	if refusals[0].Reason != expectedReason {
+		t.Fatalf("Reason expected: %v, actual: %v", expectedReason, refusals[0].Reason)
+	}
+}
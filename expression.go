@@ -0,0 +1,550 @@
+package watchdog
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// Evaluator for the subset of the GitHub Actions expression syntax that is commonly used in job-level "if:" conditions
+//
+// Evaluation is three-valued: anything that depends on information that the watchdog does not have
+// (for example, inputs, or the outcome of jobs that have not yet completed) evaluates to "unknown".
+// A job is only excluded when its condition is known to be false.
+
+type exprValueKind int
+
+const (
+	exprUnknown exprValueKind = iota
+	exprNull
+	exprBool
+	exprNumber
+	exprString
+)
+
+type exprValue struct {
+	kind exprValueKind
+	b    bool
+	n    float64
+	s    string
+}
+
+var unknownValue = exprValue{kind: exprUnknown}
+
+func boolValue(b bool) exprValue {
+	return exprValue{kind: exprBool, b: b}
+}
+
+func stringValue(s string) exprValue {
+	return exprValue{kind: exprString, s: s}
+}
+
+// The information available when evaluating the condition of a job
+type expressionContext struct {
+	EventName string
+	Ref       string
+	RefName   string
+
+	// Status of the jobs that the job needs; NeedsFailed is set when any of them has completed without success
+	NeedsCompleted bool
+	NeedsFailed    bool
+}
+
+// Evaluates to the same value as success() for the job
+func (context expressionContext) success() exprValue {
+	if context.NeedsFailed {
+		return boolValue(false)
+	}
+	if !context.NeedsCompleted {
+		return unknownValue
+	}
+	return boolValue(true)
+}
+
+func (value exprValue) truthy() bool {
+	switch value.kind {
+	case exprBool:
+		return value.b
+	case exprNumber:
+		return value.n != 0 && !math.IsNaN(value.n)
+	case exprString:
+		return value.s != ""
+	default:
+		return false
+	}
+}
+
+func (value exprValue) number() float64 {
+	switch value.kind {
+	case exprNull:
+		return 0
+	case exprBool:
+		if value.b {
+			return 1
+		}
+		return 0
+	case exprNumber:
+		return value.n
+	case exprString:
+		if strings.TrimSpace(value.s) == "" {
+			return 0
+		}
+		n, err := strconv.ParseFloat(strings.TrimSpace(value.s), 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return n
+	default:
+		return math.NaN()
+	}
+}
+
+type exprTokenKind int
+
+const (
+	tokenIdentifier exprTokenKind = iota
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenEnd
+)
+
+type exprToken struct {
+	kind  exprTokenKind
+	value string
+}
+
+func tokenizeExpression(expression string) ([]exprToken, error) {
+
+	var tokens []exprToken
+	runes := []rune(expression)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '\'':
+			// String literals use single quotes; a quote within a string is written as two quotes
+			var builder strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, errors.Errorf("Unterminated string literal in expression \"%v\"", expression)
+				}
+				if runes[i] == '\'' {
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						builder.WriteRune('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				builder.WriteRune(runes[i])
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokenString, value: builder.String()})
+
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokenNumber, value: string(runes[start:i])})
+
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '-' || runes[i] == '.' || runes[i] == '*') {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokenIdentifier, value: string(runes[start:i])})
+
+		default:
+			operator := ""
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", ",", "[", "]"} {
+				if strings.HasPrefix(string(runes[i:]), candidate) {
+					operator = candidate
+					break
+				}
+			}
+			if operator == "" {
+				return nil, errors.Errorf("Unexpected character '%c' in expression \"%v\"", r, expression)
+			}
+			tokens = append(tokens, exprToken{kind: tokenOperator, value: operator})
+			i += len(operator)
+		}
+	}
+
+	return append(tokens, exprToken{kind: tokenEnd}), nil
+}
+
+type exprParser struct {
+	tokens  []exprToken
+	pos     int
+	context expressionContext
+
+	// Set when the expression calls success(), failure(), cancelled() or always()
+	usesStatusFunction bool
+}
+
+func (parser *exprParser) peek() exprToken {
+	return parser.tokens[parser.pos]
+}
+
+func (parser *exprParser) next() exprToken {
+	token := parser.tokens[parser.pos]
+	if token.kind != tokenEnd {
+		parser.pos++
+	}
+	return token
+}
+
+func (parser *exprParser) acceptOperator(operator string) bool {
+	if token := parser.peek(); token.kind == tokenOperator && token.value == operator {
+		parser.pos++
+		return true
+	}
+	return false
+}
+
+func (parser *exprParser) parseOr() (exprValue, error) {
+
+	left, err := parser.parseAnd()
+	if err != nil {
+		return unknownValue, err
+	}
+
+	for parser.acceptOperator("||") {
+		right, err := parser.parseAnd()
+		if err != nil {
+			return unknownValue, err
+		}
+
+		if (left.kind != exprUnknown && left.truthy()) || (right.kind != exprUnknown && right.truthy()) {
+			left = boolValue(true)
+		} else if left.kind == exprUnknown || right.kind == exprUnknown {
+			left = unknownValue
+		} else {
+			left = boolValue(false)
+		}
+	}
+
+	return left, nil
+}
+
+func (parser *exprParser) parseAnd() (exprValue, error) {
+
+	left, err := parser.parseEquality()
+	if err != nil {
+		return unknownValue, err
+	}
+
+	for parser.acceptOperator("&&") {
+		right, err := parser.parseEquality()
+		if err != nil {
+			return unknownValue, err
+		}
+
+		if (left.kind != exprUnknown && !left.truthy()) || (right.kind != exprUnknown && !right.truthy()) {
+			left = boolValue(false)
+		} else if left.kind == exprUnknown || right.kind == exprUnknown {
+			left = unknownValue
+		} else {
+			left = boolValue(true)
+		}
+	}
+
+	return left, nil
+}
+
+func (parser *exprParser) parseEquality() (exprValue, error) {
+
+	left, err := parser.parseComparison()
+	if err != nil {
+		return unknownValue, err
+	}
+
+	for {
+		var negate bool
+		if parser.acceptOperator("==") {
+			negate = false
+		} else if parser.acceptOperator("!=") {
+			negate = true
+		} else {
+			return left, nil
+		}
+
+		right, err := parser.parseComparison()
+		if err != nil {
+			return unknownValue, err
+		}
+
+		if left.kind == exprUnknown || right.kind == exprUnknown {
+			left = unknownValue
+		} else {
+			left = boolValue(valuesEqual(left, right) != negate)
+		}
+	}
+}
+
+// Strings are compared case-insensitively; values of different kinds are compared as numbers
+func valuesEqual(left exprValue, right exprValue) bool {
+
+	if left.kind == exprString && right.kind == exprString {
+		return strings.EqualFold(left.s, right.s)
+	}
+
+	if left.kind == right.kind && left.kind != exprNumber {
+		return left.b == right.b
+	}
+
+	return left.number() == right.number()
+}
+
+func (parser *exprParser) parseComparison() (exprValue, error) {
+
+	left, err := parser.parseUnary()
+	if err != nil {
+		return unknownValue, err
+	}
+
+	for {
+		token := parser.peek()
+		if token.kind != tokenOperator || (token.value != "<" && token.value != "<=" && token.value != ">" && token.value != ">=") {
+			return left, nil
+		}
+		parser.next()
+
+		right, err := parser.parseUnary()
+		if err != nil {
+			return unknownValue, err
+		}
+
+		if left.kind == exprUnknown || right.kind == exprUnknown {
+			left = unknownValue
+			continue
+		}
+
+		var leftNumber, rightNumber float64
+		var result bool
+		if left.kind == exprString && right.kind == exprString {
+			comparison := strings.Compare(strings.ToLower(left.s), strings.ToLower(right.s))
+			leftNumber, rightNumber = float64(comparison), 0
+		} else {
+			leftNumber, rightNumber = left.number(), right.number()
+		}
+
+		switch token.value {
+		case "<":
+			result = leftNumber < rightNumber
+		case "<=":
+			result = leftNumber <= rightNumber
+		case ">":
+			result = leftNumber > rightNumber
+		case ">=":
+			result = leftNumber >= rightNumber
+		}
+		left = boolValue(result)
+	}
+}
+
+func (parser *exprParser) parseUnary() (exprValue, error) {
+
+	if parser.acceptOperator("!") {
+		value, err := parser.parseUnary()
+		if err != nil {
+			return unknownValue, err
+		}
+		if value.kind == exprUnknown {
+			return unknownValue, nil
+		}
+		return boolValue(!value.truthy()), nil
+	}
+
+	return parser.parsePrimary()
+}
+
+func (parser *exprParser) parsePrimary() (exprValue, error) {
+
+	token := parser.next()
+
+	switch token.kind {
+	case tokenString:
+		return stringValue(token.value), nil
+
+	case tokenNumber:
+		n, err := strconv.ParseFloat(token.value, 64)
+		if err != nil {
+			return unknownValue, errors.Errorf("Invalid number %v", token.value)
+		}
+		return exprValue{kind: exprNumber, n: n}, nil
+
+	case tokenOperator:
+		if token.value == "(" {
+			value, err := parser.parseOr()
+			if err != nil {
+				return unknownValue, err
+			}
+			if !parser.acceptOperator(")") {
+				return unknownValue, errors.New("Expected ')'")
+			}
+			return value, nil
+		}
+		return unknownValue, errors.Errorf("Unexpected operator %v", token.value)
+
+	case tokenIdentifier:
+		if parser.acceptOperator("(") {
+			return parser.parseFunctionCall(token.value)
+		}
+
+		value := parser.lookup(token.value)
+
+		// Index expressions (e.g. "github.event['inputs']") are not supported, and evaluate to unknown
+		for parser.acceptOperator("[") {
+			if _, err := parser.parseOr(); err != nil {
+				return unknownValue, err
+			}
+			if !parser.acceptOperator("]") {
+				return unknownValue, errors.New("Expected ']'")
+			}
+			value = unknownValue
+		}
+		return value, nil
+	}
+
+	return unknownValue, errors.New("Unexpected end of expression")
+}
+
+func (parser *exprParser) lookup(identifier string) exprValue {
+
+	switch strings.ToLower(identifier) {
+	case "true":
+		return boolValue(true)
+	case "false":
+		return boolValue(false)
+	case "null":
+		return exprValue{kind: exprNull}
+	case "github.event_name":
+		return stringValue(parser.context.EventName)
+	case "github.ref":
+		if parser.context.Ref == "" {
+			return unknownValue
+		}
+		return stringValue(parser.context.Ref)
+	case "github.ref_name":
+		if parser.context.RefName == "" {
+			return unknownValue
+		}
+		return stringValue(parser.context.RefName)
+	default:
+		// inputs, vars, needs outputs etc. are not provided by the workflow runs API
+		return unknownValue
+	}
+}
+
+func (parser *exprParser) parseFunctionCall(name string) (exprValue, error) {
+
+	var args []exprValue
+	if !parser.acceptOperator(")") {
+		for {
+			arg, err := parser.parseOr()
+			if err != nil {
+				return unknownValue, err
+			}
+			args = append(args, arg)
+
+			if parser.acceptOperator(")") {
+				break
+			}
+			if !parser.acceptOperator(",") {
+				return unknownValue, errors.Errorf("Expected ',' or ')' in call to %v", name)
+			}
+		}
+	}
+
+	switch strings.ToLower(name) {
+	case "always":
+		parser.usesStatusFunction = true
+		return boolValue(true), nil
+	case "success":
+		parser.usesStatusFunction = true
+		return parser.context.success(), nil
+	case "failure":
+		parser.usesStatusFunction = true
+		if parser.context.NeedsFailed {
+			return boolValue(true), nil
+		}
+		if !parser.context.NeedsCompleted {
+			return unknownValue, nil
+		}
+		return boolValue(false), nil
+	case "cancelled":
+		parser.usesStatusFunction = true
+		return unknownValue, nil
+	case "startswith", "endswith", "contains":
+		if len(args) != 2 {
+			return unknownValue, errors.Errorf("%v() expects 2 arguments", name)
+		}
+		if args[0].kind != exprString || args[1].kind != exprString {
+			return unknownValue, nil
+		}
+		haystack, needle := strings.ToLower(args[0].s), strings.ToLower(args[1].s)
+		switch strings.ToLower(name) {
+		case "startswith":
+			return boolValue(strings.HasPrefix(haystack, needle)), nil
+		case "endswith":
+			return boolValue(strings.HasSuffix(haystack, needle)), nil
+		default:
+			return boolValue(strings.Contains(haystack, needle)), nil
+		}
+	default:
+		return unknownValue, nil
+	}
+}
+
+// Conditions may optionally be written with the ${{ }} expression syntax
+func stripExpressionSyntax(condition string) string {
+
+	condition = strings.TrimSpace(condition)
+	if strings.HasPrefix(condition, "${{") && strings.HasSuffix(condition, "}}") {
+		condition = strings.TrimSpace(condition[3 : len(condition)-2])
+	}
+	return condition
+}
+
+// Determines whether a job with the given "if:" condition might run
+// Conditions that do not check job status are implicitly combined with success(), just like GitHub does
+// Returns false only when the condition is known to be false; unparseable conditions are assumed to be true
+func mightJobRun(condition string, context expressionContext) bool {
+
+	condition = stripExpressionSyntax(condition)
+	if condition == "" {
+		condition = "success()"
+	}
+
+	tokens, err := tokenizeExpression(condition)
+	if err != nil {
+		return true
+	}
+
+	parser := &exprParser{tokens: tokens, context: context}
+	value, err := parser.parseOr()
+	if err != nil || parser.peek().kind != tokenEnd {
+		return true
+	}
+
+	if !parser.usesStatusFunction {
+		if success := context.success(); success.kind == exprBool && !success.b {
+			return false
+		}
+	}
+
+	return value.kind == exprUnknown || value.truthy()
+}
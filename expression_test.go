@@ -0,0 +1,56 @@
+package watchdog
+
+import (
+	"testing"
+)
+
+func TestMightJobRun(t *testing.T) {
+
+	pushToMain := expressionContext{EventName: "push", Ref: "refs/heads/main", RefName: "main", NeedsCompleted: true}
+	needsRunning := expressionContext{EventName: "push", Ref: "refs/heads/main", RefName: "main", NeedsCompleted: false}
+	needsFailed := expressionContext{EventName: "push", Ref: "refs/heads/main", RefName: "main", NeedsCompleted: true, NeedsFailed: true}
+	unknownRef := expressionContext{EventName: "pull_request", NeedsCompleted: true}
+
+	testCases := []struct {
+		condition string
+		context   expressionContext
+		expected  bool
+	}{
+		{"", pushToMain, true},
+		{"", needsFailed, false},
+		{"", needsRunning, true},
+		{"github.event_name == 'release'", pushToMain, false},
+		{"${{ github.event_name == 'push' }}", pushToMain, true},
+		{"github.event_name == 'PUSH'", pushToMain, true},
+		{"github.event_name != 'push'", pushToMain, false},
+		{"github.event_name == 'push' && github.ref_name == 'release'", pushToMain, false},
+		{"github.event_name == 'release' || github.ref_name == 'main'", pushToMain, true},
+		{"!(github.event_name == 'push')", pushToMain, false},
+		{"startsWith(github.ref_name, 'ma')", pushToMain, true},
+		{"contains(github.ref_name, 'release')", pushToMain, false},
+		{"github.ref == 'refs/tags/v1'", pushToMain, false},
+		{"github.ref == 'refs/heads/main'", pushToMain, true},
+		{"github.ref == 'refs/tags/v1'", unknownRef, true},
+		{"github.ref_name == 'main'", unknownRef, true},
+		{"inputs.deploy == 'true'", pushToMain, true},
+		{"github.event_name == 'release' && inputs.deploy == 'true'", pushToMain, false},
+		{"github.event_name == 'push' && github.event.inputs['deploy']", pushToMain, true},
+		{"github.event_name == 'push'", needsFailed, false},
+		{"always()", needsFailed, true},
+		{"failure()", needsFailed, true},
+		{"failure()", pushToMain, false},
+		{"failure()", needsRunning, true},
+		{"success() && github.event_name == 'release'", needsRunning, false},
+		{"false", pushToMain, false},
+		{"1 == 1", pushToMain, true},
+		{"'it''s' == 'it''s'", pushToMain, true},
+		{"github.event_name == ", pushToMain, true},
+		{"github.event_name == 'push", pushToMain, true},
+	}
+
+	for _, testCase := range testCases {
+		if result := mightJobRun(testCase.condition, testCase.context); result != testCase.expected {
+			t.Errorf("Condition \"%v\" with context %+v: expected %v, actual %v", testCase.condition, testCase.context, testCase.expected, result)
+		}
+	}
+}
@@ -5,11 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/google/go-github/v32/github"
+	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
 	"google.golang.org/api/compute/v1"
 )
@@ -17,16 +19,17 @@ import (
 var ctx context.Context
 var computeService *compute.Service
 
+// Creating the Compute Engine client fails when no Google Cloud credentials are available;
+// this is reported when the client is first needed, so that e.g. configuration validation works without credentials
+var computeServiceErr error
+
 var httpClient *http.Client
 var gitHubClient *github.Client
 
 func init() {
 	ctx = context.Background()
 
-	var err error
-	if computeService, err = compute.NewService(ctx); err != nil {
-		log.Fatalln(err)
-	}
+	computeService, computeServiceErr = compute.NewService(ctx)
 
 	accessToken := os.Getenv("GITHUB_PAT")
 
@@ -34,13 +37,48 @@ func init() {
 	httpClient = oauth2.NewClient(ctx, tokenSource)
 
 	gitHubClient = github.NewClient(httpClient)
+
+	// Tracing is diagnostic only; the watchdog keeps working without it
+	if err := initTracing(ctx); err != nil {
+		GetLogger(ctx).Warningf("Tracing is disabled: %+v", err)
+	}
 }
 
 type Result struct {
-	RunnersRequired   []string           `json:"runners_required"`
-	OnDemandInstances []OnDemandInstance `json:"on_demand_instances"`
-	StartedInstances  []OnDemandInstance `json:"started_instances"`
-	StoppedInstances  []OnDemandInstance `json:"stopped_instances"`
+	RunnersRequired    []RunsOn            `json:"runners_required"`
+	RunnersPreWarmed   []RunsOn            `json:"runners_pre_warmed"`
+	OnDemandInstances  []OnDemandInstance  `json:"on_demand_instances"`
+	StartedInstances   []OnDemandInstance  `json:"started_instances"`
+	StoppedInstances   []OnDemandInstance  `json:"stopped_instances"`
+	Failovers          []Failover          `json:"failovers"`
+	InstanceGroups     []InstanceGroupSize `json:"instance_groups"`
+	StuckInstances     []StuckInstance     `json:"stuck_instances"`
+	UnhealthyInstances []UnhealthyInstance `json:"unhealthy_instances"`
+	StaleRuns          []StaleRun          `json:"stale_runs"`
+	QueueLatencies     []QueueLatency      `json:"queue_latencies"`
+	AuditEvents        []AuditEvent        `json:"audit_events"`
+	InstanceCosts      []InstanceCost      `json:"instance_costs"`
+	Spend              []PoolSpend         `json:"spend"`
+	Warnings           []Warning           `json:"warnings"`
+
+	// One entry per job that needs a runner; used for sizing Managed Instance Groups across all repositories
+	jobRunners []RunsOn
+
+	// The jobs behind jobRunners
+	jobDemands []jobDemand
+
+	// The instances among StoppedInstances that exceeded their pool's max-runtime
+	runawayInstances []OnDemandInstance
+
+	// What Plan observed about the instances of a single repository; recorded by Process
+	observations planObservations
+}
+
+// Describes a workflow run whose runner requirements could not be determined
+type Warning struct {
+	RunID        int64  `json:"run_id"`
+	WorkflowPath string `json:"workflow_path,omitempty"`
+	Message      string `json:"message"`
 }
 
 type LogMessage struct {
@@ -48,22 +86,324 @@ type LogMessage struct {
 	Severity string `json:"severity"`
 }
 
-func produceInternalServerError(w http.ResponseWriter, format string, params ...interface{}) {
+func produceInternalServerError(ctx context.Context, w http.ResponseWriter, format string, params ...interface{}) {
 	w.WriteHeader(http.StatusInternalServerError)
 
 	logMessage := LogMessage{Message: fmt.Sprintf(format, params...), Severity: "error"}
+	GetLogger(ctx).Errorf("%s", logMessage.Message)
+
 	jsonLogMessage, err := json.Marshal(logMessage)
 	if err != nil {
-		log.Printf("Error while marshalling log message to json: %v\n", logMessage)
+		GetLogger(ctx).Errorf("Error while marshalling log message to json: %v", logMessage)
 	} else {
 		w.Header().Set("Content-Type", "application/json")
 
 		fmt.Fprint(w, string(jsonLogMessage))
-		fmt.Println(string(jsonLogMessage))
 	}
 }
 
+// Tests whether any of the runners required or pre-warmed can be served by the instance
+func (result *Result) IsInstanceRequired(instance OnDemandInstance) bool {
+	return isInstanceRequired(result.RunnersRequired, instance) || isInstanceRequired(result.RunnersPreWarmed, instance)
+}
+
+func (result *Result) merge(other *Result) {
+	result.RunnersRequired = append(result.RunnersRequired, other.RunnersRequired...)
+	result.RunnersPreWarmed = append(result.RunnersPreWarmed, other.RunnersPreWarmed...)
+	result.OnDemandInstances = append(result.OnDemandInstances, other.OnDemandInstances...)
+	result.StartedInstances = append(result.StartedInstances, other.StartedInstances...)
+	result.StoppedInstances = append(result.StoppedInstances, other.StoppedInstances...)
+	result.Failovers = append(result.Failovers, other.Failovers...)
+	result.InstanceGroups = append(result.InstanceGroups, other.InstanceGroups...)
+	result.StuckInstances = append(result.StuckInstances, other.StuckInstances...)
+	result.UnhealthyInstances = append(result.UnhealthyInstances, other.UnhealthyInstances...)
+	result.StaleRuns = append(result.StaleRuns, other.StaleRuns...)
+	result.AuditEvents = append(result.AuditEvents, other.AuditEvents...)
+	result.Warnings = append(result.Warnings, other.Warnings...)
+	result.jobRunners = append(result.jobRunners, other.jobRunners...)
+	result.jobDemands = append(result.jobDemands, other.jobDemands...)
+}
+
+// JSON consumers expect empty lists rather than nulls
+func (result *Result) replaceNilSlicesWithEmpty() {
+	if result.RunnersRequired == nil {
+		result.RunnersRequired = make([]RunsOn, 0)
+	}
+	if result.RunnersPreWarmed == nil {
+		result.RunnersPreWarmed = make([]RunsOn, 0)
+	}
+	if result.OnDemandInstances == nil {
+		result.OnDemandInstances = make([]OnDemandInstance, 0)
+	}
+	if result.StartedInstances == nil {
+		result.StartedInstances = make([]OnDemandInstance, 0)
+	}
+	if result.StoppedInstances == nil {
+		result.StoppedInstances = make([]OnDemandInstance, 0)
+	}
+	if result.Failovers == nil {
+		result.Failovers = make([]Failover, 0)
+	}
+	if result.InstanceGroups == nil {
+		result.InstanceGroups = make([]InstanceGroupSize, 0)
+	}
+	if result.StuckInstances == nil {
+		result.StuckInstances = make([]StuckInstance, 0)
+	}
+	if result.UnhealthyInstances == nil {
+		result.UnhealthyInstances = make([]UnhealthyInstance, 0)
+	}
+	if result.StaleRuns == nil {
+		result.StaleRuns = make([]StaleRun, 0)
+	}
+	if result.QueueLatencies == nil {
+		result.QueueLatencies = make([]QueueLatency, 0)
+	}
+	if result.AuditEvents == nil {
+		result.AuditEvents = make([]AuditEvent, 0)
+	}
+	if result.InstanceCosts == nil {
+		result.InstanceCosts = make([]InstanceCost, 0)
+	}
+	if result.Spend == nil {
+		result.Spend = make([]PoolSpend, 0)
+	}
+	if result.Warnings == nil {
+		result.Warnings = make([]Warning, 0)
+	}
+}
+
+func checkComputeService() error {
+	if computeServiceErr != nil {
+		return errors.Wrap(computeServiceErr, "Unable to create Compute Engine client")
+	}
+	return nil
+}
+
+// Only one reconcile cycle runs at a time, regardless of whether it was triggered via HTTP, by a scheduler or from the command line
+var reconcileMutex sync.Mutex
+
+// Performs one reconcile cycle for each repository: starts instances that are needed, and stops instances that are not
+// Results for all repositories are combined
+func Reconcile(ctx context.Context, config Config) (*Result, error) {
+
+	ctx = withCorrelationID(ctx)
+	ctx, span := startSpan(ctx, "Reconcile")
+
+	start := time.Now()
+	result, err := reconcile(ctx, config)
+	observeReconcile(start, err)
+	endSpan(span, err)
+	if err == nil {
+		observeReconcileResult(result)
+	}
+
+	return result, err
+}
+
+func reconcile(ctx context.Context, config Config) (*Result, error) {
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := checkComputeService(); err != nil {
+		return nil, err
+	}
+
+	reconcileMutex.Lock()
+	defer reconcileMutex.Unlock()
+
+	result := &Result{}
+
+	for _, repository := range config.Repositories {
+		repositoryResult, err := Process(ctx, computeService, httpClient, gitHubClient, config, repository)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error during processing of GitHub repo %v", repository)
+		}
+
+		result.merge(repositoryResult)
+	}
+
+	now := time.Now()
+	instanceGroups, err := planInstanceGroups(ctx, computeService, config, result.jobRunners, len(result.Warnings) != 0, now)
+	if err != nil {
+		return nil, err
+	}
+	instanceGroupScaleDownTracker.update(instanceGroups, now)
+
+	if err := resizeInstanceGroups(ctx, computeService, gitHubClient, config, instanceGroups); err != nil {
+		return nil, err
+	}
+	result.InstanceGroups = instanceGroups
+
+	// Statistics are collected across repositories, so they are computed once rather than merged
+	result.QueueLatencies = jobQueueLatencyTracker.statistics(time.Now())
+	result.InstanceCosts = instanceCostTracker.getInstanceCosts(time.Now())
+	result.Spend = instanceCostTracker.getPoolSpend(config, time.Now())
+
+	result.replaceNilSlicesWithEmpty()
+
+	return result, nil
+}
+
+// Determines what a reconcile cycle would do, without starting or stopping any instances
+func ReconcileDryRun(ctx context.Context, config Config) (result *Result, err error) {
+
+	ctx = withCorrelationID(ctx)
+	ctx, span := startSpan(ctx, "ReconcileDryRun")
+	defer func() { endSpan(span, err) }()
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := checkComputeService(); err != nil {
+		return nil, err
+	}
+
+	result = &Result{}
+
+	for _, repository := range config.Repositories {
+		repositoryResult, err := Plan(ctx, computeService, httpClient, gitHubClient, config, repository)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error during planning of GitHub repo %v", repository)
+		}
+
+		result.merge(repositoryResult)
+	}
+
+	instanceGroups, err := planInstanceGroups(ctx, computeService, config, result.jobRunners, len(result.Warnings) != 0, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	result.InstanceGroups = instanceGroups
+
+	// Statistics are collected across repositories, so they are computed once rather than merged
+	result.QueueLatencies = jobQueueLatencyTracker.statistics(time.Now())
+	result.InstanceCosts = instanceCostTracker.getInstanceCosts(time.Now())
+	result.Spend = instanceCostTracker.getPoolSpend(config, time.Now())
+
+	result.replaceNilSlicesWithEmpty()
+
+	return result, nil
+}
+
+func getOnDemandInstancesForRunner(ctx context.Context, config Config, runnerName string) ([]OnDemandInstance, error) {
+
+	var onDemandInstancesForRunner []OnDemandInstance
+
+	for _, repository := range config.Repositories {
+		onDemandInstances, err := getOnDemandInstancesForRepository(ctx, computeService, config, repository.Organization, repository.Repository)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, instance := range onDemandInstances {
+			if instance.RunnerName == runnerName {
+				onDemandInstancesForRunner = append(onDemandInstancesForRunner, instance)
+			}
+		}
+	}
+
+	if len(onDemandInstancesForRunner) == 0 {
+		return nil, errors.Errorf("No on-demand instance found for runner %v", runnerName)
+	}
+
+	return onDemandInstancesForRunner, nil
+}
+
+// Manually starts the instance(s) that serve the given runner, regardless of whether any jobs require it
+func StartRunner(ctx context.Context, config Config, runnerName string) (instances []OnDemandInstance, err error) {
+
+	ctx = withCorrelationID(ctx)
+	ctx, span := startSpan(ctx, "StartRunner", attributeRunner.String(runnerName))
+	defer func() { endSpan(span, err) }()
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := checkComputeService(); err != nil {
+		return nil, err
+	}
+
+	reconcileMutex.Lock()
+	defer reconcileMutex.Unlock()
+
+	instances, err = getOnDemandInstancesForRunner(ctx, config, runnerName)
+	if err != nil {
+		return nil, err
+	}
+
+	var plannedEvents []AuditEvent
+	for _, instance := range instances {
+		plannedEvents = append(plannedEvents, newAuditEvent(ctx, instance.GitHubScope, getStartOperationName(instance), instance, fmt.Sprintf("Requested via StartRunner for runner %v", runnerName)))
+	}
+
+	// Audit events are written even when the operation fails part-way
+	trail := newAuditTrail(plannedEvents)
+	ctx = withAuditTrail(ctx, trail)
+	defer func() { writeAuditEvents(ctx, config.Audit, trail.finish(err)) }()
+
+	if err := startInstances(ctx, computeService, config.Project, instances); err != nil {
+		return nil, err
+	}
+
+	return instances, nil
+}
+
+// Manually stops the instance(s) that serve the given runner, regardless of whether any jobs require it
+func StopRunner(ctx context.Context, config Config, runnerName string) (instances []OnDemandInstance, err error) {
+
+	ctx = withCorrelationID(ctx)
+	ctx, span := startSpan(ctx, "StopRunner", attributeRunner.String(runnerName))
+	defer func() { endSpan(span, err) }()
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := checkComputeService(); err != nil {
+		return nil, err
+	}
+
+	reconcileMutex.Lock()
+	defer reconcileMutex.Unlock()
+
+	instances, err = getOnDemandInstancesForRunner(ctx, config, runnerName)
+	if err != nil {
+		return nil, err
+	}
+
+	var plannedEvents []AuditEvent
+	for _, instance := range instances {
+		plannedEvents = append(plannedEvents, newAuditEvent(ctx, instance.GitHubScope, getStopOperationName(instance), instance, fmt.Sprintf("Requested via StopRunner for runner %v", runnerName)))
+	}
+
+	// Audit events are written even when the operation fails part-way
+	trail := newAuditTrail(plannedEvents)
+	ctx = withAuditTrail(ctx, trail)
+	defer func() { writeAuditEvents(ctx, config.Audit, trail.finish(err)) }()
+
+	if err := stopInstances(ctx, computeService, config.Project, instances); err != nil {
+		return nil, err
+	}
+
+	return instances, nil
+}
+
+// Entry point for Cloud Functions; performs one reconcile cycle per HTTP request
 func RunWatchdog(w http.ResponseWriter, r *http.Request) {
+	serveWatchdog(w, r, RunModeFunction)
+}
+
+// Performs one reconcile cycle per HTTP request, within the long-lived process of daemon mode
+func RunWatchdogInDaemonMode(w http.ResponseWriter, r *http.Request) {
+	serveWatchdog(w, r, RunModeDaemon)
+}
+
+func serveWatchdog(w http.ResponseWriter, r *http.Request, mode RunMode) {
 
 	// Any panics within the application will result in a HTTP 500 Internal Server Error response
 	// This handler ensures that:
@@ -78,57 +418,38 @@ func RunWatchdog(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	if _, err := ioutil.ReadAll(r.Body); err != nil {
-		produceInternalServerError(w, "Error while discarding body: %+v\n", err)
-		return
-	}
+	ctx := withTraceCorrelationID(ctx, r.Header.Get("X-Cloud-Trace-Context"))
 
-	project := os.Getenv("GOOGLE_CLOUD_PROJECT")
-	if project == "" {
-		produceInternalServerError(w, "Misconfigured function: GCP_PROJECT must be set")
-		return
-	}
+	defer func() {
+		if err := FlushTraces(ctx); err != nil {
+			GetLogger(ctx).Warningf("Unable to export traces: %v", err)
+		}
+	}()
 
-	zone := os.Getenv("GCE_ZONE")
-	if zone == "" {
-		produceInternalServerError(w, "Misconfigured function: GCE_ZONE must be set")
+	if _, err := ioutil.ReadAll(r.Body); err != nil {
+		produceInternalServerError(ctx, w, "Error while discarding body: %+v\n", err)
 		return
 	}
 
-	gitHubOrganization := os.Getenv("GITHUB_ORGANIZATION")
-	if gitHubOrganization == "" {
-		produceInternalServerError(w, "Misconfigured function: GITHUB_ORGANIZATION must be set")
+	config, err := LoadConfigFromEnvironment()
+	if err != nil {
+		produceInternalServerError(ctx, w, "%+v\n", err)
 		return
 	}
 
-	gitHubRepository := os.Getenv("GITHUB_REPOSITORY")
-	if gitHubRepository == "" {
-		produceInternalServerError(w, "Misconfigured function: GITHUB_REPOSITORY must be set")
+	if err := config.ValidateForRunMode(mode); err != nil {
+		produceInternalServerError(ctx, w, "%+v\n", err)
 		return
 	}
 
-	runnersRequired, onDemandInstances, startedInstances, stoppedInstances, err := Process(ctx, computeService, httpClient, gitHubClient, project, zone, gitHubOrganization, gitHubRepository)
+	result, err := Reconcile(ctx, config)
 	if err != nil {
-		produceInternalServerError(w, "Error during processing: %+v\n", err)
+		produceInternalServerError(ctx, w, "%+v\n", err)
 		return
 	}
 
-	if runnersRequired == nil {
-		runnersRequired = make([]string, 0)
-	}
-	if onDemandInstances == nil {
-		onDemandInstances = make([]OnDemandInstance, 0)
-	}
-	if startedInstances == nil {
-		startedInstances = make([]OnDemandInstance, 0)
-	}
-	if stoppedInstances == nil {
-		stoppedInstances = make([]OnDemandInstance, 0)
-	}
-	result := &Result{RunnersRequired: runnersRequired, OnDemandInstances: onDemandInstances, StartedInstances: startedInstances, StoppedInstances: stoppedInstances}
-
 	if err := json.NewEncoder(w).Encode(result); err != nil {
-		produceInternalServerError(w, "Error during result json encoding: %+v\n", err)
+		produceInternalServerError(ctx, w, "Error during result json encoding: %+v\n", err)
 		return
 	}
 }
@@ -1,30 +1,79 @@
 package watchdog
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 )
 
-type RunsOn []string
+// GitHub allows reusable workflows to call other reusable workflows, up to this many levels of workflows in total,
+// including the top-level caller workflow
+const maxReusableWorkflowDepth = 4
+
+// Describes which runners a job can run on
+// Group is only set when the job uses the object form of "runs-on"
+type RunsOn struct {
+	Group  string   `json:"group,omitempty"`
+	Labels []string `json:"labels"`
+}
+
+type runsOnObject struct {
+	Group  string      `yaml:"group"`
+	Labels interface{} `yaml:"labels"`
+}
+
+// Keys of the jobs that must complete before a job can run
+type Needs []string
 
 type GitHubWorkflowYamlJob struct {
 	Name   string `yaml:"name"`
 	RunsOn RunsOn `yaml:"runs-on"`
+	Uses   string `yaml:"uses"`
+	Needs  Needs  `yaml:"needs"`
+	If     string `yaml:"if"`
 }
 
 type GitHubWorkflowYamlJobs struct {
 	Jobs map[string]GitHubWorkflowYamlJob `yaml:"jobs"`
 }
 
+// Identifies a specific version of a workflow file within a GitHub repository
+type workflowLocation struct {
+	Organization string
+	Repository   string
+	Ref          string
+	Path         string
+}
+
+// A job as declared in a workflow file, identified by the name that GitHub reports for it
+// Needs lists the names (not keys) of the jobs that it depends on
+type WorkflowFileJob struct {
+	RunsOn RunsOn
+	Needs  []string
+	If     string
+}
+
+type workflowFileFetcher func(location workflowLocation) (string, error)
+
 // Implements the Unmarshaler interface of the yaml pkg.
 func (runsOn *RunsOn) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 	var runsOnSingle string
 	var runsOnArray []string
+	var runsOnMapping runsOnObject
 	if err := unmarshal(&runsOnSingle); err == nil {
-		*runsOn = RunsOn{runsOnSingle}
+		*runsOn = RunsOn{Labels: []string{runsOnSingle}}
 	} else if err := unmarshal(&runsOnArray); err == nil {
-		*runsOn = runsOnArray
+		*runsOn = RunsOn{Labels: runsOnArray}
+	} else if err := unmarshal(&runsOnMapping); err == nil {
+		labels, err := parseRunsOnLabels(runsOnMapping.Labels)
+		if err != nil {
+			return err
+		}
+		*runsOn = RunsOn{Group: runsOnMapping.Group, Labels: labels}
 	} else {
 		return errors.New("Unable to deserialize \"runs-on\"")
 	}
@@ -32,6 +81,71 @@ func (runsOn *RunsOn) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// The "labels" entry within the object form of "runs-on" can be either a single string or a list of strings
+func parseRunsOnLabels(labels interface{}) ([]string, error) {
+
+	switch labels := labels.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{labels}, nil
+	case []interface{}:
+		var result []string
+		for _, label := range labels {
+			labelString, ok := label.(string)
+			if !ok {
+				return nil, errors.Errorf("Unable to deserialize \"runs-on.labels\": %v is not a string", label)
+			}
+			result = append(result, labelString)
+		}
+		return result, nil
+	default:
+		return nil, errors.Errorf("Unable to deserialize \"runs-on.labels\": %v is neither a string nor a list of strings", labels)
+	}
+}
+
+// Tests whether a runner with the given name and group satisfies the requirement
+// Runner names act as labels; a requirement without labels is satisfied by any runner in the group
+func (runsOn RunsOn) MatchesRunner(runnerName string, runnerGroup string) bool {
+
+	if runsOn.Group != "" && runsOn.Group != runnerGroup {
+		return false
+	}
+
+	if len(runsOn.Labels) == 0 {
+		return runsOn.Group != ""
+	}
+
+	for _, label := range runsOn.Labels {
+		if label == runnerName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A runs-on that only names a runner group can be served by any runner in the group
+func (runsOn RunsOn) matchesAnyRunnerInGroup() bool {
+	return runsOn.Group != "" && len(runsOn.Labels) == 0
+}
+
+// Implements the Unmarshaler interface of the yaml pkg.
+func (needs *Needs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+
+	var needsSingle string
+	var needsArray []string
+	if err := unmarshal(&needsSingle); err == nil {
+		*needs = Needs{needsSingle}
+	} else if err := unmarshal(&needsArray); err == nil {
+		*needs = needsArray
+	} else {
+		return errors.New("Unable to deserialize \"needs\"")
+	}
+
+	return nil
+}
+
 func parseWorkflowFile(workflowFile string) (map[string]GitHubWorkflowYamlJob, error) {
 
 	var jobs GitHubWorkflowYamlJobs
@@ -43,14 +157,57 @@ func parseWorkflowFile(workflowFile string) (map[string]GitHubWorkflowYamlJob, e
 	return jobs.Jobs, nil
 }
 
-func getJobsAndRunnersInWorkflowFile(workflowFile string) (map[string]RunsOn, error) {
+// Resolves the "uses:" value of a job that calls a reusable workflow
+// Local references ("./.github/workflows/build.yml") refer to the same repository and commit as the caller,
+// remote references have the form "owner/repo/path/to/workflow.yml@ref"
+func parseReusableWorkflowReference(uses string, caller workflowLocation) (workflowLocation, error) {
+
+	if strings.HasPrefix(uses, "./") {
+		return workflowLocation{Organization: caller.Organization, Repository: caller.Repository, Ref: caller.Ref, Path: strings.TrimPrefix(uses, "./")}, nil
+	}
+
+	atIndex := strings.LastIndex(uses, "@")
+	if atIndex == -1 {
+		return workflowLocation{}, errors.Errorf("Reusable workflow reference \"%v\" is missing a ref", uses)
+	}
+
+	segments := strings.SplitN(uses[:atIndex], "/", 3)
+	ref := uses[atIndex+1:]
+	if len(segments) != 3 || segments[0] == "" || segments[1] == "" || segments[2] == "" || ref == "" {
+		return workflowLocation{}, errors.Errorf("Reusable workflow reference \"%v\" should be of the form \"owner/repo/path@ref\"", uses)
+	}
+
+	return workflowLocation{Organization: segments[0], Repository: segments[1], Ref: ref, Path: segments[2]}, nil
+}
+
+func combineConditions(condition1 string, condition2 string) string {
+
+	if condition1 == "" {
+		return condition2
+	} else if condition2 == "" {
+		return condition1
+	}
+
+	return fmt.Sprintf("(%s) && (%s)", stripExpressionSyntax(condition1), stripExpressionSyntax(condition2))
+}
+
+func getJobsAndRunnersInWorkflowFile(workflowFile string, location workflowLocation, fetchWorkflowFile workflowFileFetcher) (map[string]WorkflowFileJob, error) {
+
+	return getJobsAndRunnersInWorkflowFileRecursive(workflowFile, location, fetchWorkflowFile, 0)
+}
+
+func getJobsAndRunnersInWorkflowFileRecursive(workflowFile string, location workflowLocation, fetchWorkflowFile workflowFileFetcher, depth int) (map[string]WorkflowFileJob, error) {
 
 	parsedWorkflowFile, err := parseWorkflowFile(workflowFile)
 	if err != nil {
 		return nil, err
 	}
 
-	jobsAndRunners := make(map[string]RunsOn)
+	// A job that calls a reusable workflow expands to several jobs; these are resolved first,
+	// so that "needs:" references to the calling job can be expanded to all of the called jobs
+
+	jobNames := make(map[string][]string)
+	calledJobs := make(map[string]map[string]WorkflowFileJob)
 
 	for key, value := range parsedWorkflowFile {
 
@@ -59,7 +216,71 @@ func getJobsAndRunnersInWorkflowFile(workflowFile string) (map[string]RunsOn, er
 			jobName = value.Name
 		}
 
-		jobsAndRunners[jobName] = value.RunsOn
+		if value.Uses == "" {
+			jobNames[key] = []string{jobName}
+			continue
+		}
+
+		// Jobs within a called workflow are reported by GitHub as "<caller job> / <called job>"
+
+		if depth+1 >= maxReusableWorkflowDepth {
+			return nil, errors.Errorf("Job %v in workflow %v calls reusable workflow %v, which exceeds the maximum nesting depth of %v", key, location.Path, value.Uses, maxReusableWorkflowDepth)
+		}
+
+		if fetchWorkflowFile == nil {
+			return nil, errors.Errorf("Job %v in workflow %v calls reusable workflow %v, but no means of fetching workflow files has been provided", key, location.Path, value.Uses)
+		}
+
+		calledLocation, err := parseReusableWorkflowReference(value.Uses, location)
+		if err != nil {
+			return nil, err
+		}
+
+		calledWorkflowFile, err := fetchWorkflowFile(calledLocation)
+		if err != nil {
+			return nil, err
+		}
+
+		calledJobsAndRunners, err := getJobsAndRunnersInWorkflowFileRecursive(calledWorkflowFile, calledLocation, fetchWorkflowFile, depth+1)
+		if err != nil {
+			return nil, err
+		}
+
+		calledJobs[key] = make(map[string]WorkflowFileJob)
+		for calledJobName, calledJob := range calledJobsAndRunners {
+			var needs []string
+			for _, need := range calledJob.Needs {
+				needs = append(needs, fmt.Sprintf("%s / %s", jobName, need))
+			}
+			compositeJobName := fmt.Sprintf("%s / %s", jobName, calledJobName)
+			calledJobs[key][compositeJobName] = WorkflowFileJob{RunsOn: calledJob.RunsOn, Needs: needs, If: calledJob.If}
+			jobNames[key] = append(jobNames[key], compositeJobName)
+		}
+	}
+
+	jobsAndRunners := make(map[string]WorkflowFileJob)
+
+	for key, value := range parsedWorkflowFile {
+
+		var needs []string
+		for _, need := range value.Needs {
+			neededJobNames, exists := jobNames[need]
+			if !exists {
+				return nil, errors.Errorf("Job %v in workflow %v needs job %v, which does not exist", key, location.Path, need)
+			}
+			needs = append(needs, neededJobNames...)
+		}
+		sort.Strings(needs)
+
+		if value.Uses == "" {
+			jobsAndRunners[jobNames[key][0]] = WorkflowFileJob{RunsOn: value.RunsOn, Needs: needs, If: value.If}
+			continue
+		}
+
+		// The condition on the calling job applies to all the called jobs
+		for compositeJobName, calledJob := range calledJobs[key] {
+			jobsAndRunners[compositeJobName] = WorkflowFileJob{RunsOn: calledJob.RunsOn, Needs: append(calledJob.Needs, needs...), If: combineConditions(value.If, calledJob.If)}
+		}
 	}
 
 	return jobsAndRunners, nil
@@ -1,6 +1,7 @@
 package watchdog
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
 )
@@ -67,7 +68,7 @@ jobs:
 		t.Fatalf("placeholder name should be \"echo hello world, just to get started\" but is %s", jobs["placeholder"].Name)
 	}
 
-	if !reflect.DeepEqual(jobs["placeholder"].RunsOn, RunsOn{"ubuntu-latest", "ubuntu-1804"}) {
+	if !reflect.DeepEqual(jobs["placeholder"].RunsOn, RunsOn{Labels: []string{"ubuntu-latest", "ubuntu-1804"}}) {
 		t.Fatalf("placeholder runs-on should be [ubuntu-latest ubuntu-1804] but is %s", jobs["placeholder"].RunsOn)
 	}
 
@@ -79,11 +80,47 @@ jobs:
 		t.Fatalf("build-win64 name should be \"Build for Win64\" but is %s", jobs["build-win64"].Name)
 	}
 
-	if !reflect.DeepEqual(jobs["build-win64"].RunsOn, RunsOn{"build_agent"}) {
+	if !reflect.DeepEqual(jobs["build-win64"].RunsOn, RunsOn{Labels: []string{"build_agent"}}) {
 		t.Fatalf("build-win64 runs-on should be [build_agent] but is %s", jobs["build-win64"].RunsOn)
 	}
 }
 
+func TestParseGitHubActionsWorkflowFileWithRunsOnObject(t *testing.T) {
+
+	yamlFile := `
+jobs:
+  build-win64:
+    runs-on:
+      group: ue4-agents
+      labels: [ build_agent_win64 ]
+
+  build-linux:
+    runs-on:
+      group: ue4-agents
+      labels: build_agent_linux
+
+  any-agent:
+    runs-on:
+      group: ue4-agents
+`
+	jobs, err := parseWorkflowFile(yamlFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedRunsOn := map[string]RunsOn{
+		"build-win64": {Group: "ue4-agents", Labels: []string{"build_agent_win64"}},
+		"build-linux": {Group: "ue4-agents", Labels: []string{"build_agent_linux"}},
+		"any-agent":   {Group: "ue4-agents"},
+	}
+
+	for jobName, runsOn := range expectedRunsOn {
+		if !reflect.DeepEqual(jobs[jobName].RunsOn, runsOn) {
+			t.Fatalf("%v runs-on should be %v but is %v", jobName, runsOn, jobs[jobName].RunsOn)
+		}
+	}
+}
+
 func TestParseGitHubActionsWorkflowFileFailed(t *testing.T) {
 
 	yamlFile := `
@@ -144,14 +181,14 @@ jobs:
         run: .\UploadGame ${{ github.sha }}
 `
 
-	jobsAndRunners, err := getJobsAndRunnersInWorkflowFile(yamlFile)
+	jobsAndRunners, err := getJobsAndRunnersInWorkflowFile(yamlFile, workflowLocation{}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	if _, ok := jobsAndRunners["placeholder"]; ok {
 
-		if !reflect.DeepEqual(jobsAndRunners["placeholder"], RunsOn{"ubuntu-latest", "ubuntu-1804"}) {
+		if !reflect.DeepEqual(jobsAndRunners["placeholder"].RunsOn, RunsOn{Labels: []string{"ubuntu-latest", "ubuntu-1804"}}) {
 			t.Fatalf("placeholder runs-on should be [ubuntu-latest ubuntu-1804] but is %s", jobsAndRunners["placeholder"])
 		}
 
@@ -161,7 +198,7 @@ jobs:
 
 	if _, ok := jobsAndRunners["Build for Win64"]; ok {
 
-		if !reflect.DeepEqual(jobsAndRunners["Build for Win64"], RunsOn{"build_agent"}) {
+		if !reflect.DeepEqual(jobsAndRunners["Build for Win64"].RunsOn, RunsOn{Labels: []string{"build_agent"}}) {
 			t.Fatalf("build-win64 runs-on should be [build_agent] but is %s", jobsAndRunners["build-win64"])
 		}
 
@@ -169,3 +206,235 @@ jobs:
 		t.Fatal("The key \"Build for Win64\" should exist in the resulting jobs-and-runners map")
 	}
 }
+
+func TestGetJobsAndRunnersInWorkflowFileWithNeeds(t *testing.T) {
+
+	yamlFile := `
+jobs:
+  build-win64:
+    name: "Build for Win64"
+    runs-on: build_agent
+
+  package-win64:
+    needs: build-win64
+    runs-on: package_agent
+
+  publish:
+    needs: [ build-win64, package-win64 ]
+    runs-on: ubuntu-latest
+`
+
+	jobsAndRunners, err := getJobsAndRunnersInWorkflowFile(yamlFile, workflowLocation{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedJobsAndRunners := map[string]WorkflowFileJob{
+		"Build for Win64": {RunsOn: RunsOn{Labels: []string{"build_agent"}}},
+		"package-win64":   {RunsOn: RunsOn{Labels: []string{"package_agent"}}, Needs: []string{"Build for Win64"}},
+		"publish":         {RunsOn: RunsOn{Labels: []string{"ubuntu-latest"}}, Needs: []string{"Build for Win64", "package-win64"}},
+	}
+	if !reflect.DeepEqual(expectedJobsAndRunners, jobsAndRunners) {
+		t.Fatalf("Jobs and runners expected: %v, actual: %v", expectedJobsAndRunners, jobsAndRunners)
+	}
+
+	t.Run("Needs a job which does not exist", func(t *testing.T) {
+
+		yamlFile := `
+jobs:
+  package-win64:
+    needs: build-win64
+    runs-on: package_agent
+`
+		if _, err := getJobsAndRunnersInWorkflowFile(yamlFile, workflowLocation{}, nil); err == nil {
+			t.Fatal("Should have failed")
+		}
+	})
+}
+
+func TestParseReusableWorkflowReference(t *testing.T) {
+
+	caller := workflowLocation{Organization: "MyOrg", Repository: "MyRepo", Ref: "12345678", Path: ".github/workflows/build.yml"}
+
+	t.Run("Local reference", func(t *testing.T) {
+
+		location, err := parseReusableWorkflowReference("./.github/workflows/ue4-build.yml", caller)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedLocation := workflowLocation{Organization: "MyOrg", Repository: "MyRepo", Ref: "12345678", Path: ".github/workflows/ue4-build.yml"}
+		if location != expectedLocation {
+			t.Fatalf("Location expected: %v, actual: %v", expectedLocation, location)
+		}
+	})
+
+	t.Run("Remote reference", func(t *testing.T) {
+
+		location, err := parseReusableWorkflowReference("OtherOrg/SharedWorkflows/.github/workflows/ue4-build.yml@v1", caller)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedLocation := workflowLocation{Organization: "OtherOrg", Repository: "SharedWorkflows", Ref: "v1", Path: ".github/workflows/ue4-build.yml"}
+		if location != expectedLocation {
+			t.Fatalf("Location expected: %v, actual: %v", expectedLocation, location)
+		}
+	})
+
+	t.Run("Remote reference without ref", func(t *testing.T) {
+
+		if _, err := parseReusableWorkflowReference("OtherOrg/SharedWorkflows/.github/workflows/ue4-build.yml", caller); err == nil {
+			t.Fatal("Should have failed")
+		}
+	})
+}
+
+func TestGetJobsAndRunnersInWorkflowFileWithReusableWorkflows(t *testing.T) {
+
+	callerYamlFile := `
+jobs:
+  build:
+    name: "Build"
+    uses: ./.github/workflows/ue4-build.yml
+
+  deploy:
+    needs: build
+    uses: OtherOrg/SharedWorkflows/.github/workflows/deploy.yml@v1
+`
+
+	workflowFiles := map[workflowLocation]string{
+		{Organization: "MyOrg", Repository: "MyRepo", Ref: "12345678", Path: ".github/workflows/ue4-build.yml"}: `
+jobs:
+  build-win64:
+    name: "Build for Win64"
+    runs-on: build_agent
+
+  package:
+    needs: build-win64
+    uses: ./.github/workflows/package.yml
+`,
+		{Organization: "MyOrg", Repository: "MyRepo", Ref: "12345678", Path: ".github/workflows/package.yml"}: `
+jobs:
+  package-win64:
+    runs-on: package_agent
+`,
+		{Organization: "OtherOrg", Repository: "SharedWorkflows", Ref: "v1", Path: ".github/workflows/deploy.yml"}: `
+jobs:
+  upload:
+    runs-on: [ ubuntu-latest ]
+`,
+	}
+
+	fetchWorkflowFile := func(location workflowLocation) (string, error) {
+		if workflowFile, exists := workflowFiles[location]; exists {
+			return workflowFile, nil
+		}
+		return "", fmt.Errorf("Workflow file %v not found", location)
+	}
+
+	location := workflowLocation{Organization: "MyOrg", Repository: "MyRepo", Ref: "12345678", Path: ".github/workflows/build.yml"}
+
+	jobsAndRunners, err := getJobsAndRunnersInWorkflowFile(callerYamlFile, location, fetchWorkflowFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedJobsAndRunners := map[string]WorkflowFileJob{
+		"Build / Build for Win64":         {RunsOn: RunsOn{Labels: []string{"build_agent"}}},
+		"Build / package / package-win64": {RunsOn: RunsOn{Labels: []string{"package_agent"}}, Needs: []string{"Build / Build for Win64"}},
+		"deploy / upload":                 {RunsOn: RunsOn{Labels: []string{"ubuntu-latest"}}, Needs: []string{"Build / Build for Win64", "Build / package / package-win64"}},
+	}
+	if !reflect.DeepEqual(expectedJobsAndRunners, jobsAndRunners) {
+		t.Fatalf("Jobs and runners expected: %v, actual: %v", expectedJobsAndRunners, jobsAndRunners)
+	}
+
+	t.Run("Recursion beyond max depth", func(t *testing.T) {
+
+		recursiveYamlFile := `
+jobs:
+  recurse:
+    uses: ./.github/workflows/recursive.yml
+`
+		fetchRecursiveWorkflowFile := func(location workflowLocation) (string, error) {
+			return recursiveYamlFile, nil
+		}
+
+		if _, err := getJobsAndRunnersInWorkflowFile(recursiveYamlFile, location, fetchRecursiveWorkflowFile); err == nil {
+			t.Fatal("Should have failed")
+		}
+	})
+
+	t.Run("Nesting up to the max depth", func(t *testing.T) {
+
+		// level0.yml calls level1.yml, which calls level2.yml, and so on
+		getLevelYamlFile := func(level int, levels int) string {
+			if level == levels-1 {
+				return `
+jobs:
+  build:
+    runs-on: build_agent
+`
+			}
+			return fmt.Sprintf(`
+jobs:
+  call:
+    uses: ./.github/workflows/level%d.yml
+`, level+1)
+		}
+
+		for _, levels := range []int{maxReusableWorkflowDepth, maxReusableWorkflowDepth + 1} {
+			fetchLevelWorkflowFile := func(location workflowLocation) (string, error) {
+				var level int
+				if _, err := fmt.Sscanf(location.Path, ".github/workflows/level%d.yml", &level); err != nil {
+					return "", err
+				}
+				return getLevelYamlFile(level, levels), nil
+			}
+
+			_, err := getJobsAndRunnersInWorkflowFile(getLevelYamlFile(0, levels), location, fetchLevelWorkflowFile)
+			if levels <= maxReusableWorkflowDepth && err != nil {
+				t.Fatalf("%v levels of workflows should be accepted, actual: %v", levels, err)
+			}
+			if levels > maxReusableWorkflowDepth && err == nil {
+				t.Fatalf("%v levels of workflows should be rejected", levels)
+			}
+		}
+	})
+}
+
+func TestGetJobsAndRunnersInWorkflowFileWithConditions(t *testing.T) {
+
+	callerYamlFile := `
+jobs:
+  build:
+    runs-on: build_agent
+    if: github.event_name == 'push'
+
+  publish:
+    if: ${{ github.event_name == 'release' }}
+    uses: ./.github/workflows/publish.yml
+`
+
+	fetchWorkflowFile := func(location workflowLocation) (string, error) {
+		return `
+jobs:
+  upload:
+    runs-on: ubuntu-latest
+    if: true
+`, nil
+	}
+
+	jobsAndRunners, err := getJobsAndRunnersInWorkflowFile(callerYamlFile, workflowLocation{}, fetchWorkflowFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if jobsAndRunners["build"].If != "github.event_name == 'push'" {
+		t.Fatalf("build if should be \"github.event_name == 'push'\" but is \"%v\"", jobsAndRunners["build"].If)
+	}
+
+	if jobsAndRunners["publish / upload"].If != "(github.event_name == 'release') && (true)" {
+		t.Fatalf("publish / upload if should be \"(github.event_name == 'release') && (true)\" but is \"%v\"", jobsAndRunners["publish / upload"].If)
+	}
+}
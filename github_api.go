@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/google/go-github/v32/github"
 	"github.com/pkg/errors"
@@ -14,7 +15,9 @@ func getWorkflowRunsWithStatus(ctx context.Context, gitHubClient *github.Client,
 
 	options := &github.ListWorkflowRunsOptions{Status: status}
 
+	ctx, call := startAPICall(ctx, apiGitHub, "Actions.ListRepositoryWorkflowRuns", attributeRepository.String(organization+"/"+repository))
 	workflowRuns, _, err := gitHubClient.Actions.ListRepositoryWorkflowRuns(ctx, organization, repository, options)
+	call.end(err)
 	if err != nil {
 		return nil, errors.Wrapf(err, "github.Client.Actions.ListRepositoryWorkflowRuns(%v, %v, %v) failed", organization, repository, options)
 	}
@@ -48,9 +51,11 @@ func getActiveWorkflowRuns(ctx context.Context, gitHubClient *github.Client, org
 	return activeWorkflowRuns, nil
 }
 
-func getWorkflow(context context.Context, gitHubClient *github.Client, organization string, repository string, workflow_id int64) (*github.Workflow, error) {
+func getWorkflow(ctx context.Context, gitHubClient *github.Client, organization string, repository string, workflow_id int64) (*github.Workflow, error) {
 
-	workflow, _, err := gitHubClient.Actions.GetWorkflowByID(context, organization, repository, workflow_id)
+	ctx, call := startAPICall(ctx, apiGitHub, "Actions.GetWorkflowByID", attributeRepository.String(organization+"/"+repository), attributeWorkflowID.Int64(workflow_id))
+	workflow, _, err := gitHubClient.Actions.GetWorkflowByID(ctx, organization, repository, workflow_id)
+	call.end(err)
 	if err != nil {
 		return nil, errors.Wrapf(err, "github.Client.Actions.GetWorkflowByID(%v, %v, %v) failed", organization, repository, workflow_id)
 	}
@@ -58,10 +63,16 @@ func getWorkflow(context context.Context, gitHubClient *github.Client, organizat
 	return workflow, nil
 }
 
-func getWorkflowFile(httpClient *http.Client, organization string, repository string, commit string, path string) (string, error) {
+func getWorkflowFile(ctx context.Context, httpClient *http.Client, organization string, repository string, commit string, path string) (content string, err error) {
+
+	ctx, call := startAPICall(ctx, apiGitHub, "GetWorkflowFile", attributeRepository.String(organization+"/"+repository), attributeWorkflowPath.String(path))
+	defer func() { call.end(err) }()
 
 	uri := fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/%s/%s", organization, repository, commit, path)
-	request, err := http.NewRequest("GET", uri, nil)
+	request, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "http.NewRequest(GET, %v) failed", uri)
+	}
 	response, err := httpClient.Do(request)
 	if err != nil {
 		return "", errors.Wrapf(err, "HTTP GET %v failed", uri)
@@ -69,7 +80,7 @@ func getWorkflowFile(httpClient *http.Client, organization string, repository st
 
 	defer response.Body.Close()
 
-	content, err := ioutil.ReadAll(response.Body)
+	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		return "", errors.Wrapf(err, "Error while reading HTTP response from HTTP GET %v", uri)
 	}
@@ -78,15 +89,232 @@ func getWorkflowFile(httpClient *http.Client, organization string, repository st
 		return "", errors.Errorf("HTTP GET %v returned status code %v", uri, response.Status)
 	}
 
-	return string(content), nil
+	return string(body), nil
+}
+
+// A job of a workflow run as reported by GitHub
+// go-github's WorkflowJob does not include the runner that the job runs on, so the jobs API is decoded into this instead
+type gitHubWorkflowJob struct {
+	*github.WorkflowJob
+	RunnerName string `json:"runner_name"`
+}
+
+// Returns the jobs of a workflow run, and the names of the runners that the jobs run on, by job name
+func getJobsForRun(ctx context.Context, gitHubClient *github.Client, organization string, repository string, runId int64) ([]*github.WorkflowJob, map[string]string, error) {
+
+	uri := fmt.Sprintf("repos/%v/%v/actions/runs/%v/jobs", organization, repository, runId)
+	request, err := gitHubClient.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "github.Client.NewRequest(GET, %v) failed", uri)
+	}
+
+	var jobsPage struct {
+		TotalCount int                  `json:"total_count"`
+		Jobs       []*gitHubWorkflowJob `json:"jobs"`
+	}
+
+	ctx, call := startAPICall(ctx, apiGitHub, "Actions.ListWorkflowJobs", attributeRepository.String(organization+"/"+repository), attributeRunID.Int64(runId))
+	_, err = gitHubClient.Do(ctx, request, &jobsPage)
+	call.end(err)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "github.Client.Actions.ListWorkflowJobs(%v, %v, %v) failed", organization, repository, runId)
+	}
+
+	var jobs []*github.WorkflowJob
+	runnerNames := make(map[string]string)
+	for _, job := range jobsPage.Jobs {
+		if job.WorkflowJob == nil {
+			continue
+		}
+		jobs = append(jobs, job.WorkflowJob)
+		if job.Name != nil && job.RunnerName != "" {
+			runnerNames[*job.Name] = job.RunnerName
+		}
+	}
+
+	return jobs, runnerNames, nil
+}
+
+func cancelWorkflowRun(ctx context.Context, gitHubClient *github.Client, organization string, repository string, runId int64) error {
+
+	ctx, call := startAPICall(ctx, apiGitHub, "Actions.CancelWorkflowRunByID", attributeRepository.String(organization+"/"+repository), attributeRunID.Int64(runId))
+	_, err := gitHubClient.Actions.CancelWorkflowRunByID(ctx, organization, repository, runId)
+	// GitHub accepts the cancellation with 202 Accepted, which go-github reports as an error
+	if _, accepted := err.(*github.AcceptedError); accepted {
+		err = nil
+	}
+	call.end(err)
+	if err != nil {
+		return errors.Wrapf(err, "github.Client.Actions.CancelWorkflowRunByID(%v, %v, %v) failed", organization, repository, runId)
+	}
+
+	return nil
 }
 
-func getJobsForRun(ctx context.Context, gitHubClient *github.Client, organization string, repository string, runId int64) ([]*github.WorkflowJob, error) {
+// Returns how long each job took to run, in the most recent successful run of the workflow
+func getJobDurationsForWorkflow(ctx context.Context, gitHubClient *github.Client, organization string, repository string, workflowId int64) (map[string]time.Duration, error) {
+
+	options := &github.ListWorkflowRunsOptions{Status: "success", ListOptions: github.ListOptions{PerPage: 1}}
+
+	listCtx, call := startAPICall(ctx, apiGitHub, "Actions.ListWorkflowRunsByID", attributeRepository.String(organization+"/"+repository), attributeWorkflowID.Int64(workflowId))
+	workflowRuns, _, err := gitHubClient.Actions.ListWorkflowRunsByID(listCtx, organization, repository, workflowId, options)
+	call.end(err)
+	if err != nil {
+		return nil, errors.Wrapf(err, "github.Client.Actions.ListWorkflowRunsByID(%v, %v, %v, %v) failed", organization, repository, workflowId, options)
+	}
+
+	jobDurations := make(map[string]time.Duration)
 
-	jobs, _, err := gitHubClient.Actions.ListWorkflowJobs(ctx, organization, repository, runId, nil)
+	if len(workflowRuns.WorkflowRuns) == 0 {
+		return jobDurations, nil
+	}
+
+	jobs, _, err := getJobsForRun(ctx, gitHubClient, organization, repository, *workflowRuns.WorkflowRuns[0].ID)
 	if err != nil {
-		return nil, errors.Wrapf(err, "github.Client.Actions.ListWorkflowJobs(%v, %v, %v) failed", organization, repository, runId)
+		return nil, err
+	}
+
+	for _, job := range jobs {
+		if job.Name != nil && job.StartedAt != nil && job.CompletedAt != nil {
+			jobDurations[*job.Name] = job.CompletedAt.Sub(job.StartedAt.Time)
+		}
+	}
+
+	return jobDurations, nil
+}
+
+// A self-hosted runner as reported by GitHub
+// go-github's Runner does not include whether the runner is busy, so the runners API is decoded into this instead
+type gitHubRunner struct {
+	ID     int64  `json:"id"`
+	Name   string `json:"name"`
+	OS     string `json:"os"`
+	Status string `json:"status"`
+	Busy   bool   `json:"busy"`
+}
+
+// Lists all pages of a runners endpoint, such as repos/{owner}/{repo}/actions/runners
+func listSelfHostedRunners(ctx context.Context, gitHubClient *github.Client, path string, method string, scope string) ([]gitHubRunner, error) {
+
+	var runners []gitHubRunner
+
+	for page := 1; page != 0; {
+		uri := fmt.Sprintf("%v?per_page=100&page=%v", path, page)
+		request, err := gitHubClient.NewRequest("GET", uri, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "github.Client.NewRequest(GET, %v) failed", uri)
+		}
+
+		var runnersPage struct {
+			TotalCount int            `json:"total_count"`
+			Runners    []gitHubRunner `json:"runners"`
+		}
+
+		listCtx, call := startAPICall(ctx, apiGitHub, method, attributeRepository.String(scope))
+		response, err := gitHubClient.Do(listCtx, request, &runnersPage)
+		call.end(err)
+		if err != nil {
+			return nil, errors.Wrapf(err, "github.Client.%v(%v) failed", method, scope)
+		}
+
+		runners = append(runners, runnersPage.Runners...)
+		page = response.NextPage
+	}
+
+	return runners, nil
+}
+
+func getSelfHostedRunners(ctx context.Context, gitHubClient *github.Client, organization string, repository string) ([]gitHubRunner, error) {
+	return listSelfHostedRunners(ctx, gitHubClient, fmt.Sprintf("repos/%v/%v/actions/runners", organization, repository), "Actions.ListRunners", organization+"/"+repository)
+}
+
+// Lists the self-hosted runners that are registered with an organization; these include the runners in runner groups
+func getOrganizationSelfHostedRunners(ctx context.Context, gitHubClient *github.Client, organization string) ([]gitHubRunner, error) {
+	return listSelfHostedRunners(ctx, gitHubClient, fmt.Sprintf("orgs/%v/actions/runners", organization), "Actions.ListOrganizationRunners", organization)
+}
+
+// Runners that belong to a runner group are registered with the organization rather than with a repository
+func usesOrganizationRunners(config Config, instances []OnDemandInstance) bool {
+
+	for _, pool := range config.Pools {
+		if pool.RunnerGroup != "" {
+			return true
+		}
+	}
+
+	for _, instance := range instances {
+		if instance.RunnerGroup != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Lists the self-hosted runners of several repositories, and optionally those of their organizations
+func getSelfHostedRunnersForRepositories(ctx context.Context, gitHubClient *github.Client, repositories []RepositoryConfig, includeOrganizations bool) ([]gitHubRunner, error) {
+
+	var runners []gitHubRunner
+	organizationsListed := make(map[string]bool)
+
+	for _, repository := range repositories {
+		repositoryRunners, err := getSelfHostedRunners(ctx, gitHubClient, repository.Organization, repository.Repository)
+		if err != nil {
+			return nil, err
+		}
+		runners = append(runners, repositoryRunners...)
+
+		if includeOrganizations && !organizationsListed[repository.Organization] {
+			organizationRunners, err := getOrganizationSelfHostedRunners(ctx, gitHubClient, repository.Organization)
+			if err != nil {
+				return nil, err
+			}
+			runners = append(runners, organizationRunners...)
+			organizationsListed[repository.Organization] = true
+		}
+	}
+
+	return runners, nil
+}
+
+// Returns whether a runner name reported by GitHub refers to the given instance: the runner is named after the instance,
+// or after the instance's runner name, as long as no other awake instance carries the same runner name
+// Instances that are not awake cannot be running a runner, so equivalent instances in other zones do not make the name ambiguous
+func isRunnerOfInstance(runnerName string, instance OnDemandInstance, onDemandInstances []OnDemandInstance) bool {
+
+	if runnerName == "" {
+		return false
+	}
+	if runnerName == instance.InstanceName {
+		return true
+	}
+	if runnerName != instance.RunnerName {
+		return false
+	}
+
+	for _, other := range onDemandInstances {
+		if other.RunnerName == instance.RunnerName && isInstanceAwake(other.Status) && getInstanceKey(other.Zone, other.InstanceName) != getInstanceKey(instance.Zone, instance.InstanceName) {
+			return false
+		}
+	}
+	return true
+}
+
+// Finds the GitHub runner that runs on an instance: the runner that is named after the instance, or else after the instance's runner name,
+// when that name does not also refer to other instances
+func findGitHubRunner(instance OnDemandInstance, onDemandInstances []OnDemandInstance, runners []gitHubRunner) *gitHubRunner {
+
+	for index, runner := range runners {
+		if runner.Name == instance.InstanceName {
+			return &runners[index]
+		}
+	}
+
+	for index, runner := range runners {
+		if isRunnerOfInstance(runner.Name, instance, onDemandInstances) {
+			return &runners[index]
+		}
 	}
 
-	return jobs.Jobs, nil
+	return nil
 }
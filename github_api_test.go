@@ -2,23 +2,28 @@ package watchdog
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
 
 	"github.com/google/go-github/v32/github"
 )
 
 func testingHTTPClient(handler http.Handler) (*http.Client, func()) {
-	s := httptest.NewServer(handler)
+	s := httptest.NewTLSServer(handler)
 
 	cli := &http.Client{
 		Transport: &http.Transport{
 			DialContext: func(_ context.Context, network, _ string) (net.Conn, error) {
 				return net.Dial(network, s.Listener.Addr().String())
 			},
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
 		},
 	}
 
@@ -29,7 +34,7 @@ func TestGetWorkflowFile(t *testing.T) {
 
 	httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		if r.URL.String() == "/MyOrg/MyRepo/raw/12345678/.github/workflows/build.yaml" {
+		if r.URL.String() == "/MyOrg/MyRepo/12345678/.github/workflows/build.yaml" {
 			w.Header().Set("Content-Type", "text/plain")
 			fmt.Fprintln(w, `
 			name: Build
@@ -86,7 +91,7 @@ func TestGetWorkflowFile(t *testing.T) {
 
 	t.Run("Fetch workflow file that exists", func(t *testing.T) {
 
-		_, err := getWorkflowFile(httpClient, "MyOrg", "MyRepo", "12345678", ".github/workflows/build.yaml")
+		_, err := getWorkflowFile(context.Background(), httpClient, "MyOrg", "MyRepo", "12345678", ".github/workflows/build.yaml")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -94,7 +99,7 @@ func TestGetWorkflowFile(t *testing.T) {
 
 	t.Run("Fetch workflow file that does not exist", func(t *testing.T) {
 
-		_, err := getWorkflowFile(httpClient, "MyOrg2", "MyRepo2", "12345679", ".github/workflows/build.yaml")
+		_, err := getWorkflowFile(context.Background(), httpClient, "MyOrg2", "MyRepo2", "12345679", ".github/workflows/build.yaml")
 		if err == nil {
 			t.Fatal("Should have failed")
 		}
@@ -151,3 +156,65 @@ func TestGetWorkflow(t *testing.T) {
 		}
 	})
 }
+
+func TestGetJobsForRun(t *testing.T) {
+
+	httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path != "/repos/MyOrg/MyRepo/actions/runs/1234/jobs" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		fmt.Fprintln(w, `{ "total_count": 2, "jobs": [
+			{ "id": 1, "name": "compile", "status": "in_progress", "runner_name": "build-agent-1" },
+			{ "id": 2, "name": "cook", "status": "queued", "runner_name": null } ] }`)
+	}))
+	defer teardown()
+
+	jobs, runnerNames, err := getJobsForRun(context.Background(), github.NewClient(httpClient), "MyOrg", "MyRepo", 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 2 || jobs[0].GetName() != "compile" || jobs[1].GetStatus() != "queued" {
+		t.Fatalf("Jobs compile and cook expected, actual: %v", jobs)
+	}
+
+	expectedRunnerNames := map[string]string{"compile": "build-agent-1"}
+	if !reflect.DeepEqual(expectedRunnerNames, runnerNames) {
+		t.Fatalf("Runner names expected: %v, actual: %v", expectedRunnerNames, runnerNames)
+	}
+}
+
+func TestGetSelfHostedRunners(t *testing.T) {
+
+	httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path != "/repos/MyOrg/MyRepo/actions/runners" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if r.URL.Query().Get("page") == "1" {
+			w.Header().Set("Link", `<https://api.github.com/repos/MyOrg/MyRepo/actions/runners?per_page=100&page=2>; rel="next"`)
+			fmt.Fprintln(w, `{ "total_count": 2, "runners": [ { "id": 1, "name": "build-agent-1", "os": "windows", "status": "online", "busy": true } ] }`)
+		} else {
+			fmt.Fprintln(w, `{ "total_count": 2, "runners": [ { "id": 2, "name": "build-agent-2", "os": "windows", "status": "offline", "busy": false } ] }`)
+		}
+	}))
+	defer teardown()
+
+	runners, err := getSelfHostedRunners(context.Background(), github.NewClient(httpClient), "MyOrg", "MyRepo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedRunners := []gitHubRunner{
+		{ID: 1, Name: "build-agent-1", OS: "windows", Status: "online", Busy: true},
+		{ID: 2, Name: "build-agent-2", OS: "windows", Status: "offline", Busy: false},
+	}
+	if !reflect.DeepEqual(expectedRunners, runners) {
+		t.Fatalf("Runners expected: %v, actual: %v", expectedRunners, runners)
+	}
+}
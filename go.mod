@@ -3,10 +3,16 @@ module github.com/falldamagestudio/UE4-GHA-BuildAgentWatchdog
 go 1.14
 
 require (
+	cloud.google.com/go/functions v1.0.0 // indirect
 	github.com/GoogleCloudPlatform/functions-framework-go v1.0.1
 	github.com/google/go-github/v32 v32.0.0
-	github.com/pkg/errors v0.8.1
-	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
-	google.golang.org/api v0.27.0
-	gopkg.in/yaml.v2 v2.2.2
+	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.1
+	go.opentelemetry.io/otel v1.3.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.3.0
+	go.opentelemetry.io/otel/sdk v1.3.0
+	go.opentelemetry.io/otel/trace v1.3.0
+	golang.org/x/oauth2 v0.0.0-20211104180415-d3ed0bb246c8
+	google.golang.org/api v0.67.0
+	gopkg.in/yaml.v2 v2.3.0
 )
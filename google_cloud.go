@@ -1,40 +1,118 @@
 package watchdog
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
 )
 
+// Describes an instance that could not be started due to lack of capacity in its zone (or that was not started
+// because it is a Spot instance that has been preempted too often), and the equivalent instance that was started in its place
+// (nil if none could be started)
+type Failover struct {
+	FailedInstance      OnDemandInstance  `json:"failed_instance"`
+	ReplacementInstance *OnDemandInstance `json:"replacement_instance"`
+	Reason              string            `json:"reason"`
+}
+
 type OnDemandInstance struct {
 	InstanceName string `json:"instance_name"`
+	Zone         string `json:"zone"`
 	RunnerName   string `json:"runner_name"`
+	RunnerGroup  string `json:"runner_group,omitempty"`
 	GitHubScope  string `json:"github_scope"`
 	Status       string `json:"status"`
+	StopMode     string `json:"stop_mode,omitempty"`
+	Spot         bool   `json:"spot,omitempty"`
+	MachineType  string `json:"machine_type,omitempty"`
+
+	// When the instance was last started, as reported by GCE
+	runningSince time.Time
 }
 
-func getOnDemandInstances(computeService *compute.Service, project string, zone string) ([]OnDemandInstance, error) {
+const (
+	// Shuts down the instance; it boots from scratch when started again
+	StopModeStop = "stop"
 
-	instancesCall := computeService.Instances.List(project, zone)
-	instances, err := instancesCall.Do()
+	// Suspends the instance, preserving memory contents; it resumes faster than it boots
+	StopModeSuspend = "suspend"
+)
+
+// The Compute API refers to resources such as zones and machine types by URL, for example
+// "https://www.googleapis.com/compute/v1/projects/my-project/zones/europe-west1-b"; returns the resource's name
+func getResourceNameFromURL(url string) string {
+
+	segments := strings.Split(url, "/")
+	return segments[len(segments)-1]
+}
+
+// An empty allow-list allows all zones
+func isZoneAllowed(zone string, zones []string) bool {
+
+	if len(zones) == 0 {
+		return true
+	}
+
+	for _, allowedZone := range zones {
+		if zone == allowedZone {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns when the instance was last started, or the zero time if that is not known
+// GCE does not report when an instance was last resumed, so for instances that have been suspended since their last start,
+// the time is not known
+func getInstanceRunningSince(instance *compute.Instance) time.Time {
+
+	lastStart, err := time.Parse(time.RFC3339, instance.LastStartTimestamp)
 	if err != nil {
-		return nil, errors.Wrapf(err, "compute.Service.Instances.List(%v, %v) failed", project, zone)
+		return time.Time{}
 	}
 
-	var onDemandInstances []OnDemandInstance
+	if lastSuspended, err := time.Parse(time.RFC3339, instance.LastSuspendedTimestamp); err == nil && lastSuspended.After(lastStart) {
+		return time.Time{}
+	}
 
-	for _, instance := range instances.Items {
+	return lastStart
+}
+
+// Extracts the watchdog-related metadata from an instance; returns false if the instance is not an on-demand instance
+// Settings can be provided either as metadata keys, or as GCE labels; metadata takes precedence
+// GCE label values cannot contain '/', so the scope is given by separate github-organization and github-repository labels
+func parseOnDemandInstance(ctx context.Context, instance *compute.Instance) (OnDemandInstance, bool) {
+
+	runnerName := instance.Labels["runner-name"]
+	runnerGroup := instance.Labels["runner-group"]
+	onDemand := instance.Labels["on-demand"]
+	stopMode := instance.Labels["stop-mode"]
 
-		var runnerName string
-		var gitHubScope string
-		var onDemand string
+	var gitHubScope string
+	if instance.Labels["github-organization"] != "" && instance.Labels["github-repository"] != "" {
+		gitHubScope = fmt.Sprintf("%s/%s", instance.Labels["github-organization"], instance.Labels["github-repository"])
+	}
 
+	if instance.Metadata != nil {
 		for _, item := range instance.Metadata.Items {
+			if item.Value == nil {
+				continue
+			}
+
 			if item.Key == "runner-name" {
 				runnerName = *item.Value
 			}
 
+			if item.Key == "runner-group" {
+				runnerGroup = *item.Value
+			}
+
 			if item.Key == "github-scope" {
 				gitHubScope = *item.Value
 			}
@@ -42,42 +120,475 @@ func getOnDemandInstances(computeService *compute.Service, project string, zone
 			if item.Key == "on-demand" {
 				onDemand = *item.Value
 			}
+
+			if item.Key == "stop-mode" {
+				stopMode = *item.Value
+			}
 		}
+	}
+
+	zone := getResourceNameFromURL(instance.Zone)
+
+	logger := GetLogger(ctx).With(logFieldInstance, instance.Name).With(logFieldZone, zone)
+	logger.Debugf("Enumerating instance - runnerName: \"%s\", runnerGroup: \"%s\", gitHubScope: \"%s\", status: \"%s\"", runnerName, runnerGroup, gitHubScope, instance.Status)
+
+	if stopMode != "" && stopMode != StopModeStop && stopMode != StopModeSuspend {
+		logger.Warningf("Instance %v has unknown stop-mode \"%v\"; the pool's stop mode will be used", instance.Name, stopMode)
+		stopMode = ""
+	}
+
+	if onDemand == "true" && gitHubScope != "" && runnerName != "" {
+		return OnDemandInstance{InstanceName: instance.Name, Zone: zone, RunnerName: runnerName, RunnerGroup: runnerGroup, GitHubScope: gitHubScope, Status: instance.Status, StopMode: stopMode, Spot: isInstanceSpot(instance), MachineType: getResourceNameFromURL(instance.MachineType), runningSince: getInstanceRunningSince(instance)}, true
+	}
+
+	return OnDemandInstance{}, false
+}
 
-		log.Printf("Enumerating instance - name: \"%s\", runnerName: \"%s\", gitHubScope: \"%s\", status: \"%s\"\n", instance.Name, runnerName, gitHubScope, instance.Status)
+// Lists on-demand instances across all zones in the project, optionally restricted to an allow-list of zones
+// A non-empty filter (for example "labels.on-demand=true") is applied server-side, which avoids transferring
+// information about unrelated instances in large projects
+func getOnDemandInstances(ctx context.Context, computeService *compute.Service, project string, zones []string, filter string) ([]OnDemandInstance, error) {
 
-		if onDemand == "true" && gitHubScope != "" && runnerName != "" {
-			onDemandInstances = append(onDemandInstances, OnDemandInstance{InstanceName: instance.Name, RunnerName: runnerName, GitHubScope: gitHubScope, Status: instance.Status})
+	var onDemandInstances []OnDemandInstance
+
+	instancesCall := computeService.Instances.AggregatedList(project)
+	if filter != "" {
+		instancesCall = instancesCall.Filter(filter)
+	}
+	listCtx, call := startAPICall(ctx, apiCompute, "Instances.AggregatedList")
+	err := instancesCall.Pages(listCtx, func(instances *compute.InstanceAggregatedList) error {
+
+		for scope, scopedList := range instances.Items {
+
+			if !isZoneAllowed(getResourceNameFromURL(scope), zones) {
+				continue
+			}
+
+			for _, instance := range scopedList.Instances {
+				if onDemandInstance, ok := parseOnDemandInstance(ctx, instance); ok {
+					onDemandInstances = append(onDemandInstances, onDemandInstance)
+				}
+			}
 		}
+
+		return nil
+	})
+	call.end(err)
+	if err != nil {
+		return nil, errors.Wrapf(err, "compute.Service.Instances.AggregatedList(%v) with filter \"%v\" failed", project, filter)
 	}
 
 	return onDemandInstances, nil
 }
 
-func startInstances(computeService *compute.Service, project string, zone string, instancesToStart []OnDemandInstance) error {
+// GCE reports this error code when a zone does not currently have capacity for the instance's machine type
+const zoneResourcePoolExhausted = "ZONE_RESOURCE_POOL_EXHAUSTED"
+
+type resourceExhaustedError struct {
+	instance OnDemandInstance
+	message  string
+}
+
+func (err *resourceExhaustedError) Error() string {
+	return fmt.Sprintf("Unable to start instance %v in zone %v due to lack of resources: %v", err.instance.InstanceName, err.instance.Zone, err.message)
+}
+
+func isResourceExhaustedError(err error) bool {
+	_, ok := errors.Cause(err).(*resourceExhaustedError)
+	return ok
+}
+
+// Covers both ZONE_RESOURCE_POOL_EXHAUSTED and ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS
+func isResourceExhaustedCode(code string) bool {
+	return strings.HasPrefix(code, zoneResourcePoolExhausted)
+}
+
+// Blocks until a zonal operation has completed, and returns the final state of the operation
+func waitForZoneOperation(ctx context.Context, computeService *compute.Service, project string, zone string, operation *compute.Operation) (*compute.Operation, error) {
+
+	for operation.Status != "DONE" {
+		operationName := operation.Name
+		var err error
+		waitCtx, call := startAPICall(ctx, apiCompute, "ZoneOperations.Wait", attributeZone.String(zone))
+		operation, err = computeService.ZoneOperations.Wait(project, zone, operationName).Context(waitCtx).Do()
+		call.end(err)
+		if err != nil {
+			return nil, errors.Wrapf(err, "compute.Service.ZoneOperations.Wait(%v, %v, %v) failed", project, zone, operationName)
+		}
+	}
+
+	return operation, nil
+}
+
+// Instances that are stopping or suspending are polled at this interval, until they have finished doing so
+var instanceTransitionPollInterval = 5 * time.Second
+
+// Starting an instance that is falling asleep waits at most this long; an instance that is still falling asleep by then
+// is started by a later reconcile cycle instead, so that a slow stop does not hold up the entire reconcile cycle
+var instanceTransitionTimeout = 30 * time.Second
+
+// Reported when an instance could not be started yet, because it is still falling asleep
+type startDeferredError struct {
+	instance OnDemandInstance
+}
+
+func (err *startDeferredError) Error() string {
+	return fmt.Sprintf("Instance %v is still %v; it will be started by a later reconcile cycle", err.instance.InstanceName, err.instance.Status)
+}
+
+func isStartDeferredError(err error) bool {
+	_, ok := errors.Cause(err).(*startDeferredError)
+	return ok
+}
+
+// Waits for an instance that is stopping or suspending to finish doing so, for at most instanceTransitionTimeout,
+// and returns its latest status
+func waitForInstanceToFallAsleep(ctx context.Context, computeService *compute.Service, project string, instance OnDemandInstance) (string, error) {
+
+	GetLogger(ctx).WithInstance(instance).Infof("Instance %v is %v; waiting for it to finish before starting it again", instance.InstanceName, instance.Status)
+
+	deadline := time.Now().Add(instanceTransitionTimeout)
+	status := instance.Status
+
+	for isInstanceFallingAsleep(status) && time.Now().Before(deadline) {
+
+		select {
+		case <-ctx.Done():
+			return "", errors.Wrapf(ctx.Err(), "Waiting for instance %v to finish %v was interrupted", instance.InstanceName, status)
+		case <-time.After(instanceTransitionPollInterval):
+		}
+
+		getCtx, call := startAPICall(ctx, apiCompute, "Instances.Get", instanceAttributes(instance)...)
+		computeInstance, err := computeService.Instances.Get(project, instance.Zone, instance.InstanceName).Context(getCtx).Do()
+		call.end(err)
+		if err != nil {
+			return "", errors.Wrapf(err, "compute.Service.Instances.Get(%v, %v, %v) failed", project, instance.Zone, instance.InstanceName)
+		}
+		status = computeInstance.Status
+	}
+
+	return status, nil
+}
+
+// Waits for the instance to fall asleep, if it is on its way to sleep; returns false if the instance no longer needs to be started
+// An instance that is still falling asleep after the wait is reported as a startDeferredError
+func prepareInstanceForStart(ctx context.Context, computeService *compute.Service, project string, instance *OnDemandInstance) (bool, error) {
+
+	if !isInstanceFallingAsleep(instance.Status) {
+		return true, nil
+	}
+
+	status, err := waitForInstanceToFallAsleep(ctx, computeService, project, *instance)
+	if err != nil {
+		return false, err
+	}
+	instance.Status = status
+
+	if isInstanceFallingAsleep(status) {
+		return false, &startDeferredError{instance: *instance}
+	}
+
+	if !isInstanceAsleep(status) {
+		GetLogger(ctx).WithInstance(*instance).Infof("Instance %v is %v; it will not be started", instance.InstanceName, status)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// Starts a stopped instance, or resumes a suspended instance, without waiting for the operation to complete
+func startOrResumeInstance(ctx context.Context, computeService *compute.Service, project string, instance OnDemandInstance) (*compute.Operation, string, error) {
+
+	if instance.Status == instanceStatusSuspended {
+		GetLogger(ctx).WithInstance(instance).Infof("Resuming instance %v", instance.InstanceName)
+		resumeCtx, call := startAPICall(ctx, apiCompute, "Instances.Resume", instanceAttributes(instance)...)
+		operation, err := computeService.Instances.Resume(project, instance.Zone, instance.InstanceName).Context(resumeCtx).Do()
+		call.end(err)
+		return operation, "Resume", err
+	}
+
+	GetLogger(ctx).WithInstance(instance).Infof("Starting instance %v", instance.InstanceName)
+	startCtx, call := startAPICall(ctx, apiCompute, "Instances.Start", instanceAttributes(instance)...)
+	operation, err := computeService.Instances.Start(project, instance.Zone, instance.InstanceName).Context(startCtx).Do()
+	call.end(err)
+	return operation, "Start", err
+}
+
+// Starts (or resumes) a single instance, and waits for the operation to complete
+// Lack of capacity in the instance's zone is reported as a resourceExhaustedError
+func startInstance(ctx context.Context, computeService *compute.Service, project string, instance OnDemandInstance) error {
+
+	if startNeeded, err := prepareInstanceForStart(ctx, computeService, project, &instance); err != nil {
+		// A deferred start is neither a success nor a failure; its audit event is reported as skipped
+		if !isStartDeferredError(err) {
+			recordAuditOutcome(ctx, getStartOperationName(instance), instance, err)
+		}
+		return err
+	} else if !startNeeded {
+		return nil
+	}
+
+	err := startAndWaitForInstance(ctx, computeService, project, instance)
+	observeInstanceOperation(getStartOperationName(instance), err)
+	recordAuditOutcome(ctx, getStartOperationName(instance), instance, err)
+	return err
+}
+
+func getStartOperationName(instance OnDemandInstance) string {
+	if instance.Status == instanceStatusSuspended {
+		return "resume"
+	}
+	return "start"
+}
+
+func getStopOperationName(instance OnDemandInstance) string {
+	if instance.StopMode == StopModeSuspend {
+		return "suspend"
+	}
+	return "stop"
+}
+
+func startAndWaitForInstance(ctx context.Context, computeService *compute.Service, project string, instance OnDemandInstance) error {
+
+	operation, method, err := startOrResumeInstance(ctx, computeService, project, instance)
+	if err != nil {
+		if apiError, ok := err.(*googleapi.Error); ok {
+			for _, item := range apiError.Errors {
+				if isResourceExhaustedCode(item.Reason) {
+					return &resourceExhaustedError{instance: instance, message: item.Message}
+				}
+			}
+		}
+		return errors.Wrapf(err, "compute.Service.Instances.%v(%v, %v, %v) failed", method, project, instance.Zone, instance.InstanceName)
+	}
+
+	operation, err = waitForZoneOperation(ctx, computeService, project, instance.Zone, operation)
+	if err != nil {
+		return err
+	}
+
+	if operation.Error != nil && len(operation.Error.Errors) != 0 {
+		for _, item := range operation.Error.Errors {
+			if isResourceExhaustedCode(item.Code) {
+				return &resourceExhaustedError{instance: instance, message: item.Message}
+			}
+		}
+		return errors.Errorf("compute.Service.Instances.%v(%v, %v, %v) operation failed: %v: %v", method, project, instance.Zone, instance.InstanceName, operation.Error.Errors[0].Code, operation.Error.Errors[0].Message)
+	}
+
+	return nil
+}
+
+// Waits for an operation on an instance to complete, and returns an error if the operation failed
+func waitForInstanceOperation(ctx context.Context, computeService *compute.Service, project string, instance OnDemandInstance, method string, operation *compute.Operation) error {
+
+	operation, err := waitForZoneOperation(ctx, computeService, project, instance.Zone, operation)
+	if err != nil {
+		return err
+	}
+
+	if operation.Error != nil && len(operation.Error.Errors) != 0 {
+		return errors.Errorf("compute.Service.Instances.%v(%v, %v, %v) operation failed: %v: %v", method, project, instance.Zone, instance.InstanceName, operation.Error.Errors[0].Code, operation.Error.Errors[0].Message)
+	}
+
+	return nil
+}
+
+// Resets a running instance, as if its power had been cycled, and waits for the reset to complete
+func resetInstance(ctx context.Context, computeService *compute.Service, project string, instance OnDemandInstance) error {
+
+	GetLogger(ctx).WithInstance(instance).Infof("Resetting instance %v", instance.InstanceName)
+
+	resetCtx, call := startAPICall(ctx, apiCompute, "Instances.Reset", instanceAttributes(instance)...)
+	operation, err := computeService.Instances.Reset(project, instance.Zone, instance.InstanceName).Context(resetCtx).Do()
+	call.end(err)
+	if err != nil {
+		err = errors.Wrapf(err, "compute.Service.Instances.Reset(%v, %v, %v) failed", project, instance.Zone, instance.InstanceName)
+	} else {
+		err = waitForInstanceOperation(ctx, computeService, project, instance, "Reset", operation)
+	}
+
+	observeInstanceOperation("reset", err)
+	recordAuditOutcome(ctx, "reset", instance, err)
+	return err
+}
+
+// Stops a running instance, and starts it again once it has stopped
+// Unlike a reset, this gives GCE the opportunity to move the instance to another host
+// The stop is waited for at most instanceTransitionTimeout; an instance that is still stopping by then is started by the next reconcile cycle
+func restartInstance(ctx context.Context, computeService *compute.Service, project string, instance OnDemandInstance) error {
+
+	GetLogger(ctx).WithInstance(instance).Infof("Restarting instance %v", instance.InstanceName)
+
+	stopCtx, call := startAPICall(ctx, apiCompute, "Instances.Stop", instanceAttributes(instance)...)
+	operation, err := computeService.Instances.Stop(project, instance.Zone, instance.InstanceName).Context(stopCtx).Do()
+	call.end(err)
+	if err != nil {
+		err = errors.Wrapf(err, "compute.Service.Instances.Stop(%v, %v, %v) failed", project, instance.Zone, instance.InstanceName)
+	} else {
+		err = startInstanceAfterStop(ctx, computeService, project, instance, operation)
+	}
+
+	observeInstanceOperation("restart", err)
+	recordAuditOutcome(ctx, "restart", instance, err)
+	return err
+}
+
+// Waits for a stop operation to complete, and starts the instance again
+// When the stop does not complete within instanceTransitionTimeout, the start is left to the next reconcile cycle
+func startInstanceAfterStop(ctx context.Context, computeService *compute.Service, project string, instance OnDemandInstance, operation *compute.Operation) error {
+
+	waitCtx, cancel := context.WithTimeout(ctx, instanceTransitionTimeout)
+	defer cancel()
+
+	if err := waitForInstanceOperation(waitCtx, computeService, project, instance, "Stop", operation); err != nil {
+		if ctx.Err() == nil && waitCtx.Err() == context.DeadlineExceeded {
+			GetLogger(ctx).WithInstance(instance).Infof("Instance %v is still stopping; it will be started again by the next reconcile cycle", instance.InstanceName)
+			pendingRestarts.add(instance)
+			return nil
+		}
+		return err
+	}
+
+	instance.Status = instanceStatusTerminated
+	return startAndWaitForInstance(ctx, computeService, project, instance)
+}
+
+// Returns instances that serve the same runner as the given instance, but in other zones, and that are available to be started
+// Instances whose keys are in excludedInstances are already being started for other reasons, and are not considered
+func getEquivalentInstancesInOtherZones(instance OnDemandInstance, onDemandInstances []OnDemandInstance, excludedZones map[string]bool, excludedInstances map[string]bool) []OnDemandInstance {
+
+	var equivalentInstances []OnDemandInstance
+
+	for _, candidate := range onDemandInstances {
+		if candidate.RunnerName == instance.RunnerName && candidate.RunnerGroup == instance.RunnerGroup && candidate.GitHubScope == instance.GitHubScope &&
+			!excludedZones[candidate.Zone] && !excludedInstances[getInstanceKey(candidate.Zone, candidate.InstanceName)] && isInstanceAsleep(candidate.Status) {
+			equivalentInstances = append(equivalentInstances, candidate)
+		}
+	}
+
+	return equivalentInstances
+}
+
+// Starts the given instances; when an instance cannot be started because its zone has run out of capacity,
+// an equivalent instance in another zone is started in its place, if one is available
+// Returns the instances that were actually started, and any failovers that took place
+func startInstancesWithFailover(ctx context.Context, computeService *compute.Service, project string, instancesToStart []OnDemandInstance, onDemandInstances []OnDemandInstance) ([]OnDemandInstance, []Failover, error) {
+
+	var startedInstances []OnDemandInstance
+	var failovers []Failover
+
+	// Instances that are scheduled to be started, or have been started as replacements, are not available for failover
+	claimedInstances := make(map[string]bool)
+	for _, instance := range instancesToStart {
+		claimedInstances[getInstanceKey(instance.Zone, instance.InstanceName)] = true
+	}
 
 	for _, instance := range instancesToStart {
 
-		log.Printf("Starting instance: %v\n", instance)
-		instanceStartCall := computeService.Instances.Start(project, zone, instance.InstanceName)
-		_, err := instanceStartCall.Do()
+		err := startInstance(ctx, computeService, project, instance)
+		if err == nil {
+			startedInstances = append(startedInstances, instance)
+			continue
+		}
+
+		if isStartDeferredError(err) {
+			GetLogger(ctx).WithInstance(instance).Infof("%v", err)
+			continue
+		}
+
+		if !isResourceExhaustedError(err) {
+			return startedInstances, failovers, err
+		}
+
+		GetLogger(ctx).WithInstance(instance).Warningf("%v; looking for equivalent instances in other zones", err)
+
+		failover := Failover{FailedInstance: instance, Reason: err.Error()}
+		exhaustedZones := map[string]bool{instance.Zone: true}
+
+		for {
+			candidates := getEquivalentInstancesInOtherZones(instance, onDemandInstances, exhaustedZones, claimedInstances)
+			if len(candidates) == 0 {
+				GetLogger(ctx).WithInstance(instance).Warningf("No equivalent instance available for runner %v in other zones", instance.RunnerName)
+				break
+			}
+
+			candidate := candidates[0]
+			planAuditEvent(ctx, getStartOperationName(candidate), candidate, fmt.Sprintf("Replaces %v: %v", instance.InstanceName, failover.Reason))
+			err := startInstance(ctx, computeService, project, candidate)
+			if err == nil {
+				failover.ReplacementInstance = &candidate
+				startedInstances = append(startedInstances, candidate)
+				claimedInstances[getInstanceKey(candidate.Zone, candidate.InstanceName)] = true
+				break
+			}
+
+			if !isResourceExhaustedError(err) {
+				return startedInstances, append(failovers, failover), err
+			}
+
+			GetLogger(ctx).WithInstance(candidate).Warningf("%v", err)
+			exhaustedZones[candidate.Zone] = true
+		}
+
+		failovers = append(failovers, failover)
+	}
+
+	return startedInstances, failovers, nil
+}
+
+func startInstances(ctx context.Context, computeService *compute.Service, project string, instancesToStart []OnDemandInstance) error {
+
+	for _, instance := range instancesToStart {
+
+		if startNeeded, err := prepareInstanceForStart(ctx, computeService, project, &instance); err != nil {
+			if !isStartDeferredError(err) {
+				recordAuditOutcome(ctx, getStartOperationName(instance), instance, err)
+			}
+			return err
+		} else if !startNeeded {
+			continue
+		}
+
+		_, method, err := startOrResumeInstance(ctx, computeService, project, instance)
+		observeInstanceOperation(getStartOperationName(instance), err)
+		recordAuditOutcome(ctx, getStartOperationName(instance), instance, err)
 		if err != nil {
-			return errors.Wrapf(err, "compute.Service.Instances.Start(%v, %v, %v) failed", project, zone, instance.InstanceName)
+			return errors.Wrapf(err, "compute.Service.Instances.%v(%v, %v, %v) failed", method, project, instance.Zone, instance.InstanceName)
 		}
 	}
 
 	return nil
 }
 
-func stopInstances(computeService *compute.Service, project string, zone string, instancesToStop []OnDemandInstance) error {
+// Stops or suspends each instance, depending on its stop mode
+func stopInstances(ctx context.Context, computeService *compute.Service, project string, instancesToStop []OnDemandInstance) error {
 
 	for _, instance := range instancesToStop {
 
-		log.Printf("Stopping instance: %v\n", instance)
-		instanceStartCall := computeService.Instances.Stop(project, zone, instance.InstanceName)
-		_, err := instanceStartCall.Do()
+		if instance.StopMode == StopModeSuspend {
+			GetLogger(ctx).WithInstance(instance).Infof("Suspending instance %v", instance.InstanceName)
+			suspendCtx, call := startAPICall(ctx, apiCompute, "Instances.Suspend", instanceAttributes(instance)...)
+			instanceSuspendCall := computeService.Instances.Suspend(project, instance.Zone, instance.InstanceName)
+			_, err := instanceSuspendCall.Context(suspendCtx).Do()
+			call.end(err)
+			observeInstanceOperation("suspend", err)
+			recordAuditOutcome(ctx, "suspend", instance, err)
+			if err != nil {
+				return errors.Wrapf(err, "compute.Service.Instances.Suspend(%v, %v, %v) failed", project, instance.Zone, instance.InstanceName)
+			}
+			continue
+		}
+
+		GetLogger(ctx).WithInstance(instance).Infof("Stopping instance %v", instance.InstanceName)
+		stopCtx, call := startAPICall(ctx, apiCompute, "Instances.Stop", instanceAttributes(instance)...)
+		instanceStopCall := computeService.Instances.Stop(project, instance.Zone, instance.InstanceName)
+		_, err := instanceStopCall.Context(stopCtx).Do()
+		call.end(err)
+		observeInstanceOperation("stop", err)
+		recordAuditOutcome(ctx, "stop", instance, err)
 		if err != nil {
-			return errors.Wrapf(err, "compute.Service.Instances.Stop(%v, %v, %v) failed", project, zone, instance.InstanceName)
+			return errors.Wrapf(err, "compute.Service.Instances.Stop(%v, %v, %v) failed", project, instance.Zone, instance.InstanceName)
 		}
 	}
 
@@ -0,0 +1,281 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+func TestParseOnDemandInstance(t *testing.T) {
+
+	value := func(value string) *string { return &value }
+
+	instance := &compute.Instance{
+		Name:   "build-agent-1",
+		Zone:   "https://www.googleapis.com/compute/v1/projects/my-project/zones/europe-west1-b",
+		Status: "TERMINATED",
+		Metadata: &compute.Metadata{Items: []*compute.MetadataItems{
+			{Key: "on-demand", Value: value("true")},
+			{Key: "github-scope", Value: value("MyOrg/MyRepo")},
+			{Key: "runner-name", Value: value("build_agent")},
+			{Key: "runner-group", Value: value("ue4-agents")},
+		}},
+	}
+
+	onDemandInstance, ok := parseOnDemandInstance(context.Background(), instance)
+	if !ok {
+		t.Fatal("Instance should be recognized as an on-demand instance")
+	}
+
+	expectedOnDemandInstance := OnDemandInstance{InstanceName: "build-agent-1", Zone: "europe-west1-b", RunnerName: "build_agent", RunnerGroup: "ue4-agents", GitHubScope: "MyOrg/MyRepo", Status: "TERMINATED"}
+	if onDemandInstance != expectedOnDemandInstance {
+		t.Fatalf("On-demand instance expected: %v, actual: %v", expectedOnDemandInstance, onDemandInstance)
+	}
+
+	t.Run("Instance with labels", func(t *testing.T) {
+
+		instance := &compute.Instance{
+			Name:   "build-agent-2",
+			Zone:   "https://www.googleapis.com/compute/v1/projects/my-project/zones/europe-west1-b",
+			Status: "RUNNING",
+			Labels: map[string]string{"on-demand": "true", "github-organization": "myorg", "github-repository": "myrepo", "runner-name": "build_agent", "stop-mode": "suspend"},
+		}
+
+		onDemandInstance, ok := parseOnDemandInstance(context.Background(), instance)
+		if !ok {
+			t.Fatal("Instance should be recognized as an on-demand instance")
+		}
+
+		expectedOnDemandInstance := OnDemandInstance{InstanceName: "build-agent-2", Zone: "europe-west1-b", RunnerName: "build_agent", GitHubScope: "myorg/myrepo", Status: "RUNNING", StopMode: "suspend"}
+		if onDemandInstance != expectedOnDemandInstance {
+			t.Fatalf("On-demand instance expected: %v, actual: %v", expectedOnDemandInstance, onDemandInstance)
+		}
+	})
+
+	t.Run("Running since", func(t *testing.T) {
+
+		started := &compute.Instance{LastStartTimestamp: "2021-03-01T04:00:00.123-08:00", LastSuspendedTimestamp: "2021-02-28T10:00:00.000-08:00"}
+		expectedTime := time.Date(2021, 3, 1, 12, 0, 0, 123000000, time.UTC)
+		if runningSince := getInstanceRunningSince(started); !runningSince.Equal(expectedTime) {
+			t.Fatalf("Running since expected: %v, actual: %v", expectedTime, runningSince)
+		}
+
+		resumed := &compute.Instance{LastStartTimestamp: "2021-03-01T04:00:00.000-08:00", LastSuspendedTimestamp: "2021-03-01T06:00:00.000-08:00"}
+		if runningSince := getInstanceRunningSince(resumed); !runningSince.IsZero() {
+			t.Fatalf("Running since should not be known for resumed instances, actual: %v", runningSince)
+		}
+	})
+
+	t.Run("Instance without metadata", func(t *testing.T) {
+
+		if _, ok := parseOnDemandInstance(context.Background(), &compute.Instance{Name: "other"}); ok {
+			t.Fatal("Instance should not be recognized as an on-demand instance")
+		}
+	})
+}
+
+func TestGetOnDemandInstances(t *testing.T) {
+
+	instanceJson := func(name string, zone string) string {
+		return fmt.Sprintf(`{ "name": "%s", "zone": "https://www.googleapis.com/compute/v1/projects/my-project/zones/%s", "status": "RUNNING", "metadata": { "items": [
+			{ "key": "on-demand", "value": "true" }, { "key": "github-scope", "value": "MyOrg/MyRepo" }, { "key": "runner-name", "value": "%s" } ] } }`, name, zone, name)
+	}
+
+	httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path != "/compute/v1/projects/my-project/aggregated/instances" || r.URL.Query().Get("filter") != "labels.on-demand=true" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if r.URL.Query().Get("pageToken") == "" {
+			fmt.Fprintf(w, `{ "items": { "zones/europe-west1-b": { "instances": [ %s ] }, "zones/us-central1-a": { "instances": [ %s ] } }, "nextPageToken": "page2" }`,
+				instanceJson("agent-1", "europe-west1-b"), instanceJson("agent-2", "us-central1-a"))
+		} else {
+			fmt.Fprintf(w, `{ "items": { "zones/europe-west4-a": { "instances": [ %s ] }, "zones/asia-east1-a": { "warning": { "code": "NO_RESULTS_ON_PAGE" } } } }`,
+				instanceJson("agent-3", "europe-west4-a"))
+		}
+	}))
+	defer teardown()
+
+	ctx := context.Background()
+
+	computeService, err := compute.NewService(ctx, option.WithHTTPClient(httpClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	onDemandInstances, err := getOnDemandInstances(ctx, computeService, "my-project", []string{"europe-west1-b", "europe-west4-a"}, "labels.on-demand=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var instanceZones []string
+	for _, instance := range onDemandInstances {
+		instanceZones = append(instanceZones, fmt.Sprintf("%s@%s", instance.InstanceName, instance.Zone))
+	}
+
+	expectedInstanceZones := []string{"agent-1@europe-west1-b", "agent-3@europe-west4-a"}
+	if !reflect.DeepEqual(expectedInstanceZones, instanceZones) {
+		t.Fatalf("Instances expected: %v, actual: %v", expectedInstanceZones, instanceZones)
+	}
+}
+
+func TestStartInstancesWithFailover(t *testing.T) {
+
+	httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		switch r.URL.Path {
+		case "/compute/v1/projects/my-project/zones/europe-west1-b/instances/gpu-agent-b/start":
+			fmt.Fprintln(w, `{ "name": "operation-1", "status": "RUNNING" }`)
+		case "/compute/v1/projects/my-project/zones/europe-west1-b/operations/operation-1/wait":
+			fmt.Fprintln(w, `{ "name": "operation-1", "status": "DONE", "error": { "errors": [ { "code": "ZONE_RESOURCE_POOL_EXHAUSTED", "message": "The zone does not have enough resources" } ] } }`)
+		case "/compute/v1/projects/my-project/zones/europe-west4-a/instances/gpu-agent-a/start":
+			fmt.Fprintln(w, `{ "name": "operation-2", "status": "DONE" }`)
+		case "/compute/v1/projects/my-project/zones/europe-west1-b/instances/cpu-agent/start":
+			fmt.Fprintln(w, `{ "name": "operation-3", "status": "DONE" }`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer teardown()
+
+	ctx := context.Background()
+
+	computeService, err := compute.NewService(ctx, option.WithHTTPClient(httpClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	onDemandInstances := []OnDemandInstance{
+		{InstanceName: "gpu-agent-b", Zone: "europe-west1-b", RunnerName: "gpu_agent", GitHubScope: "MyOrg/MyRepo", Status: "TERMINATED"},
+		{InstanceName: "gpu-agent-a", Zone: "europe-west4-a", RunnerName: "gpu_agent", GitHubScope: "MyOrg/MyRepo", Status: "TERMINATED"},
+		{InstanceName: "cpu-agent", Zone: "europe-west1-b", RunnerName: "cpu_agent", GitHubScope: "MyOrg/MyRepo", Status: "TERMINATED"},
+	}
+
+	instancesToStart := []OnDemandInstance{onDemandInstances[0], onDemandInstances[2]}
+
+	startedInstances, failovers, err := startInstancesWithFailover(ctx, computeService, "my-project", instancesToStart, onDemandInstances)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedStartedInstances := []OnDemandInstance{onDemandInstances[1], onDemandInstances[2]}
+	if !reflect.DeepEqual(expectedStartedInstances, startedInstances) {
+		t.Fatalf("Started instances expected: %v, actual: %v", expectedStartedInstances, startedInstances)
+	}
+
+	if len(failovers) != 1 || failovers[0].FailedInstance != onDemandInstances[0] || failovers[0].ReplacementInstance == nil || *failovers[0].ReplacementInstance != onDemandInstances[1] {
+		t.Fatalf("Expected a single failover from gpu-agent-b to gpu-agent-a, actual: %+v", failovers)
+	}
+
+	t.Run("Instances already claimed are not used for failover", func(t *testing.T) {
+
+		var requests []string
+
+		httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			requests = append(requests, r.URL.Path)
+			switch r.URL.Path {
+			case "/compute/v1/projects/my-project/zones/europe-west1-b/instances/agent-b1/start",
+				"/compute/v1/projects/my-project/zones/europe-west1-b/instances/agent-b2/start":
+				fmt.Fprintln(w, `{ "name": "operation-1", "status": "DONE", "error": { "errors": [ { "code": "ZONE_RESOURCE_POOL_EXHAUSTED", "message": "The zone does not have enough resources" } ] } }`)
+			case "/compute/v1/projects/my-project/zones/europe-west4-a/instances/agent-a1/start":
+				fmt.Fprintln(w, `{ "name": "operation-2", "status": "DONE" }`)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer teardown()
+
+		computeService, err := compute.NewService(ctx, option.WithHTTPClient(httpClient))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		onDemandInstances := []OnDemandInstance{
+			{InstanceName: "agent-b1", Zone: "europe-west1-b", RunnerName: "agent", GitHubScope: "MyOrg/MyRepo", Status: "TERMINATED"},
+			{InstanceName: "agent-b2", Zone: "europe-west1-b", RunnerName: "agent", GitHubScope: "MyOrg/MyRepo", Status: "TERMINATED"},
+			{InstanceName: "agent-a1", Zone: "europe-west4-a", RunnerName: "agent", GitHubScope: "MyOrg/MyRepo", Status: "TERMINATED"},
+		}
+
+		// agent-a1 is started directly, so neither agent-b1 nor agent-b2 may fail over to it
+		instancesToStart := []OnDemandInstance{onDemandInstances[0], onDemandInstances[1], onDemandInstances[2]}
+
+		startedInstances, failovers, err := startInstancesWithFailover(ctx, computeService, "my-project", instancesToStart, onDemandInstances)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedStartedInstances := []OnDemandInstance{onDemandInstances[2]}
+		if !reflect.DeepEqual(expectedStartedInstances, startedInstances) {
+			t.Fatalf("Started instances expected: %v, actual: %v", expectedStartedInstances, startedInstances)
+		}
+
+		if len(failovers) != 2 || failovers[0].ReplacementInstance != nil || failovers[1].ReplacementInstance != nil {
+			t.Fatalf("Expected two failovers without replacements, actual: %+v", failovers)
+		}
+
+		expectedRequests := []string{
+			"/compute/v1/projects/my-project/zones/europe-west1-b/instances/agent-b1/start",
+			"/compute/v1/projects/my-project/zones/europe-west1-b/instances/agent-b2/start",
+			"/compute/v1/projects/my-project/zones/europe-west4-a/instances/agent-a1/start",
+		}
+		if !reflect.DeepEqual(expectedRequests, requests) {
+			t.Fatalf("Requests expected: %v, actual: %v", expectedRequests, requests)
+		}
+	})
+}
+
+func TestStartAndStopInstancesWithSuspend(t *testing.T) {
+
+	var requests []string
+
+	httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		requests = append(requests, r.URL.Path)
+		fmt.Fprintln(w, `{ "name": "operation-1", "status": "DONE" }`)
+	}))
+	defer teardown()
+
+	ctx := context.Background()
+
+	computeService, err := compute.NewService(ctx, option.WithHTTPClient(httpClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instancesToStart := []OnDemandInstance{
+		{InstanceName: "suspended-agent", Zone: "europe-west1-b", RunnerName: "agent1", Status: "SUSPENDED", StopMode: StopModeSuspend},
+		{InstanceName: "stopped-agent", Zone: "europe-west1-b", RunnerName: "agent2", Status: "TERMINATED", StopMode: StopModeStop},
+	}
+
+	if _, _, err := startInstancesWithFailover(ctx, computeService, "my-project", instancesToStart, instancesToStart); err != nil {
+		t.Fatal(err)
+	}
+
+	instancesToStop := []OnDemandInstance{
+		{InstanceName: "suspended-agent", Zone: "europe-west1-b", RunnerName: "agent1", Status: "RUNNING", StopMode: StopModeSuspend},
+		{InstanceName: "stopped-agent", Zone: "europe-west1-b", RunnerName: "agent2", Status: "RUNNING", StopMode: StopModeStop},
+	}
+
+	if err := stopInstances(ctx, computeService, "my-project", instancesToStop); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedRequests := []string{
+		"/compute/v1/projects/my-project/zones/europe-west1-b/instances/suspended-agent/resume",
+		"/compute/v1/projects/my-project/zones/europe-west1-b/instances/stopped-agent/start",
+		"/compute/v1/projects/my-project/zones/europe-west1-b/instances/suspended-agent/suspend",
+		"/compute/v1/projects/my-project/zones/europe-west1-b/instances/stopped-agent/stop",
+	}
+	if !reflect.DeepEqual(expectedRequests, requests) {
+		t.Fatalf("Requests expected: %v, actual: %v", expectedRequests, requests)
+	}
+}
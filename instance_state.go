@@ -0,0 +1,128 @@
+package watchdog
+
+import (
+	"sync"
+	"time"
+)
+
+// Instance statuses reported by GCE; see https://cloud.google.com/compute/docs/instances/instance-life-cycle
+const (
+	instanceStatusProvisioning = "PROVISIONING"
+	instanceStatusStaging      = "STAGING"
+	instanceStatusRunning      = "RUNNING"
+	instanceStatusStopping     = "STOPPING"
+	instanceStatusStopped      = "STOPPED"
+	instanceStatusSuspending   = "SUSPENDING"
+	instanceStatusSuspended    = "SUSPENDED"
+	instanceStatusRepairing    = "REPAIRING"
+	instanceStatusTerminated   = "TERMINATED"
+)
+
+// Instances that are stopped or suspended are asleep, and can be started or resumed when needed
+func isInstanceAsleep(status string) bool {
+	return status == instanceStatusTerminated || status == instanceStatusStopped || status == instanceStatusSuspended
+}
+
+// Instances that are on their way up are treated like running instances
+func isInstanceAwake(status string) bool {
+	return status == instanceStatusProvisioning || status == instanceStatusStaging || status == instanceStatusRunning || status == instanceStatusRepairing
+}
+
+// Instances that are on their way to sleep cannot be started or resumed until the transition has completed
+func isInstanceFallingAsleep(status string) bool {
+	return status == instanceStatusStopping || status == instanceStatusSuspending
+}
+
+// GCE moves instances out of these statuses on its own; an instance that remains in one of them for long is likely stuck
+func isInstanceStatusTransitional(status string) bool {
+	return status == instanceStatusProvisioning || status == instanceStatusStaging || status == instanceStatusRepairing || isInstanceFallingAsleep(status)
+}
+
+type instanceAction int
+
+const (
+	instanceActionNone instanceAction = iota
+	instanceActionStart
+	instanceActionStop
+)
+
+// Decides what to do with an instance, given its status and whether any job needs it
+// Needed instances that are falling asleep are started; the start waits briefly for the instance to finish falling asleep first,
+// and is otherwise left to a later reconcile cycle
+// Instances that are not needed are only stopped once they are running, so that instances which are booting are left alone
+func getInstanceAction(status string, needed bool) instanceAction {
+
+	switch {
+	case needed && (isInstanceAsleep(status) || isInstanceFallingAsleep(status)):
+		return instanceActionStart
+	case !needed && status == instanceStatusRunning:
+		return instanceActionStop
+	default:
+		return instanceActionNone
+	}
+}
+
+// Describes an instance that has remained in a transitional status for longer than expected
+type StuckInstance struct {
+	OnDemandInstance
+	StatusSince time.Time `json:"status_since"`
+}
+
+type instanceStatusSince struct {
+	status string
+	since  time.Time
+}
+
+// Remembers since when each instance has been in its current transitional status, across invocations
+// Instances are keyed by zone and name, since equivalent instances in different zones can share a name
+type transitionTracker struct {
+	mutex       sync.Mutex
+	statusSince map[string]instanceStatusSince
+}
+
+var instanceTransitionTracker = &transitionTracker{statusSince: make(map[string]instanceStatusSince)}
+
+// Returns the instances that have been in a transitional status for at least the threshold, without recording anything
+func (tracker *transitionTracker) getStuckInstances(onDemandInstances []OnDemandInstance, now time.Time, threshold time.Duration) []StuckInstance {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	var stuckInstances []StuckInstance
+
+	for _, instance := range onDemandInstances {
+		if !isInstanceStatusTransitional(instance.Status) {
+			continue
+		}
+
+		since := now
+		if statusSince, exists := tracker.statusSince[getInstanceKey(instance.Zone, instance.InstanceName)]; exists && statusSince.status == instance.Status {
+			since = statusSince.since
+		}
+
+		if now.Sub(since) >= threshold {
+			stuckInstances = append(stuckInstances, StuckInstance{OnDemandInstance: instance, StatusSince: since})
+		}
+	}
+
+	return stuckInstances
+}
+
+// Records the status of each instance
+func (tracker *transitionTracker) update(onDemandInstances []OnDemandInstance, now time.Time) {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	for _, instance := range onDemandInstances {
+		key := getInstanceKey(instance.Zone, instance.InstanceName)
+		if !isInstanceStatusTransitional(instance.Status) {
+			delete(tracker.statusSince, key)
+			continue
+		}
+
+		if statusSince, exists := tracker.statusSince[key]; !exists || statusSince.status != instance.Status {
+			tracker.statusSince[key] = instanceStatusSince{status: instance.Status, since: now}
+		}
+	}
+}
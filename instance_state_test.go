@@ -0,0 +1,204 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+func TestGetInstanceAction(t *testing.T) {
+
+	tests := []struct {
+		status   string
+		needed   bool
+		expected instanceAction
+	}{
+		{"TERMINATED", true, instanceActionStart},
+		{"SUSPENDED", true, instanceActionStart},
+		{"STOPPING", true, instanceActionStart},
+		{"SUSPENDING", true, instanceActionStart},
+		{"PROVISIONING", true, instanceActionNone},
+		{"STAGING", true, instanceActionNone},
+		{"RUNNING", true, instanceActionNone},
+		{"REPAIRING", true, instanceActionNone},
+		{"RUNNING", false, instanceActionStop},
+		{"STAGING", false, instanceActionNone},
+		{"STOPPING", false, instanceActionNone},
+		{"TERMINATED", false, instanceActionNone},
+	}
+
+	for _, test := range tests {
+		if action := getInstanceAction(test.status, test.needed); action != test.expected {
+			t.Errorf("Action for status %v (needed: %v) expected: %v, actual: %v", test.status, test.needed, test.expected, action)
+		}
+	}
+}
+
+func TestGetInstancesToStartWithTransitionalStatuses(t *testing.T) {
+
+	onDemandInstances := []OnDemandInstance{
+		{InstanceName: "instance1-a", Zone: "europe-west1-b", RunnerName: "runner1", Status: "STAGING"},
+		{InstanceName: "instance1-b", Zone: "europe-west4-a", RunnerName: "runner1", Status: "TERMINATED"},
+		{InstanceName: "instance2", RunnerName: "runner2", Status: "STOPPING"},
+		{InstanceName: "instance3", RunnerName: "runner3", Status: "SUSPENDING"},
+	}
+
+	runnersRequired := []RunsOn{{Labels: []string{"runner1"}}, {Labels: []string{"runner2"}}}
+
+	instancesToStart := getInstancesToStart(runnersRequired, onDemandInstances)
+
+	expectedInstancesToStart := []OnDemandInstance{onDemandInstances[2]}
+	if !reflect.DeepEqual(expectedInstancesToStart, instancesToStart) {
+		t.Fatalf("Instances to start diff. Expected: %v, actual: %v", expectedInstancesToStart, instancesToStart)
+	}
+}
+
+func TestTransitionTracker(t *testing.T) {
+
+	tracker := &transitionTracker{statusSince: make(map[string]instanceStatusSince)}
+
+	now := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	// Equivalent instances in different zones can share a name; each has its own status
+	instances := []OnDemandInstance{
+		{InstanceName: "instance1", Zone: "europe-west1-b", Status: "STOPPING"},
+		{InstanceName: "instance1", Zone: "europe-west4-a", Status: "RUNNING"},
+	}
+
+	if stuckInstances := tracker.getStuckInstances(instances, now, 10*time.Minute); len(stuckInstances) != 0 {
+		t.Fatalf("No instances should be stuck yet, actual: %v", stuckInstances)
+	}
+	tracker.update(instances, now)
+
+	// Looking without recording, such as during a dry run, does not change what later invocations see
+	if stuckInstances := tracker.getStuckInstances(instances, now.Add(5*time.Minute), 10*time.Minute); len(stuckInstances) != 0 {
+		t.Fatalf("No instances should be stuck yet, actual: %v", stuckInstances)
+	}
+
+	stuckInstances := tracker.getStuckInstances(instances, now.Add(10*time.Minute), 10*time.Minute)
+	tracker.update(instances, now.Add(10*time.Minute))
+
+	expectedStuckInstances := []StuckInstance{{OnDemandInstance: instances[0], StatusSince: now}}
+	if !reflect.DeepEqual(expectedStuckInstances, stuckInstances) {
+		t.Fatalf("Stuck instances diff. Expected: %v, actual: %v", expectedStuckInstances, stuckInstances)
+	}
+
+	instances[0].Status = "TERMINATED"
+	tracker.update(instances, now.Add(11*time.Minute))
+	if len(tracker.statusSince) != 0 {
+		t.Fatalf("Instances that are no longer in a transitional status should be forgotten, but tracker contains %v", tracker.statusSince)
+	}
+}
+
+func TestStartInstanceWaitsForStop(t *testing.T) {
+
+	var requests []string
+	getRequests := 0
+
+	httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		requests = append(requests, r.Method+" "+r.URL.Path)
+
+		switch r.URL.Path {
+		case "/compute/v1/projects/my-project/zones/europe-west1-b/instances/instance1":
+			getRequests++
+			if getRequests < 2 {
+				fmt.Fprintln(w, `{ "name": "instance1", "status": "STOPPING" }`)
+			} else {
+				fmt.Fprintln(w, `{ "name": "instance1", "status": "TERMINATED" }`)
+			}
+		case "/compute/v1/projects/my-project/zones/europe-west1-b/instances/instance1/start":
+			fmt.Fprintln(w, `{ "name": "operation-1", "status": "DONE" }`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer teardown()
+
+	ctx := context.Background()
+
+	computeService, err := compute.NewService(ctx, option.WithHTTPClient(httpClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pollInterval := instanceTransitionPollInterval
+	instanceTransitionPollInterval = time.Millisecond
+	defer func() { instanceTransitionPollInterval = pollInterval }()
+
+	instance := OnDemandInstance{InstanceName: "instance1", Zone: "europe-west1-b", RunnerName: "runner1", Status: "STOPPING"}
+
+	if err := startInstance(ctx, computeService, "my-project", instance); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedRequests := []string{
+		"GET /compute/v1/projects/my-project/zones/europe-west1-b/instances/instance1",
+		"GET /compute/v1/projects/my-project/zones/europe-west1-b/instances/instance1",
+		"POST /compute/v1/projects/my-project/zones/europe-west1-b/instances/instance1/start",
+	}
+	if !reflect.DeepEqual(expectedRequests, requests) {
+		t.Fatalf("Requests expected: %v, actual: %v", expectedRequests, requests)
+	}
+}
+
+func TestStartInstanceDefersWhileStillStopping(t *testing.T) {
+
+	var requests []string
+
+	httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		fmt.Fprintln(w, `{ "name": "instance1", "status": "STOPPING" }`)
+	}))
+	defer teardown()
+
+	ctx := context.Background()
+
+	computeService, err := compute.NewService(ctx, option.WithHTTPClient(httpClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pollInterval, timeout := instanceTransitionPollInterval, instanceTransitionTimeout
+	instanceTransitionPollInterval, instanceTransitionTimeout = time.Millisecond, 10*time.Millisecond
+	defer func() { instanceTransitionPollInterval, instanceTransitionTimeout = pollInterval, timeout }()
+
+	instance := OnDemandInstance{InstanceName: "instance1", Zone: "europe-west1-b", RunnerName: "runner1", Status: "STOPPING"}
+
+	t.Run("Start is left to a later reconcile cycle", func(t *testing.T) {
+
+		startedInstances, _, err := startInstancesWithFailover(ctx, computeService, "my-project", []OnDemandInstance{instance}, []OnDemandInstance{instance})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(startedInstances) != 0 {
+			t.Fatalf("No instance should have been started, actual: %v", startedInstances)
+		}
+
+		for _, request := range requests {
+			if request != "GET /compute/v1/projects/my-project/zones/europe-west1-b/instances/instance1" {
+				t.Fatalf("Only the instance's status should have been polled, requests: %v", requests)
+			}
+		}
+	})
+
+	t.Run("Waiting stops when the context is cancelled", func(t *testing.T) {
+
+		instanceTransitionTimeout = time.Hour
+
+		cancelledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		if err := startInstance(cancelledCtx, computeService, "my-project", instance); err == nil || isStartDeferredError(err) {
+			t.Fatalf("Start should fail when the context is cancelled, actual: %v", err)
+		}
+	})
+}
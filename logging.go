@@ -0,0 +1,165 @@
+package watchdog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Severities understood by Cloud Logging
+const (
+	severityDebug   = "DEBUG"
+	severityInfo    = "INFO"
+	severityWarning = "WARNING"
+	severityError   = "ERROR"
+)
+
+// Field names used in log entries
+const (
+	logFieldCorrelationID = "correlation_id"
+	logFieldRepository    = "repository"
+	logFieldRunID         = "run_id"
+	logFieldWorkflowPath  = "workflow_path"
+	logFieldInstance      = "instance"
+	logFieldZone          = "zone"
+	logFieldInstanceGroup = "instance_group"
+)
+
+type logSink struct {
+	mutex  sync.Mutex
+	output io.Writer
+}
+
+// Writes log entries as one JSON object per line, which Cloud Logging turns into structured log entries
+// Each entry contains the message, its severity, and the fields that have been attached to the logger
+type Logger struct {
+	sink   *logSink
+	fields map[string]interface{}
+}
+
+func newLogger(output io.Writer) *Logger {
+	return &Logger{sink: &logSink{output: output}, fields: make(map[string]interface{})}
+}
+
+// Logs go to stderr, which keeps stdout free for the CLI's output
+var rootLogger = newLogger(os.Stderr)
+
+// Returns a logger that adds the given field to all its entries, in addition to the fields of this logger
+func (logger *Logger) With(key string, value interface{}) *Logger {
+
+	fields := make(map[string]interface{}, len(logger.fields)+1)
+	for existingKey, existingValue := range logger.fields {
+		fields[existingKey] = existingValue
+	}
+	fields[key] = value
+
+	return &Logger{sink: logger.sink, fields: fields}
+}
+
+// Returns a logger with the instance's name and zone attached
+func (logger *Logger) WithInstance(instance OnDemandInstance) *Logger {
+	return logger.With(logFieldInstance, instance.InstanceName).With(logFieldZone, instance.Zone)
+}
+
+func (logger *Logger) log(severity string, format string, params ...interface{}) {
+
+	entry := make(map[string]interface{}, len(logger.fields)+3)
+	for key, value := range logger.fields {
+		entry[key] = value
+	}
+	entry["severity"] = severity
+	entry["message"] = fmt.Sprintf(format, params...)
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	jsonEntry, err := json.Marshal(entry)
+	if err != nil {
+		jsonEntry, _ = json.Marshal(LogMessage{Message: fmt.Sprintf("Error while marshalling log entry to json: %v", err), Severity: severityError})
+	}
+
+	logger.sink.mutex.Lock()
+	defer logger.sink.mutex.Unlock()
+	fmt.Fprintln(logger.sink.output, string(jsonEntry))
+}
+
+func (logger *Logger) Debugf(format string, params ...interface{}) {
+	logger.log(severityDebug, format, params...)
+}
+
+func (logger *Logger) Infof(format string, params ...interface{}) {
+	logger.log(severityInfo, format, params...)
+}
+
+func (logger *Logger) Warningf(format string, params ...interface{}) {
+	logger.log(severityWarning, format, params...)
+}
+
+func (logger *Logger) Errorf(format string, params ...interface{}) {
+	logger.log(severityError, format, params...)
+}
+
+type loggerContextKey struct{}
+
+// Attaches a logger to the context; functions further down the call chain log through it
+func WithLogger(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// Returns the logger attached to the context, or the root logger if there is none
+func GetLogger(ctx context.Context) *Logger {
+
+	if logger, ok := ctx.Value(loggerContextKey{}).(*Logger); ok {
+		return logger
+	}
+
+	return rootLogger
+}
+
+func newCorrelationID() string {
+
+	bytes := make([]byte, 8)
+	if _, err := rand.Read(bytes); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(bytes)
+}
+
+// Gives the invocation a correlation ID, unless the caller has already provided one,
+// so that all log entries from one reconcile cycle can be found together
+func withCorrelationID(ctx context.Context) context.Context {
+
+	logger := GetLogger(ctx)
+	if _, exists := logger.fields[logFieldCorrelationID]; exists {
+		return ctx
+	}
+
+	return WithLogger(ctx, logger.With(logFieldCorrelationID, newCorrelationID()))
+}
+
+// Uses the trace ID from an X-Cloud-Trace-Context header as correlation ID, so that log entries
+// can be matched with the request that caused them
+func withTraceCorrelationID(ctx context.Context, traceContext string) context.Context {
+
+	traceID := strings.SplitN(traceContext, "/", 2)[0]
+	if traceID == "" {
+		return withCorrelationID(ctx)
+	}
+
+	return WithLogger(ctx, GetLogger(ctx).With(logFieldCorrelationID, traceID))
+}
+
+func getInstanceNames(instances []OnDemandInstance) []string {
+
+	instanceNames := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		instanceNames = append(instanceNames, instance.InstanceName)
+	}
+
+	return instanceNames
+}
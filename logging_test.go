@@ -0,0 +1,97 @@
+package watchdog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func parseLogEntries(t *testing.T, output *bytes.Buffer) []map[string]interface{} {
+
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Log line is not valid JSON: %v, error: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestLogger(t *testing.T) {
+
+	output := &bytes.Buffer{}
+	logger := newLogger(output).With(logFieldRepository, "my-org/my-repo")
+
+	logger.WithInstance(OnDemandInstance{InstanceName: "instance1", Zone: "europe-west1-b"}).Warningf("Instance %v is stuck", "instance1")
+	logger.Infof("Done")
+
+	entries := parseLogEntries(t, output)
+	if len(entries) != 2 {
+		t.Fatalf("Log entries expected: %v, actual: %v", 2, len(entries))
+	}
+
+	expectedFields := map[string]interface{}{
+		"severity":         severityWarning,
+		"message":          "Instance instance1 is stuck",
+		logFieldRepository: "my-org/my-repo",
+		logFieldInstance:   "instance1",
+		logFieldZone:       "europe-west1-b",
+	}
+	for key, expectedValue := range expectedFields {
+		if entries[0][key] != expectedValue {
+			t.Fatalf("Field %v expected: %v, actual: %v", key, expectedValue, entries[0][key])
+		}
+	}
+
+	if _, exists := entries[1][logFieldInstance]; exists {
+		t.Fatalf("Fields added with With() should not leak into the parent logger, but entry was: %v", entries[1])
+	}
+	if entries[1]["severity"] != severityInfo {
+		t.Fatalf("Severity expected: %v, actual: %v", severityInfo, entries[1]["severity"])
+	}
+}
+
+func TestCorrelationID(t *testing.T) {
+
+	output := &bytes.Buffer{}
+	ctx := WithLogger(context.Background(), newLogger(output))
+
+	t.Run("A correlation ID is assigned once and kept by nested calls", func(t *testing.T) {
+		output.Reset()
+
+		outerCtx := withCorrelationID(ctx)
+		innerCtx := withCorrelationID(outerCtx)
+		GetLogger(outerCtx).Infof("outer")
+		GetLogger(innerCtx).Infof("inner")
+
+		entries := parseLogEntries(t, output)
+		correlationID, ok := entries[0][logFieldCorrelationID].(string)
+		if !ok || correlationID == "" {
+			t.Fatalf("Correlation ID expected, actual entry: %v", entries[0])
+		}
+		if entries[1][logFieldCorrelationID] != correlationID {
+			t.Fatalf("Correlation ID expected: %v, actual: %v", correlationID, entries[1][logFieldCorrelationID])
+		}
+	})
+
+	t.Run("The trace ID from X-Cloud-Trace-Context is used as correlation ID", func(t *testing.T) {
+		output.Reset()
+
+		GetLogger(withTraceCorrelationID(ctx, "105445aa7843bc8bf206b12000100000/1;o=1")).Infof("traced")
+
+		entries := parseLogEntries(t, output)
+		if entries[0][logFieldCorrelationID] != "105445aa7843bc8bf206b12000100000" {
+			t.Fatalf("Correlation ID expected: %v, actual: %v", "105445aa7843bc8bf206b12000100000", entries[0][logFieldCorrelationID])
+		}
+	})
+
+	t.Run("Without a logger in the context, the root logger is used", func(t *testing.T) {
+		if GetLogger(context.Background()) != rootLogger {
+			t.Fatalf("Root logger expected")
+		}
+	})
+}
@@ -0,0 +1,263 @@
+package watchdog
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+)
+
+// Describes the size of the Managed Instance Group behind a pool, before and after reconciliation
+type InstanceGroupSize struct {
+	Pool          string `json:"pool"`
+	InstanceGroup string `json:"instance_group"`
+	Zone          string `json:"zone"`
+	CurrentSize   int64  `json:"current_size"`
+	TargetSize    int64  `json:"target_size"`
+
+	// The size needed for the jobs, before postponing scale-downs; recorded by the scale-down tracker
+	desiredSize int64
+}
+
+// Counts the jobs that can be served by the pool's runners, limited to the pool's minimum and maximum size
+func getDesiredInstanceGroupSize(pool PoolConfig, jobRunners []RunsOn) int64 {
+
+	var jobCount int64
+
+	for _, runsOn := range jobRunners {
+		for _, runner := range pool.Runners {
+			if runsOn.MatchesRunner(runner, pool.RunnerGroup) {
+				jobCount++
+				break
+			}
+		}
+	}
+
+	if jobCount < pool.MinSize {
+		return pool.MinSize
+	}
+	if jobCount > pool.MaxSize {
+		return pool.MaxSize
+	}
+	return jobCount
+}
+
+// Remembers since when each instance group has been larger than needed, across invocations
+type scaleDownTracker struct {
+	mutex          sync.Mutex
+	oversizedSince map[string]time.Time
+}
+
+var instanceGroupScaleDownTracker = &scaleDownTracker{oversizedSince: make(map[string]time.Time)}
+
+// Returns the size that an instance group should be resized to, without recording anything
+// Scaling down is postponed until the instance group has been larger than needed for at least the grace period
+func (tracker *scaleDownTracker) getTargetSize(instanceGroup string, currentSize int64, desiredSize int64, gracePeriod time.Duration, now time.Time) int64 {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if desiredSize >= currentSize {
+		return desiredSize
+	}
+
+	since, exists := tracker.oversizedSince[instanceGroup]
+	if !exists {
+		since = now
+	}
+
+	if now.Sub(since) < gracePeriod {
+		return currentSize
+	}
+
+	return desiredSize
+}
+
+// Records which instance groups are larger than needed
+func (tracker *scaleDownTracker) update(instanceGroups []InstanceGroupSize, now time.Time) {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	for _, instanceGroup := range instanceGroups {
+		if instanceGroup.desiredSize >= instanceGroup.CurrentSize {
+			delete(tracker.oversizedSince, instanceGroup.InstanceGroup)
+		} else if _, exists := tracker.oversizedSince[instanceGroup.InstanceGroup]; !exists {
+			tracker.oversizedSince[instanceGroup.InstanceGroup] = now
+		}
+	}
+}
+
+// Determines the target size of each Managed Instance Group pool, based on the jobs across all repositories
+// When requirements are incomplete, instance groups are only scaled up, unless policies say otherwise
+func planInstanceGroups(ctx context.Context, computeService *compute.Service, config Config, jobRunners []RunsOn, incompleteRequirements bool, now time.Time) ([]InstanceGroupSize, error) {
+
+	var instanceGroups []InstanceGroupSize
+
+	for index, pool := range config.Pools {
+		if !pool.isManagedInstanceGroup() {
+			continue
+		}
+
+		logger := GetLogger(ctx).With(logFieldInstanceGroup, pool.InstanceGroup).With(logFieldZone, pool.Zone)
+
+		getCtx, call := startAPICall(ctx, apiCompute, "InstanceGroupManagers.Get", attributeInstanceGroup.String(pool.InstanceGroup), attributeZone.String(pool.Zone))
+		instanceGroupManager, err := computeService.InstanceGroupManagers.Get(config.Project, pool.Zone, pool.InstanceGroup).Context(getCtx).Do()
+		call.end(err)
+		if err != nil {
+			return nil, errors.Wrapf(err, "compute.Service.InstanceGroupManagers.Get(%v, %v, %v) failed", config.Project, pool.Zone, pool.InstanceGroup)
+		}
+
+		currentSize := instanceGroupManager.TargetSize
+		desiredSize := getDesiredInstanceGroupSize(pool, jobRunners)
+
+		if scheduledSize := pool.getScheduledMinimum(now); desiredSize < scheduledSize {
+			logger.Infof("The schedule of pool %v keeps at least %v instance(s) awake", pool.Name, scheduledSize)
+			desiredSize = scheduledSize
+			if desiredSize > pool.MaxSize {
+				desiredSize = pool.MaxSize
+			}
+		}
+
+		if incompleteRequirements && !config.Policies.StopOnIncompleteRequirements && desiredSize < currentSize {
+			logger.Warningf("Requirements are incomplete; instance group %v will not be scaled down", pool.InstanceGroup)
+			desiredSize = currentSize
+		}
+
+		gracePeriod := config.idleGracePeriodForPool(&config.Pools[index])
+		targetSize := instanceGroupScaleDownTracker.getTargetSize(pool.InstanceGroup, currentSize, desiredSize, gracePeriod, now)
+		if targetSize > desiredSize {
+			logger.Infof("Instance group %v is larger than needed, but has not been so for its grace period of %v; it will not be scaled down yet", pool.InstanceGroup, gracePeriod)
+		}
+
+		logger.Infof("Instance group %v (pool %v): current size %v, target size %v", pool.InstanceGroup, pool.Name, currentSize, targetSize)
+
+		instanceGroups = append(instanceGroups, InstanceGroupSize{Pool: pool.Name, InstanceGroup: pool.InstanceGroup, Zone: pool.Zone, CurrentSize: currentSize, TargetSize: targetSize, desiredSize: desiredSize})
+	}
+
+	return instanceGroups, nil
+}
+
+// Returns the managed instances of an instance group that can be deleted without interrupting a job:
+// those whose runner GitHub does not report as busy, and that are not already being deleted
+func getIdleManagedInstances(managedInstances []*compute.ManagedInstance, runners []gitHubRunner) []*compute.ManagedInstance {
+
+	var idleInstances []*compute.ManagedInstance
+
+	for _, managedInstance := range managedInstances {
+		if managedInstance.CurrentAction == "DELETING" || managedInstance.CurrentAction == "ABANDONING" {
+			continue
+		}
+
+		instance := OnDemandInstance{InstanceName: getResourceNameFromURL(managedInstance.Instance)}
+		if runner := findGitHubRunner(instance, nil, runners); runner != nil && runner.Busy {
+			continue
+		}
+
+		idleInstances = append(idleInstances, managedInstance)
+	}
+
+	return idleInstances
+}
+
+// Shrinks an instance group by deleting specific idle instances; resizing it instead would let GCE pick which VMs to delete,
+// including VMs that are running a job
+// Returns the number of instances deleted, which is less than requested when too few instances are idle
+func deleteIdleInstances(ctx context.Context, computeService *compute.Service, project string, instanceGroup InstanceGroupSize, runners []gitHubRunner) (int64, error) {
+
+	logger := GetLogger(ctx).With(logFieldInstanceGroup, instanceGroup.InstanceGroup).With(logFieldZone, instanceGroup.Zone)
+
+	var managedInstances []*compute.ManagedInstance
+	listCtx, call := startAPICall(ctx, apiCompute, "InstanceGroupManagers.ListManagedInstances", attributeInstanceGroup.String(instanceGroup.InstanceGroup), attributeZone.String(instanceGroup.Zone))
+	err := computeService.InstanceGroupManagers.ListManagedInstances(project, instanceGroup.Zone, instanceGroup.InstanceGroup).Pages(listCtx, func(response *compute.InstanceGroupManagersListManagedInstancesResponse) error {
+		managedInstances = append(managedInstances, response.ManagedInstances...)
+		return nil
+	})
+	call.end(err)
+	if err != nil {
+		return 0, errors.Wrapf(err, "compute.Service.InstanceGroupManagers.ListManagedInstances(%v, %v, %v) failed", project, instanceGroup.Zone, instanceGroup.InstanceGroup)
+	}
+
+	idleInstances := getIdleManagedInstances(managedInstances, runners)
+
+	count := instanceGroup.CurrentSize - instanceGroup.TargetSize
+	if int64(len(idleInstances)) < count {
+		logger.Infof("Only %v instance(s) of instance group %v are idle; busy instances will not be deleted", len(idleInstances), instanceGroup.InstanceGroup)
+		count = int64(len(idleInstances))
+	}
+	if count == 0 {
+		return 0, nil
+	}
+
+	var instanceURLs []string
+	var instanceNames []string
+	for _, managedInstance := range idleInstances[:count] {
+		instanceURLs = append(instanceURLs, managedInstance.Instance)
+		instanceNames = append(instanceNames, getResourceNameFromURL(managedInstance.Instance))
+	}
+
+	logger.Infof("Deleting idle instances %v from instance group %v", instanceNames, instanceGroup.InstanceGroup)
+	request := &compute.InstanceGroupManagersDeleteInstancesRequest{Instances: instanceURLs}
+	deleteCtx, call := startAPICall(ctx, apiCompute, "InstanceGroupManagers.DeleteInstances", attributeInstanceGroup.String(instanceGroup.InstanceGroup), attributeZone.String(instanceGroup.Zone))
+	_, err = computeService.InstanceGroupManagers.DeleteInstances(project, instanceGroup.Zone, instanceGroup.InstanceGroup, request).Context(deleteCtx).Do()
+	call.end(err)
+	observeInstanceOperation("resize", err)
+	if err != nil {
+		return 0, errors.Wrapf(err, "compute.Service.InstanceGroupManagers.DeleteInstances(%v, %v, %v, %v) failed", project, instanceGroup.Zone, instanceGroup.InstanceGroup, instanceNames)
+	}
+
+	return count, nil
+}
+
+// Resizes the instance groups whose target size differs from their current size
+// Instance groups are scaled up by resizing, and scaled down by deleting idle instances; when GitHub cannot be asked
+// which runners are busy, instance groups are not scaled down
+// The operations are not waited for; the instance groups create and delete VMs in the background
+// The target sizes are updated to the sizes that the instance groups were actually resized to
+func resizeInstanceGroups(ctx context.Context, computeService *compute.Service, gitHubClient *github.Client, config Config, instanceGroups []InstanceGroupSize) error {
+
+	var runners []gitHubRunner
+	runnersListed := false
+
+	for index := range instanceGroups {
+		instanceGroup := &instanceGroups[index]
+		if instanceGroup.TargetSize == instanceGroup.CurrentSize {
+			continue
+		}
+
+		logger := GetLogger(ctx).With(logFieldInstanceGroup, instanceGroup.InstanceGroup).With(logFieldZone, instanceGroup.Zone)
+
+		if instanceGroup.TargetSize < instanceGroup.CurrentSize {
+			if !runnersListed {
+				var err error
+				if runners, err = getSelfHostedRunnersForRepositories(ctx, gitHubClient, config.Repositories, usesOrganizationRunners(config, nil)); err != nil {
+					logger.Warningf("Unable to determine which runners are busy; instance group %v will not be scaled down: %v", instanceGroup.InstanceGroup, err)
+					instanceGroup.TargetSize = instanceGroup.CurrentSize
+					continue
+				}
+				runnersListed = true
+			}
+
+			deleted, err := deleteIdleInstances(ctx, computeService, config.Project, *instanceGroup, runners)
+			instanceGroup.TargetSize = instanceGroup.CurrentSize - deleted
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		logger.Infof("Resizing instance group %v from %v to %v", instanceGroup.InstanceGroup, instanceGroup.CurrentSize, instanceGroup.TargetSize)
+		resizeCtx, call := startAPICall(ctx, apiCompute, "InstanceGroupManagers.Resize", attributeInstanceGroup.String(instanceGroup.InstanceGroup), attributeZone.String(instanceGroup.Zone))
+		_, err := computeService.InstanceGroupManagers.Resize(config.Project, instanceGroup.Zone, instanceGroup.InstanceGroup, instanceGroup.TargetSize).Context(resizeCtx).Do()
+		call.end(err)
+		observeInstanceOperation("resize", err)
+		if err != nil {
+			return errors.Wrapf(err, "compute.Service.InstanceGroupManagers.Resize(%v, %v, %v, %v) failed", config.Project, instanceGroup.Zone, instanceGroup.InstanceGroup, instanceGroup.TargetSize)
+		}
+	}
+
+	return nil
+}
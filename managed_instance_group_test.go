@@ -0,0 +1,192 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+func TestGetDesiredInstanceGroupSize(t *testing.T) {
+
+	pool := PoolConfig{Name: "linux", Type: PoolTypeManagedInstanceGroup, Runners: []string{"cook_agent_linux"}, MinSize: 1, MaxSize: 3}
+
+	cookJob := RunsOn{Labels: []string{"cook_agent_linux"}}
+	buildJob := RunsOn{Labels: []string{"build_agent_win64"}}
+
+	t.Run("One instance per job", func(t *testing.T) {
+
+		if size := getDesiredInstanceGroupSize(pool, []RunsOn{cookJob, buildJob, cookJob}); size != 2 {
+			t.Fatalf("Desired size expected: %v, actual: %v", 2, size)
+		}
+	})
+
+	t.Run("Minimum size", func(t *testing.T) {
+
+		if size := getDesiredInstanceGroupSize(pool, []RunsOn{buildJob}); size != 1 {
+			t.Fatalf("Desired size expected: %v, actual: %v", 1, size)
+		}
+	})
+
+	t.Run("Maximum size", func(t *testing.T) {
+
+		if size := getDesiredInstanceGroupSize(pool, []RunsOn{cookJob, cookJob, cookJob, cookJob, cookJob}); size != 3 {
+			t.Fatalf("Desired size expected: %v, actual: %v", 3, size)
+		}
+	})
+
+	t.Run("Runner group", func(t *testing.T) {
+
+		groupPool := pool
+		groupPool.RunnerGroup = "ue4-agents"
+
+		if size := getDesiredInstanceGroupSize(groupPool, []RunsOn{{Group: "ue4-agents"}, {Group: "other-agents"}, cookJob}); size != 2 {
+			t.Fatalf("Desired size expected: %v, actual: %v", 2, size)
+		}
+	})
+}
+
+func TestScaleDownTracker(t *testing.T) {
+
+	tracker := &scaleDownTracker{oversizedSince: make(map[string]time.Time)}
+
+	now := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	if size := tracker.getTargetSize("cook-agents", 1, 3, 10*time.Minute, now); size != 3 {
+		t.Fatalf("Scaling up should happen immediately; target size expected: %v, actual: %v", 3, size)
+	}
+
+	if size := tracker.getTargetSize("cook-agents", 3, 1, 10*time.Minute, now); size != 3 {
+		t.Fatalf("Scaling down should wait for the grace period; target size expected: %v, actual: %v", 3, size)
+	}
+
+	// Only recorded observations count towards the grace period, so that dry runs do not affect later reconcile cycles
+	if size := tracker.getTargetSize("cook-agents", 3, 1, 10*time.Minute, now.Add(10*time.Minute)); size != 3 {
+		t.Fatalf("Scaling down should wait for the grace period from when the instance group was first recorded as oversized; target size expected: %v, actual: %v", 3, size)
+	}
+
+	tracker.update([]InstanceGroupSize{{InstanceGroup: "cook-agents", CurrentSize: 3, desiredSize: 1}}, now)
+
+	if size := tracker.getTargetSize("cook-agents", 3, 1, 10*time.Minute, now.Add(10*time.Minute)); size != 1 {
+		t.Fatalf("Scaling down should happen after the grace period; target size expected: %v, actual: %v", 1, size)
+	}
+
+	tracker.update([]InstanceGroupSize{{InstanceGroup: "cook-agents", CurrentSize: 1, desiredSize: 1}}, now.Add(10*time.Minute))
+	if len(tracker.oversizedSince) != 0 {
+		t.Fatalf("Instance groups that are no longer oversized should be forgotten, but tracker contains %v", tracker.oversizedSince)
+	}
+}
+
+func TestPlanAndResizeInstanceGroups(t *testing.T) {
+
+	var resizeRequests []string
+	var deleteRequests []string
+
+	httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		switch r.URL.Path {
+		case "/compute/v1/projects/my-project/zones/europe-west1-b/instanceGroupManagers/cook-agents":
+			fmt.Fprintln(w, `{ "name": "cook-agents", "targetSize": 1 }`)
+		case "/compute/v1/projects/my-project/zones/europe-west1-b/instanceGroupManagers/cook-agents/resize":
+			resizeRequests = append(resizeRequests, r.URL.Query().Get("size"))
+			fmt.Fprintln(w, `{ "name": "operation-1", "status": "RUNNING" }`)
+		case "/compute/v1/projects/my-project/zones/europe-west1-b/instanceGroupManagers/cook-agents/listManagedInstances":
+			fmt.Fprintln(w, `{ "managedInstances": [
+				{ "instance": "https://www.googleapis.com/compute/v1/projects/my-project/zones/europe-west1-b/instances/cook-agents-a" },
+				{ "instance": "https://www.googleapis.com/compute/v1/projects/my-project/zones/europe-west1-b/instances/cook-agents-b" },
+				{ "instance": "https://www.googleapis.com/compute/v1/projects/my-project/zones/europe-west1-b/instances/cook-agents-c" }
+			] }`)
+		case "/compute/v1/projects/my-project/zones/europe-west1-b/instanceGroupManagers/cook-agents/deleteInstances":
+			body, _ := ioutil.ReadAll(r.Body)
+			deleteRequests = append(deleteRequests, string(body))
+			fmt.Fprintln(w, `{ "name": "operation-2", "status": "RUNNING" }`)
+		case "/repos/MyOrg/MyRepo/actions/runners":
+			fmt.Fprintln(w, `{ "total_count": 3, "runners": [
+				{ "id": 1, "name": "cook-agents-a", "status": "online", "busy": true },
+				{ "id": 2, "name": "cook-agents-b", "status": "online", "busy": true },
+				{ "id": 3, "name": "cook-agents-c", "status": "online", "busy": false }
+			] }`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer teardown()
+
+	ctx := context.Background()
+
+	computeService, err := compute.NewService(ctx, option.WithHTTPClient(httpClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{
+		Project:      "my-project",
+		Repositories: []RepositoryConfig{{Organization: "MyOrg", Repository: "MyRepo"}},
+		Pools: []PoolConfig{
+			{Name: "win64", Runners: []string{"build_agent_win64"}},
+			{Name: "linux", Type: PoolTypeManagedInstanceGroup, Runners: []string{"cook_agent_linux"}, InstanceGroup: "cook-agents", Zone: "europe-west1-b", MaxSize: 4},
+		},
+	}
+
+	jobRunners := []RunsOn{{Labels: []string{"cook_agent_linux"}}, {Labels: []string{"cook_agent_linux"}}, {Labels: []string{"build_agent_win64"}}}
+
+	instanceGroups, err := planInstanceGroups(ctx, computeService, config, jobRunners, false, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedInstanceGroups := []InstanceGroupSize{{Pool: "linux", InstanceGroup: "cook-agents", Zone: "europe-west1-b", CurrentSize: 1, TargetSize: 2, desiredSize: 2}}
+	if !reflect.DeepEqual(expectedInstanceGroups, instanceGroups) {
+		t.Fatalf("Instance groups diff. Expected: %v, actual: %v", expectedInstanceGroups, instanceGroups)
+	}
+
+	if err := resizeInstanceGroups(ctx, computeService, github.NewClient(httpClient), config, instanceGroups); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedResizeRequests := []string{"2"}
+	if !reflect.DeepEqual(expectedResizeRequests, resizeRequests) {
+		t.Fatalf("Resize requests diff. Expected: %v, actual: %v", expectedResizeRequests, resizeRequests)
+	}
+
+	t.Run("Scaling down deletes idle instances only", func(t *testing.T) {
+
+		instanceGroups := []InstanceGroupSize{{Pool: "linux", InstanceGroup: "cook-agents", Zone: "europe-west1-b", CurrentSize: 3, TargetSize: 0}}
+
+		if err := resizeInstanceGroups(ctx, computeService, github.NewClient(httpClient), config, instanceGroups); err != nil {
+			t.Fatal(err)
+		}
+
+		expectedDeleteRequests := []string{`{"instances":["https://www.googleapis.com/compute/v1/projects/my-project/zones/europe-west1-b/instances/cook-agents-c"]}` + "\n"}
+		if !reflect.DeepEqual(expectedDeleteRequests, deleteRequests) {
+			t.Fatalf("Delete requests diff. Expected: %v, actual: %v", expectedDeleteRequests, deleteRequests)
+		}
+
+		if len(resizeRequests) != 1 {
+			t.Fatalf("Instance groups should not be scaled down by resizing, resize requests: %v", resizeRequests)
+		}
+
+		if instanceGroups[0].TargetSize != 2 {
+			t.Fatalf("Target size should exclude the busy instances; expected: %v, actual: %v", 2, instanceGroups[0].TargetSize)
+		}
+	})
+
+	t.Run("Incomplete requirements", func(t *testing.T) {
+
+		instanceGroups, err := planInstanceGroups(ctx, computeService, config, nil, true, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(instanceGroups) != 1 || instanceGroups[0].TargetSize != 1 {
+			t.Fatalf("Instance group should not be scaled down when requirements are incomplete, actual: %v", instanceGroups)
+		}
+	})
+}
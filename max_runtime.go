@@ -0,0 +1,211 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+)
+
+// An in-progress job whose instance was stopped for exceeding its pool's maximum runtime
+// GitHub likely lost track of the job, for example because its runner crashed
+type StaleRun struct {
+	RunID        int64     `json:"run_id"`
+	WorkflowPath string    `json:"workflow_path"`
+	Job          string    `json:"job"`
+	Instance     string    `json:"instance"`
+	Zone         string    `json:"zone"`
+	Runner       string    `json:"runner"`
+	RunningSince time.Time `json:"running_since"`
+	Cancelled    bool      `json:"cancelled"`
+	CancelError  string    `json:"cancel_error,omitempty"`
+}
+
+// Remembers since when each instance has been observed awake, across invocations
+// This is used for instances whose last start is not known from GCE, such as resumed instances
+type awakeTracker struct {
+	mutex      sync.Mutex
+	awakeSince map[string]time.Time
+}
+
+var instanceAwakeTracker = &awakeTracker{awakeSince: make(map[string]time.Time)}
+
+// Returns since when each of the given instances that are awake has been running, without recording anything
+func (tracker *awakeTracker) getRunningSince(onDemandInstances []OnDemandInstance, now time.Time) map[string]time.Time {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	runningSince := make(map[string]time.Time)
+
+	for _, instance := range onDemandInstances {
+		if !isInstanceAwake(instance.Status) {
+			continue
+		}
+
+		key := getInstanceKey(instance.Zone, instance.InstanceName)
+		if !instance.runningSince.IsZero() {
+			runningSince[key] = instance.runningSince
+		} else if awakeSince, exists := tracker.awakeSince[key]; exists {
+			runningSince[key] = awakeSince
+		} else {
+			runningSince[key] = now
+		}
+	}
+
+	return runningSince
+}
+
+// Records which of the given instances are awake
+func (tracker *awakeTracker) update(onDemandInstances []OnDemandInstance, now time.Time) {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	for _, instance := range onDemandInstances {
+		key := getInstanceKey(instance.Zone, instance.InstanceName)
+		if !isInstanceAwake(instance.Status) {
+			delete(tracker.awakeSince, key)
+		} else if _, exists := tracker.awakeSince[key]; !exists {
+			tracker.awakeSince[key] = now
+		}
+	}
+}
+
+// Returns the running instances that have been running for longer than their pool's maximum runtime
+func getRunawayInstances(config Config, onDemandInstances []OnDemandInstance, runningSince map[string]time.Time, now time.Time) []OnDemandInstance {
+
+	var runawayInstances []OnDemandInstance
+
+	for _, instance := range onDemandInstances {
+		pool := config.poolForRunner(instance.RunnerName)
+		if pool == nil || pool.MaxRuntime <= 0 || instance.Status != instanceStatusRunning {
+			continue
+		}
+
+		since, exists := runningSince[getInstanceKey(instance.Zone, instance.InstanceName)]
+		if exists && now.Sub(since) > time.Duration(pool.MaxRuntime) {
+			runawayInstances = append(runawayInstances, instance)
+		}
+	}
+
+	return runawayInstances
+}
+
+// Returns the in-progress jobs that GitHub reports as running on a runaway instance
+// Jobs on other instances with the same runner labels are left alone, so that healthy runs are not cancelled
+func getStaleRuns(instance OnDemandInstance, onDemandInstances []OnDemandInstance, demands []jobDemand, runningSince time.Time) []StaleRun {
+
+	var staleRuns []StaleRun
+
+	for _, demand := range demands {
+		if demand.InProgress && !demand.PreWarm && isRunnerOfInstance(demand.RunnerName, instance, onDemandInstances) {
+			staleRuns = append(staleRuns, StaleRun{RunID: demand.RunID, WorkflowPath: demand.WorkflowPath, Job: demand.Job, Instance: instance.InstanceName, Zone: instance.Zone, Runner: instance.RunnerName, RunningSince: runningSince})
+		}
+	}
+
+	return staleRuns
+}
+
+func getMaxRuntimeReason(config Config, instance OnDemandInstance, runningSince time.Time) string {
+
+	var maxRuntime time.Duration
+	var poolName string
+	if pool := config.poolForRunner(instance.RunnerName); pool != nil {
+		maxRuntime, poolName = time.Duration(pool.MaxRuntime), pool.Name
+	}
+
+	return fmt.Sprintf("Running since %v, which exceeds the max-runtime of %v of pool %v", runningSince.UTC().Format(time.RFC3339), maxRuntime, poolName)
+}
+
+// Remembers the jobs of stale runs, across invocations
+// These jobs no longer count as requiring a runner, so that the instances stopped for them are not started again
+type staleJobTracker struct {
+	mutex   sync.Mutex
+	flagged map[string]bool
+}
+
+var staleJobs = &staleJobTracker{flagged: make(map[string]bool)}
+
+func getStaleJobKey(repository string, runID int64, job string) string {
+	return fmt.Sprintf("%v/%v/%v", repository, runID, job)
+}
+
+func (tracker *staleJobTracker) flag(repository string, staleRuns []StaleRun) {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	for _, staleRun := range staleRuns {
+		tracker.flagged[getStaleJobKey(repository, staleRun.RunID, staleRun.Job)] = true
+	}
+}
+
+// Splits a repository's demands into those to act on and those of stale jobs
+func (tracker *staleJobTracker) exclude(repository string, demands []jobDemand) ([]jobDemand, []jobDemand) {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	var remainingDemands, staleDemands []jobDemand
+
+	for _, demand := range demands {
+		if tracker.flagged[getStaleJobKey(repository, demand.RunID, demand.Job)] {
+			staleDemands = append(staleDemands, demand)
+		} else {
+			remainingDemands = append(remainingDemands, demand)
+		}
+	}
+
+	return remainingDemands, staleDemands
+}
+
+// Forgets the stale jobs of a repository that are no longer among its demands
+func (tracker *staleJobTracker) forgetInactive(repository string, demands []jobDemand) {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	active := make(map[string]bool)
+	for _, demand := range demands {
+		active[getStaleJobKey(repository, demand.RunID, demand.Job)] = true
+	}
+
+	prefix := repository + "/"
+	for key := range tracker.flagged {
+		if strings.HasPrefix(key, prefix) && !active[key] {
+			delete(tracker.flagged, key)
+		}
+	}
+}
+
+// Cancels the workflow run of each stale run; failures are recorded in the stale runs and logged
+func cancelStaleRuns(ctx context.Context, gitHubClient *github.Client, repository RepositoryConfig, staleRuns []StaleRun) []StaleRun {
+
+	cancelErrors := make(map[int64]error)
+	cancelled := make(map[int64]bool)
+
+	for index := range staleRuns {
+		staleRun := &staleRuns[index]
+
+		if !cancelled[staleRun.RunID] && cancelErrors[staleRun.RunID] == nil {
+			if err := cancelWorkflowRun(ctx, gitHubClient, repository.Organization, repository.Repository, staleRun.RunID); err != nil {
+				GetLogger(ctx).With(logFieldRunID, staleRun.RunID).Errorf("Unable to cancel stale workflow run %v: %v", staleRun.RunID, err)
+				cancelErrors[staleRun.RunID] = err
+			} else {
+				GetLogger(ctx).With(logFieldRunID, staleRun.RunID).Infof("Cancelled stale workflow run %v", staleRun.RunID)
+				cancelled[staleRun.RunID] = true
+			}
+		}
+
+		staleRun.Cancelled = cancelled[staleRun.RunID]
+		if err := cancelErrors[staleRun.RunID]; err != nil {
+			staleRun.CancelError = err.Error()
+		}
+	}
+
+	return staleRuns
+}
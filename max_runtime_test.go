@@ -0,0 +1,150 @@
+package watchdog
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+)
+
+func TestGetRunawayInstances(t *testing.T) {
+
+	maxRuntime := Duration(6 * time.Hour)
+	config := Config{
+		Pools: []PoolConfig{
+			{Name: "win64", Runners: []string{"build_agent", "package_agent"}, MaxRuntime: maxRuntime},
+			{Name: "linux", Runners: []string{"cook_agent"}},
+		},
+	}
+
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	onDemandInstances := []OnDemandInstance{
+		{InstanceName: "build-agent", Zone: "europe-west1-b", RunnerName: "build_agent", Status: "RUNNING", runningSince: now.Add(-7 * time.Hour)},
+		{InstanceName: "package-agent", Zone: "europe-west1-b", RunnerName: "package_agent", Status: "RUNNING"},
+		{InstanceName: "cook-agent", Zone: "europe-west1-b", RunnerName: "cook_agent", Status: "RUNNING", runningSince: now.Add(-7 * time.Hour)},
+	}
+
+	tracker := &awakeTracker{awakeSince: make(map[string]time.Time)}
+
+	// package-agent was resumed, so how long it has been running is only known from when the watchdog first saw it awake
+	tracker.update(onDemandInstances, now.Add(-2*time.Hour))
+
+	// Looking without recording, such as during a dry run, does not change what later invocations see
+	if since := tracker.getRunningSince(onDemandInstances, now.Add(-time.Hour))["europe-west1-b/package-agent"]; !since.Equal(now.Add(-2 * time.Hour)) {
+		t.Fatalf("package-agent running since expected: %v, actual: %v", now.Add(-2*time.Hour), since)
+	}
+
+	runningSince := tracker.getRunningSince(onDemandInstances, now)
+	tracker.update(onDemandInstances, now)
+
+	if since := runningSince["europe-west1-b/package-agent"]; !since.Equal(now.Add(-2 * time.Hour)) {
+		t.Fatalf("package-agent running since expected: %v, actual: %v", now.Add(-2*time.Hour), since)
+	}
+
+	expectedInstances := []OnDemandInstance{onDemandInstances[0]}
+	if instances := getRunawayInstances(config, onDemandInstances, runningSince, now); !reflect.DeepEqual(expectedInstances, instances) {
+		t.Fatalf("Runaway instances expected: %v, actual: %v", expectedInstances, instances)
+	}
+
+	t.Run("In-progress jobs on runaway instances are stale", func(t *testing.T) {
+
+		demands := []jobDemand{
+			{RunID: 1, WorkflowPath: ".github/workflows/build.yaml", Job: "compile", RunsOn: RunsOn{Labels: []string{"build_agent"}}, InProgress: true, RunnerName: "build_agent"},
+			{RunID: 2, WorkflowPath: ".github/workflows/build.yaml", Job: "compile", RunsOn: RunsOn{Labels: []string{"build_agent"}}, QueuedAt: now},
+			{RunID: 3, WorkflowPath: ".github/workflows/build.yaml", Job: "cook", RunsOn: RunsOn{Labels: []string{"cook_agent"}}, InProgress: true, RunnerName: "cook_agent"},
+		}
+
+		expectedStaleRuns := []StaleRun{{RunID: 1, WorkflowPath: ".github/workflows/build.yaml", Job: "compile", Instance: "build-agent", Zone: "europe-west1-b", Runner: "build_agent", RunningSince: now.Add(-7 * time.Hour)}}
+		if staleRuns := getStaleRuns(onDemandInstances[0], onDemandInstances, demands, now.Add(-7*time.Hour)); !reflect.DeepEqual(expectedStaleRuns, staleRuns) {
+			t.Fatalf("Stale runs expected: %+v, actual: %+v", expectedStaleRuns, staleRuns)
+		}
+	})
+
+	t.Run("Jobs on other instances with the same runner labels are not stale", func(t *testing.T) {
+
+		buildAgents := []OnDemandInstance{
+			{InstanceName: "build-agent-1", Zone: "europe-west1-b", RunnerName: "build_agent", Status: "RUNNING"},
+			{InstanceName: "build-agent-2", Zone: "europe-west1-b", RunnerName: "build_agent", Status: "RUNNING"},
+		}
+
+		demands := []jobDemand{
+			{RunID: 1, WorkflowPath: ".github/workflows/build.yaml", Job: "compile", RunsOn: RunsOn{Labels: []string{"build_agent"}}, InProgress: true, RunnerName: "build-agent-2"},
+			{RunID: 2, WorkflowPath: ".github/workflows/build.yaml", Job: "compile", RunsOn: RunsOn{Labels: []string{"build_agent"}}, InProgress: true, RunnerName: "build-agent-1"},
+			{RunID: 3, WorkflowPath: ".github/workflows/build.yaml", Job: "compile", RunsOn: RunsOn{Labels: []string{"build_agent"}}, InProgress: true},
+			// Several instances carry this runner name, so the job cannot be attributed to either of them
+			{RunID: 4, WorkflowPath: ".github/workflows/build.yaml", Job: "compile", RunsOn: RunsOn{Labels: []string{"build_agent"}}, InProgress: true, RunnerName: "build_agent"},
+		}
+
+		expectedStaleRuns := []StaleRun{{RunID: 2, WorkflowPath: ".github/workflows/build.yaml", Job: "compile", Instance: "build-agent-1", Zone: "europe-west1-b", Runner: "build_agent", RunningSince: now.Add(-7 * time.Hour)}}
+		if staleRuns := getStaleRuns(buildAgents[0], buildAgents, demands, now.Add(-7*time.Hour)); !reflect.DeepEqual(expectedStaleRuns, staleRuns) {
+			t.Fatalf("Stale runs expected: %+v, actual: %+v", expectedStaleRuns, staleRuns)
+		}
+	})
+}
+
+func TestStaleJobTracker(t *testing.T) {
+
+	tracker := &staleJobTracker{flagged: make(map[string]bool)}
+	tracker.flag("MyOrg/MyRepo", []StaleRun{{RunID: 1, Job: "compile"}})
+
+	demands := []jobDemand{
+		{RunID: 1, Job: "compile"},
+		{RunID: 1, Job: "test"},
+	}
+
+	remainingDemands, staleDemands := tracker.exclude("MyOrg/MyRepo", demands)
+	if !reflect.DeepEqual(demands[1:], remainingDemands) || !reflect.DeepEqual(demands[:1], staleDemands) {
+		t.Fatalf("Stale job compile should be excluded, remaining: %v, stale: %v", remainingDemands, staleDemands)
+	}
+
+	if _, staleDemands := tracker.exclude("MyOrg/OtherRepo", demands); len(staleDemands) != 0 {
+		t.Fatalf("Stale jobs are tracked per repository, actual: %v", staleDemands)
+	}
+
+	// Once the job is no longer active, it is forgotten
+	tracker.forgetInactive("MyOrg/MyRepo", demands)
+	if _, staleDemands := tracker.exclude("MyOrg/MyRepo", demands); len(staleDemands) != 1 {
+		t.Fatalf("Stale job is still active and should be remembered, actual: %v", staleDemands)
+	}
+	tracker.forgetInactive("MyOrg/MyRepo", nil)
+	if _, staleDemands := tracker.exclude("MyOrg/MyRepo", demands); len(staleDemands) != 0 {
+		t.Fatalf("Stale job should have been forgotten, actual: %v", staleDemands)
+	}
+}
+
+func TestCancelStaleRuns(t *testing.T) {
+
+	var cancelRequests []string
+
+	httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		cancelRequests = append(cancelRequests, r.Method+" "+r.URL.Path)
+		if r.URL.Path == "/repos/MyOrg/MyRepo/actions/runs/2/cancel" {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer teardown()
+
+	staleRuns := []StaleRun{
+		{RunID: 1, Job: "compile"},
+		{RunID: 1, Job: "test"},
+		{RunID: 2, Job: "compile"},
+	}
+
+	staleRuns = cancelStaleRuns(context.Background(), github.NewClient(httpClient), RepositoryConfig{Organization: "MyOrg", Repository: "MyRepo"}, staleRuns)
+
+	expectedRequests := []string{"POST /repos/MyOrg/MyRepo/actions/runs/1/cancel", "POST /repos/MyOrg/MyRepo/actions/runs/2/cancel"}
+	if !reflect.DeepEqual(expectedRequests, cancelRequests) {
+		t.Fatalf("Each run should be cancelled once; requests expected: %v, actual: %v", expectedRequests, cancelRequests)
+	}
+
+	if !staleRuns[0].Cancelled || !staleRuns[1].Cancelled || staleRuns[2].Cancelled || staleRuns[2].CancelError == "" {
+		t.Fatalf("Run 1 should be cancelled and run 2 should have an error, actual: %+v", staleRuns)
+	}
+}
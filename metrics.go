@@ -0,0 +1,114 @@
+package watchdog
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are registered with the default Prometheus registry; cmd serves them at /metrics
+var (
+	runnersRequiredGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "watchdog_runners_required",
+		Help: "Number of distinct runners required by jobs, by kind (required: runnable now, pre_warmed: runnable soon)",
+	}, []string{"kind"})
+
+	instancesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "watchdog_instances",
+		Help: "Number of on-demand instances, by GCE status",
+	}, []string{"status"})
+
+	poolSpendGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "watchdog_pool_spend",
+		Help: "Estimated spend of each pool's instances during the current month, in the currency of the configured prices",
+	}, []string{"pool"})
+
+	instanceOperationsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "watchdog_instance_operations_total",
+		Help: "Number of instance operations issued, by operation (start, resume, stop, suspend, resize) and result (success, failure)",
+	}, []string{"operation", "result"})
+
+	apiCallDurationHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "watchdog_api_call_duration_seconds",
+		Help:    "Latency of GitHub and GCE API calls, by API and method",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"api", "method"})
+
+	apiCallErrorsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "watchdog_api_call_errors_total",
+		Help: "Number of failed GitHub and GCE API calls, by API and method",
+	}, []string{"api", "method"})
+
+	jobQueueWaitHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "watchdog_job_queue_wait_seconds",
+		Help:    "Time from a job being queued until it started running, by runner",
+		Buckets: []float64{5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+	}, []string{"runner"})
+
+	jobColdStartHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "watchdog_job_cold_start_seconds",
+		Help:    "Part of a job's queue wait spent waiting for an instance that the watchdog started, by runner",
+		Buckets: []float64{5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+	}, []string{"runner"})
+
+	reconcileDurationHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "watchdog_reconcile_duration_seconds",
+		Help:    "Duration of reconcile cycles, by result (success, failure)",
+		Buckets: []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"result"})
+)
+
+const (
+	apiGitHub  = "github"
+	apiCompute = "compute"
+)
+
+func getResultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// Records the latency and outcome of an API call that started at the given time
+func observeAPICall(api string, method string, start time.Time, err error) {
+
+	apiCallDurationHistogram.WithLabelValues(api, method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		apiCallErrorsCounter.WithLabelValues(api, method).Inc()
+	}
+}
+
+func observeInstanceOperation(operation string, err error) {
+	instanceOperationsCounter.WithLabelValues(operation, getResultLabel(err)).Inc()
+}
+
+func observeJobQueueWait(runner string, wait time.Duration, coldStart time.Duration) {
+
+	jobQueueWaitHistogram.WithLabelValues(runner).Observe(wait.Seconds())
+	if coldStart > 0 {
+		jobColdStartHistogram.WithLabelValues(runner).Observe(coldStart.Seconds())
+	}
+}
+
+func observeReconcile(start time.Time, err error) {
+	reconcileDurationHistogram.WithLabelValues(getResultLabel(err)).Observe(time.Since(start).Seconds())
+}
+
+// Updates the gauges that describe the outcome of the latest reconcile cycle
+func observeReconcileResult(result *Result) {
+
+	runnersRequiredGauge.WithLabelValues("required").Set(float64(len(result.RunnersRequired)))
+	runnersRequiredGauge.WithLabelValues("pre_warmed").Set(float64(len(result.RunnersPreWarmed)))
+
+	instancesGauge.Reset()
+	for _, instance := range result.OnDemandInstances {
+		instancesGauge.WithLabelValues(instance.Status).Inc()
+	}
+
+	poolSpendGauge.Reset()
+	for _, spend := range result.Spend {
+		poolSpendGauge.WithLabelValues(spend.Pool).Set(spend.Spend)
+	}
+}
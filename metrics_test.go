@@ -0,0 +1,54 @@
+package watchdog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveReconcileResult(t *testing.T) {
+
+	result := &Result{
+		RunnersRequired:  []RunsOn{{Labels: []string{"runner1"}}, {Labels: []string{"runner2"}}},
+		RunnersPreWarmed: []RunsOn{{Labels: []string{"runner3"}}},
+		OnDemandInstances: []OnDemandInstance{
+			{InstanceName: "instance1", Status: "RUNNING"},
+			{InstanceName: "instance2", Status: "RUNNING"},
+			{InstanceName: "instance3", Status: "TERMINATED"},
+		},
+	}
+
+	observeReconcileResult(result)
+
+	if value := testutil.ToFloat64(runnersRequiredGauge.WithLabelValues("required")); value != 2 {
+		t.Fatalf("Runners required expected: %v, actual: %v", 2, value)
+	}
+
+	if value := testutil.ToFloat64(runnersRequiredGauge.WithLabelValues("pre_warmed")); value != 1 {
+		t.Fatalf("Runners pre-warmed expected: %v, actual: %v", 1, value)
+	}
+
+	if value := testutil.ToFloat64(instancesGauge.WithLabelValues("RUNNING")); value != 2 {
+		t.Fatalf("Running instances expected: %v, actual: %v", 2, value)
+	}
+
+	observeReconcileResult(&Result{})
+
+	if count := testutil.CollectAndCount(instancesGauge); count != 0 {
+		t.Fatalf("Instance statuses that no longer occur should be removed, but %v remain", count)
+	}
+}
+
+func TestObserveAPICall(t *testing.T) {
+
+	errorsBefore := testutil.ToFloat64(apiCallErrorsCounter.WithLabelValues(apiGitHub, "Test"))
+
+	observeAPICall(apiGitHub, "Test", time.Now(), nil)
+	observeAPICall(apiGitHub, "Test", time.Now(), errors.New("failed"))
+
+	if value := testutil.ToFloat64(apiCallErrorsCounter.WithLabelValues(apiGitHub, "Test")) - errorsBefore; value != 1 {
+		t.Fatalf("API call errors expected: %v, actual: %v", 1, value)
+	}
+}
@@ -0,0 +1,311 @@
+package watchdog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Kinds of notifications; these are also the names of their templates in the configuration file
+const (
+	notificationInstanceStartFailed     = "instance-start-failed"
+	notificationJobWaiting              = "job-waiting"
+	notificationBusyInstanceStopSkipped = "busy-instance-stop-skipped"
+	notificationBusyInstanceStopForced  = "busy-instance-stop-forced"
+)
+
+var notificationKinds = []string{notificationInstanceStartFailed, notificationJobWaiting, notificationBusyInstanceStopSkipped, notificationBusyInstanceStopForced}
+
+var defaultNotificationTemplates = map[string]string{
+	notificationInstanceStartFailed:     "Failed to {{.Action}} instance {{.Instance}} in {{.Zone}} (runner {{.Runner}}) for {{.Repository}}: {{.Error}}",
+	notificationJobWaiting:              "Job {{.Job}} of workflow run {{.RunID}} ({{.WorkflowPath}}) in {{.Repository}} has been waiting {{.Waited}} for a runner with runs-on {{.Runner}}",
+	notificationBusyInstanceStopSkipped: "Instance {{.Instance}} in {{.Zone}} (runner {{.Runner}}) for {{.Repository}} was not shut down ({{.Action}}) because GitHub reports its runner as busy",
+	notificationBusyInstanceStopForced:  "Instance {{.Instance}} in {{.Zone}} (runner {{.Runner}}) for {{.Repository}} was shut down ({{.Action}}) while GitHub reported its runner as busy, because it exceeded its pool's max-runtime",
+}
+
+// Returns the template for each kind of notification, using the default for templates that are not configured
+func (templates NotificationTemplates) byKind() map[string]string {
+
+	configured := map[string]string{
+		notificationInstanceStartFailed:     templates.InstanceStartFailed,
+		notificationJobWaiting:              templates.JobWaiting,
+		notificationBusyInstanceStopSkipped: templates.BusyInstanceStopSkipped,
+		notificationBusyInstanceStopForced:  templates.BusyInstanceStopForced,
+	}
+
+	byKind := make(map[string]string)
+	for _, kind := range notificationKinds {
+		if configured[kind] != "" {
+			byKind[kind] = configured[kind]
+		} else {
+			byKind[kind] = defaultNotificationTemplates[kind]
+		}
+	}
+
+	return byKind
+}
+
+// Something that happened to an agent that build engineers should know about
+// All fields are available to the notification's template
+type NotificationEvent struct {
+	Kind         string
+	Repository   string
+	Action       string
+	Instance     string
+	Zone         string
+	Runner       string
+	Error        string
+	RunID        int64
+	WorkflowPath string
+	Job          string
+	Waited       time.Duration
+}
+
+// Identifies the event for deduplication; the same failure, wait or stop is only posted once per repeat interval
+func (event NotificationEvent) key() string {
+
+	switch event.Kind {
+	case notificationJobWaiting:
+		return fmt.Sprintf("%v/%v/%v/%v", event.Kind, event.Repository, event.RunID, event.Job)
+	default:
+		return fmt.Sprintf("%v/%v/%v/%v", event.Kind, event.Repository, event.Zone, event.Instance)
+	}
+}
+
+// Determines what to notify about after a repository has been processed
+// Busy instances whose stop was skipped are always reported; busy instances whose stop was forced by max-runtime
+// are reported only if stopping them succeeded
+func getNotificationEvents(repository string, auditEvents []AuditEvent, demands []jobDemand, skippedStops []OnDemandInstance, forcedStops []OnDemandInstance, jobWaitThreshold time.Duration, now time.Time) []NotificationEvent {
+
+	var events []NotificationEvent
+
+	for _, instance := range skippedStops {
+		events = append(events, NotificationEvent{Kind: notificationBusyInstanceStopSkipped, Repository: repository, Action: getStopOperationName(instance), Instance: instance.InstanceName, Zone: instance.Zone, Runner: instance.RunnerName})
+	}
+
+	forced := make(map[string]bool)
+	for _, instance := range forcedStops {
+		forced[getInstanceKey(instance.Zone, instance.InstanceName)] = true
+	}
+
+	for _, auditEvent := range auditEvents {
+		isStart := auditEvent.Action == "start" || auditEvent.Action == "resume"
+		isStop := auditEvent.Action == "stop" || auditEvent.Action == "suspend"
+
+		if isStart && auditEvent.Outcome == auditOutcomeFailure {
+			events = append(events, NotificationEvent{Kind: notificationInstanceStartFailed, Repository: repository, Action: auditEvent.Action, Instance: auditEvent.Instance, Zone: auditEvent.Zone, Runner: auditEvent.Runner, Error: auditEvent.Error})
+		}
+
+		if isStop && auditEvent.Outcome == auditOutcomeSuccess && forced[getInstanceKey(auditEvent.Zone, auditEvent.Instance)] {
+			events = append(events, NotificationEvent{Kind: notificationBusyInstanceStopForced, Repository: repository, Action: auditEvent.Action, Instance: auditEvent.Instance, Zone: auditEvent.Zone, Runner: auditEvent.Runner})
+		}
+	}
+
+	if jobWaitThreshold > 0 {
+		for _, demand := range demands {
+			if demand.QueuedAt.IsZero() || now.Sub(demand.QueuedAt) <= jobWaitThreshold {
+				continue
+			}
+			waited := now.Sub(demand.QueuedAt).Truncate(time.Second)
+			events = append(events, NotificationEvent{Kind: notificationJobWaiting, Repository: repository, Runner: formatRunsOn(demand.RunsOn), RunID: demand.RunID, WorkflowPath: demand.WorkflowPath, Job: demand.Job, Waited: waited})
+		}
+	}
+
+	return events
+}
+
+// Returns the instances among those about to be stopped whose GitHub runner is busy
+func getBusyInstances(instances []OnDemandInstance, onDemandInstances []OnDemandInstance, runners []gitHubRunner) []OnDemandInstance {
+
+	var busyInstances []OnDemandInstance
+
+	for _, instance := range instances {
+		if runner := findGitHubRunner(instance, onDemandInstances, runners); runner != nil && runner.Busy {
+			busyInstances = append(busyInstances, instance)
+		}
+	}
+
+	return busyInstances
+}
+
+// Splits the busy instances among those about to be stopped into those whose stop is skipped, and those that exceeded
+// their pool's max-runtime and are stopped regardless; returns the instances that remain to be stopped
+func skipBusyInstances(instancesToStop []OnDemandInstance, busyInstances []OnDemandInstance, runawayInstances []OnDemandInstance) ([]OnDemandInstance, []OnDemandInstance, []OnDemandInstance) {
+
+	busy := make(map[string]bool)
+	for _, instance := range busyInstances {
+		busy[getInstanceKey(instance.Zone, instance.InstanceName)] = true
+	}
+	runaway := make(map[string]bool)
+	for _, instance := range runawayInstances {
+		runaway[getInstanceKey(instance.Zone, instance.InstanceName)] = true
+	}
+
+	var remainingInstances, skippedStops, forcedStops []OnDemandInstance
+	for _, instance := range instancesToStop {
+		key := getInstanceKey(instance.Zone, instance.InstanceName)
+		switch {
+		case !busy[key]:
+			remainingInstances = append(remainingInstances, instance)
+		case runaway[key]:
+			remainingInstances = append(remainingInstances, instance)
+			forcedStops = append(forcedStops, instance)
+		default:
+			skippedStops = append(skippedStops, instance)
+		}
+	}
+
+	return remainingInstances, skippedStops, forcedStops
+}
+
+// Posts messages to a chat channel
+type Notifier interface {
+	Notify(ctx context.Context, message string) error
+}
+
+// Supported webhook types
+const (
+	WebhookTypeSlack   = "slack"
+	WebhookTypeTeams   = "teams"
+	WebhookTypeDiscord = "discord"
+)
+
+// Posts messages to an incoming webhook; the webhook type decides the shape of the JSON payload
+type webhookNotifier struct {
+	url        string
+	client     *http.Client
+	getPayload func(message string) interface{}
+}
+
+func (notifier *webhookNotifier) Notify(ctx context.Context, message string) error {
+
+	body, err := json.Marshal(notifier.getPayload(message))
+	if err != nil {
+		return errors.Wrap(err, "Error while marshalling webhook payload to json")
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", notifier.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "http.NewRequest(POST) for webhook failed")
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	// Webhook URLs contain credentials, so they are left out of errors
+	response, err := notifier.client.Do(request)
+	if err != nil {
+		return errors.Errorf("HTTP POST to webhook failed: %v", strings.Replace(err.Error(), notifier.url, "<webhook>", -1))
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return errors.Errorf("HTTP POST to webhook returned status code %v", response.Status)
+	}
+	return nil
+}
+
+func newNotifier(webhook WebhookConfig, client *http.Client) Notifier {
+
+	switch webhook.Type {
+	case WebhookTypeSlack:
+		return &webhookNotifier{url: webhook.URL, client: client, getPayload: func(message string) interface{} {
+			return map[string]string{"text": message}
+		}}
+	case WebhookTypeTeams:
+		return &webhookNotifier{url: webhook.URL, client: client, getPayload: func(message string) interface{} {
+			return map[string]string{"@type": "MessageCard", "@context": "https://schema.org/extensions", "summary": message, "text": message}
+		}}
+	case WebhookTypeDiscord:
+		return &webhookNotifier{url: webhook.URL, client: client, getPayload: func(message string) interface{} {
+			return map[string]string{"content": message}
+		}}
+	default:
+		return nil
+	}
+}
+
+// An unresponsive webhook must not hold up the reconcile cycle indefinitely
+var notificationHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// Remembers when each notification was last posted, across invocations
+type notificationTracker struct {
+	mutex    sync.Mutex
+	lastSent map[string]time.Time
+}
+
+var sentNotificationTracker = newNotificationTracker()
+
+func newNotificationTracker() *notificationTracker {
+	return &notificationTracker{lastSent: make(map[string]time.Time)}
+}
+
+// Returns whether a notification should be posted, and if so, records that it has been
+func (tracker *notificationTracker) shouldSend(key string, now time.Time, repeatInterval time.Duration) bool {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	for existingKey, sent := range tracker.lastSent {
+		if now.Sub(sent) >= repeatInterval {
+			delete(tracker.lastSent, existingKey)
+		}
+	}
+
+	if _, exists := tracker.lastSent[key]; exists {
+		return false
+	}
+
+	tracker.lastSent[key] = now
+	return true
+}
+
+func renderNotification(templates map[string]string, event NotificationEvent) (string, error) {
+
+	notificationTemplate, err := template.New(event.Kind).Parse(templates[event.Kind])
+	if err != nil {
+		return "", errors.Wrapf(err, "Error while parsing %v template", event.Kind)
+	}
+
+	var message bytes.Buffer
+	if err := notificationTemplate.Execute(&message, event); err != nil {
+		return "", errors.Wrapf(err, "Error while rendering %v template", event.Kind)
+	}
+
+	return message.String(), nil
+}
+
+// Posts each event that has not been posted within the repeat interval to all webhooks
+// Failures are logged; they do not fail the reconcile cycle
+func sendNotifications(ctx context.Context, config NotificationConfig, tracker *notificationTracker, client *http.Client, events []NotificationEvent, now time.Time) {
+
+	if len(config.Webhooks) == 0 {
+		return
+	}
+
+	templates := config.Templates.byKind()
+
+	for _, event := range events {
+		if !tracker.shouldSend(event.key(), now, time.Duration(config.RepeatInterval)) {
+			continue
+		}
+
+		message, err := renderNotification(templates, event)
+		if err != nil {
+			GetLogger(ctx).Errorf("%+v", err)
+			continue
+		}
+
+		for _, webhook := range config.Webhooks {
+			if err := newNotifier(webhook, client).Notify(ctx, message); err != nil {
+				GetLogger(ctx).Errorf("Unable to post %v notification to %v webhook: %v", event.Kind, webhook.Type, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package watchdog
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetNotificationEvents(t *testing.T) {
+
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	auditEvents := []AuditEvent{
+		{Action: "start", Instance: "broken-agent", Zone: "europe-west1-b", Runner: "agent1", Outcome: auditOutcomeFailure, Error: "quota exceeded"},
+		{Action: "resume", Instance: "good-agent", Zone: "europe-west1-b", Runner: "agent2", Outcome: auditOutcomeSuccess},
+		{Action: "stop", Instance: "busy-agent", Zone: "europe-west1-b", Runner: "agent3", Outcome: auditOutcomeSuccess},
+		{Action: "suspend", Instance: "busy-agent-2", Zone: "europe-west1-b", Runner: "agent4", Outcome: auditOutcomeFailure, Error: "failed"},
+		{Action: "stop", Instance: "idle-agent", Zone: "europe-west1-b", Runner: "agent5", Outcome: auditOutcomeSuccess},
+	}
+
+	skippedStops := []OnDemandInstance{
+		{InstanceName: "busy-idle-agent", Zone: "europe-west1-b", RunnerName: "agent6", StopMode: StopModeSuspend},
+	}
+
+	forcedStops := []OnDemandInstance{
+		{InstanceName: "busy-agent", Zone: "europe-west1-b"},
+		{InstanceName: "busy-agent-2", Zone: "europe-west1-b"},
+	}
+
+	demands := []jobDemand{
+		{RunID: 1, WorkflowPath: ".github/workflows/build.yaml", Job: "compile", RunsOn: RunsOn{Labels: []string{"agent1"}}, QueuedAt: now.Add(-20 * time.Minute)},
+		{RunID: 1, WorkflowPath: ".github/workflows/build.yaml", Job: "test", RunsOn: RunsOn{Labels: []string{"agent2"}}, QueuedAt: now.Add(-5 * time.Minute)},
+		{RunID: 1, WorkflowPath: ".github/workflows/build.yaml", Job: "package", RunsOn: RunsOn{Labels: []string{"agent3"}}},
+	}
+
+	events := getNotificationEvents("MyOrg/MyRepo", auditEvents, demands, skippedStops, forcedStops, 15*time.Minute, now)
+
+	expectedEvents := []NotificationEvent{
+		{Kind: notificationBusyInstanceStopSkipped, Repository: "MyOrg/MyRepo", Action: "suspend", Instance: "busy-idle-agent", Zone: "europe-west1-b", Runner: "agent6"},
+		{Kind: notificationInstanceStartFailed, Repository: "MyOrg/MyRepo", Action: "start", Instance: "broken-agent", Zone: "europe-west1-b", Runner: "agent1", Error: "quota exceeded"},
+		{Kind: notificationBusyInstanceStopForced, Repository: "MyOrg/MyRepo", Action: "stop", Instance: "busy-agent", Zone: "europe-west1-b", Runner: "agent3"},
+		{Kind: notificationJobWaiting, Repository: "MyOrg/MyRepo", Runner: "agent1", RunID: 1, WorkflowPath: ".github/workflows/build.yaml", Job: "compile", Waited: 20 * time.Minute},
+	}
+
+	if !reflect.DeepEqual(expectedEvents, events) {
+		t.Fatalf("Notification events expected: %+v, actual: %+v", expectedEvents, events)
+	}
+
+	t.Run("A threshold of zero disables job wait notifications", func(t *testing.T) {
+		if events := getNotificationEvents("MyOrg/MyRepo", nil, demands, nil, nil, 0, now); len(events) != 0 {
+			t.Fatalf("No events expected, actual: %+v", events)
+		}
+	})
+}
+
+func TestGetBusyInstances(t *testing.T) {
+
+	instances := []OnDemandInstance{
+		{InstanceName: "build-agent-1", Zone: "europe-west1-b", RunnerName: "build_agent", Status: "RUNNING"},
+		{InstanceName: "build-agent-2", Zone: "europe-west1-b", RunnerName: "build_agent", Status: "RUNNING"},
+		{InstanceName: "cook-agent", Zone: "europe-west1-b", RunnerName: "cook_agent", Status: "RUNNING"},
+		{InstanceName: "cook-agent", Zone: "europe-west4-a", RunnerName: "cook_agent", Status: "TERMINATED"},
+	}
+
+	runners := []gitHubRunner{
+		{Name: "build-agent-1", Busy: false},
+		{Name: "build-agent-2", Busy: true},
+		{Name: "cook_agent", Busy: true},
+	}
+
+	// Only one awake instance carries runner name cook_agent, so the runner of that name runs on it
+	expectedInstances := []OnDemandInstance{instances[1], instances[2]}
+	if busyInstances := getBusyInstances(instances[:3], instances, runners); !reflect.DeepEqual(expectedInstances, busyInstances) {
+		t.Fatalf("Busy instances expected: %v, actual: %v", expectedInstances, busyInstances)
+	}
+
+	t.Run("Runner names shared by several awake instances are not matched", func(t *testing.T) {
+
+		runners := []gitHubRunner{
+			{Name: "build_agent", Busy: true},
+		}
+
+		if busyInstances := getBusyInstances(instances[:2], instances, runners); len(busyInstances) != 0 {
+			t.Fatalf("No busy instances expected, actual: %v", busyInstances)
+		}
+	})
+}
+
+func TestSkipBusyInstances(t *testing.T) {
+
+	idleInstance := OnDemandInstance{InstanceName: "idle-agent", Zone: "europe-west1-b"}
+	busyInstance := OnDemandInstance{InstanceName: "busy-agent", Zone: "europe-west1-b"}
+	runawayInstance := OnDemandInstance{InstanceName: "runaway-agent", Zone: "europe-west1-b"}
+
+	instancesToStop := []OnDemandInstance{idleInstance, busyInstance, runawayInstance}
+	busyInstances := []OnDemandInstance{busyInstance, runawayInstance}
+
+	remainingInstances, skippedStops, forcedStops := skipBusyInstances(instancesToStop, busyInstances, []OnDemandInstance{runawayInstance})
+
+	if expected := []OnDemandInstance{idleInstance, runawayInstance}; !reflect.DeepEqual(expected, remainingInstances) {
+		t.Fatalf("Instances to stop expected: %v, actual: %v", expected, remainingInstances)
+	}
+	if expected := []OnDemandInstance{busyInstance}; !reflect.DeepEqual(expected, skippedStops) {
+		t.Fatalf("Skipped stops expected: %v, actual: %v", expected, skippedStops)
+	}
+	if expected := []OnDemandInstance{runawayInstance}; !reflect.DeepEqual(expected, forcedStops) {
+		t.Fatalf("Forced stops expected: %v, actual: %v", expected, forcedStops)
+	}
+}
+
+func TestSendNotifications(t *testing.T) {
+
+	payloads := make(map[string][]map[string]string)
+
+	httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		body, _ := ioutil.ReadAll(r.Body)
+		var payload map[string]string
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("Payload is not a JSON object: %v", string(body))
+		}
+		payloads[r.URL.Path] = append(payloads[r.URL.Path], payload)
+	}))
+	defer teardown()
+
+	config := NotificationConfig{
+		Webhooks: []WebhookConfig{
+			{Type: WebhookTypeSlack, URL: "https://hooks.slack.com/services/slack"},
+			{Type: WebhookTypeTeams, URL: "https://example.webhook.office.com/teams"},
+			{Type: WebhookTypeDiscord, URL: "https://discord.com/api/webhooks/discord"},
+		},
+		RepeatInterval: Duration(time.Hour),
+		Templates:      NotificationTemplates{JobWaiting: "{{.Job}} waited {{.Waited}}"},
+	}
+
+	events := []NotificationEvent{
+		{Kind: notificationInstanceStartFailed, Repository: "MyOrg/MyRepo", Action: "start", Instance: "broken-agent", Zone: "europe-west1-b", Runner: "agent1", Error: "quota exceeded"},
+		{Kind: notificationJobWaiting, Repository: "MyOrg/MyRepo", RunID: 1, Job: "compile", Waited: 20 * time.Minute},
+	}
+
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	tracker := newNotificationTracker()
+
+	sendNotifications(context.Background(), config, tracker, httpClient, events, now)
+
+	t.Run("Each webhook type gets its own payload", func(t *testing.T) {
+
+		expectedMessage := "Failed to start instance broken-agent in europe-west1-b (runner agent1) for MyOrg/MyRepo: quota exceeded"
+
+		if text := payloads["/services/slack"][0]["text"]; text != expectedMessage {
+			t.Fatalf("Slack text expected: %v, actual: %v", expectedMessage, text)
+		}
+		if text := payloads["/teams"][0]["text"]; text != expectedMessage || payloads["/teams"][0]["@type"] != "MessageCard" {
+			t.Fatalf("Teams message card with text %v expected, actual: %v", expectedMessage, payloads["/teams"][0])
+		}
+		if content := payloads["/api/webhooks/discord"][0]["content"]; content != expectedMessage {
+			t.Fatalf("Discord content expected: %v, actual: %v", expectedMessage, content)
+		}
+	})
+
+	t.Run("Configured templates replace the defaults", func(t *testing.T) {
+		if text := payloads["/services/slack"][1]["text"]; text != "compile waited 20m0s" {
+			t.Fatalf("Slack text expected: %v, actual: %v", "compile waited 20m0s", text)
+		}
+	})
+
+	t.Run("Notifications are not repeated within the repeat interval", func(t *testing.T) {
+
+		sendNotifications(context.Background(), config, tracker, httpClient, events, now.Add(30*time.Minute))
+		if len(payloads["/services/slack"]) != 2 {
+			t.Fatalf("Slack messages expected: %v, actual: %v", 2, len(payloads["/services/slack"]))
+		}
+
+		sendNotifications(context.Background(), config, tracker, httpClient, events[:1], now.Add(time.Hour))
+		if len(payloads["/services/slack"]) != 3 {
+			t.Fatalf("Slack messages expected: %v, actual: %v", 3, len(payloads["/services/slack"]))
+		}
+	})
+}
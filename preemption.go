@@ -0,0 +1,114 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+)
+
+// GCE records an operation of this type each time it preempts a Spot or preemptible instance
+const preemptedOperationType = "compute.instances.preempted"
+
+// Spot VMs, and the older preemptible VMs, can be stopped by GCE at any time
+func isInstanceSpot(instance *compute.Instance) bool {
+	return instance.Scheduling != nil && (instance.Scheduling.Preemptible || instance.Scheduling.ProvisioningModel == "SPOT")
+}
+
+func hasSpotInstances(instances []OnDemandInstance) bool {
+
+	for _, instance := range instances {
+		if instance.Spot {
+			return true
+		}
+	}
+
+	return false
+}
+
+func getInstanceKey(zone string, instanceName string) string {
+	return fmt.Sprintf("%s/%s", zone, instanceName)
+}
+
+// Counts how many times each instance has been preempted since the given time, based on the project's operation history
+// Instances are keyed by zone and name
+func getPreemptionCounts(ctx context.Context, computeService *compute.Service, project string, since time.Time) (map[string]int, error) {
+
+	preemptionCounts := make(map[string]int)
+
+	filter := fmt.Sprintf("operationType=\"%s\"", preemptedOperationType)
+
+	listCtx, call := startAPICall(ctx, apiCompute, "GlobalOperations.AggregatedList")
+	err := computeService.GlobalOperations.AggregatedList(project).Filter(filter).Pages(listCtx, func(operations *compute.OperationAggregatedList) error {
+
+		for _, scopedList := range operations.Items {
+			for _, operation := range scopedList.Operations {
+
+				insertTime, err := time.Parse(time.RFC3339, operation.InsertTime)
+				if err != nil {
+					GetLogger(ctx).Warningf("Unable to parse insert time of operation %v: %v", operation.Name, err)
+					continue
+				}
+				if insertTime.Before(since) {
+					continue
+				}
+
+				targetSegments := strings.Split(operation.TargetLink, "/")
+				instanceName := targetSegments[len(targetSegments)-1]
+				preemptionCounts[getInstanceKey(getResourceNameFromURL(operation.Zone), instanceName)]++
+			}
+		}
+
+		return nil
+	})
+	call.end(err)
+	if err != nil {
+		return nil, errors.Wrapf(err, "compute.Service.GlobalOperations.AggregatedList(%v) with filter \"%v\" failed", project, filter)
+	}
+
+	return preemptionCounts, nil
+}
+
+// Replaces Spot instances that have been preempted too often with equivalent standard instances, where available
+// Spot instances without a standard equivalent are started anyway
+func applySpotFallback(ctx context.Context, instancesToStart []OnDemandInstance, onDemandInstances []OnDemandInstance, preemptionCounts map[string]int, preemptionLimit int, preemptionWindow time.Duration) ([]OnDemandInstance, []Failover) {
+
+	var instances []OnDemandInstance
+	var failovers []Failover
+
+	for _, instance := range instancesToStart {
+
+		preemptions := preemptionCounts[getInstanceKey(instance.Zone, instance.InstanceName)]
+		if !instance.Spot || preemptions < preemptionLimit {
+			instances = append(instances, instance)
+			continue
+		}
+
+		var fallbackInstance *OnDemandInstance
+		for index, candidate := range onDemandInstances {
+			if !candidate.Spot && candidate.RunnerName == instance.RunnerName && candidate.RunnerGroup == instance.RunnerGroup && candidate.GitHubScope == instance.GitHubScope &&
+				getInstanceAction(candidate.Status, true) == instanceActionStart {
+				fallbackInstance = &onDemandInstances[index]
+				break
+			}
+		}
+
+		if fallbackInstance == nil {
+			GetLogger(ctx).WithInstance(instance).Warningf("Spot instance %v has been preempted %v times within %v, but there is no standard instance to fall back to", instance.InstanceName, preemptions, preemptionWindow)
+			instances = append(instances, instance)
+			continue
+		}
+
+		reason := fmt.Sprintf("Spot instance %v has been preempted %v times within %v", instance.InstanceName, preemptions, preemptionWindow)
+		GetLogger(ctx).WithInstance(instance).Warningf("%v; starting standard instance %v instead", reason, fallbackInstance.InstanceName)
+
+		replacementInstance := *fallbackInstance
+		instances = append(instances, replacementInstance)
+		failovers = append(failovers, Failover{FailedInstance: instance, ReplacementInstance: &replacementInstance, Reason: reason})
+	}
+
+	return instances, failovers
+}
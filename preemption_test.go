@@ -0,0 +1,106 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+func TestIsInstanceSpot(t *testing.T) {
+
+	if !isInstanceSpot(&compute.Instance{Scheduling: &compute.Scheduling{ProvisioningModel: "SPOT"}}) {
+		t.Fatal("Instance with provisioning model SPOT should be a Spot instance")
+	}
+
+	if !isInstanceSpot(&compute.Instance{Scheduling: &compute.Scheduling{Preemptible: true}}) {
+		t.Fatal("Preemptible instance should be a Spot instance")
+	}
+
+	if isInstanceSpot(&compute.Instance{Scheduling: &compute.Scheduling{ProvisioningModel: "STANDARD"}}) || isInstanceSpot(&compute.Instance{}) {
+		t.Fatal("Standard instance should not be a Spot instance")
+	}
+}
+
+func TestGetPreemptionCounts(t *testing.T) {
+
+	now := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	operationJson := func(instanceName string, insertTime time.Time) string {
+		return fmt.Sprintf(`{ "name": "operation-%s-%d", "operationType": "compute.instances.preempted", "insertTime": "%s",
+			"zone": "https://www.googleapis.com/compute/v1/projects/my-project/zones/europe-west1-b",
+			"targetLink": "https://www.googleapis.com/compute/v1/projects/my-project/zones/europe-west1-b/instances/%s" }`, instanceName, insertTime.Unix(), insertTime.Format(time.RFC3339), instanceName)
+	}
+
+	httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path != "/compute/v1/projects/my-project/aggregated/operations" || r.URL.Query().Get("filter") != `operationType="compute.instances.preempted"` {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		fmt.Fprintf(w, `{ "items": { "zones/europe-west1-b": { "operations": [ %s, %s, %s ] } } }`,
+			operationJson("spot-agent", now.Add(-10*time.Minute)),
+			operationJson("spot-agent", now.Add(-20*time.Minute)),
+			operationJson("other-agent", now.Add(-2*time.Hour)))
+	}))
+	defer teardown()
+
+	ctx := context.Background()
+
+	computeService, err := compute.NewService(ctx, option.WithHTTPClient(httpClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	preemptionCounts, err := getPreemptionCounts(ctx, computeService, "my-project", now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPreemptionCounts := map[string]int{"europe-west1-b/spot-agent": 2}
+	if !reflect.DeepEqual(expectedPreemptionCounts, preemptionCounts) {
+		t.Fatalf("Preemption counts expected: %v, actual: %v", expectedPreemptionCounts, preemptionCounts)
+	}
+}
+
+func TestApplySpotFallback(t *testing.T) {
+
+	onDemandInstances := []OnDemandInstance{
+		{InstanceName: "spot-agent", Zone: "europe-west1-b", RunnerName: "build_agent", GitHubScope: "MyOrg/MyRepo", Status: "TERMINATED", Spot: true},
+		{InstanceName: "standard-agent", Zone: "europe-west1-b", RunnerName: "build_agent", GitHubScope: "MyOrg/MyRepo", Status: "TERMINATED"},
+		{InstanceName: "other-spot-agent", Zone: "europe-west1-b", RunnerName: "cook_agent", GitHubScope: "MyOrg/MyRepo", Status: "TERMINATED", Spot: true},
+	}
+
+	instancesToStart := []OnDemandInstance{onDemandInstances[0], onDemandInstances[2]}
+
+	t.Run("Below limit", func(t *testing.T) {
+
+		instances, failovers := applySpotFallback(context.Background(), instancesToStart, onDemandInstances, map[string]int{"europe-west1-b/spot-agent": 2}, 3, time.Hour)
+
+		if !reflect.DeepEqual(instancesToStart, instances) || len(failovers) != 0 {
+			t.Fatalf("Instances should be unchanged, actual: %v, failovers: %v", instances, failovers)
+		}
+	})
+
+	t.Run("Limit reached", func(t *testing.T) {
+
+		preemptionCounts := map[string]int{"europe-west1-b/spot-agent": 3, "europe-west1-b/other-spot-agent": 5}
+
+		instances, failovers := applySpotFallback(context.Background(), instancesToStart, onDemandInstances, preemptionCounts, 3, time.Hour)
+
+		expectedInstances := []OnDemandInstance{onDemandInstances[1], onDemandInstances[2]}
+		if !reflect.DeepEqual(expectedInstances, instances) {
+			t.Fatalf("Instances to start expected: %v, actual: %v", expectedInstances, instances)
+		}
+
+		if len(failovers) != 1 || failovers[0].FailedInstance != onDemandInstances[0] || failovers[0].ReplacementInstance == nil || *failovers[0].ReplacementInstance != onDemandInstances[1] {
+			t.Fatalf("Expected a single failover from spot-agent to standard-agent, actual: %+v", failovers)
+		}
+	})
+}
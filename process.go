@@ -3,10 +3,11 @@ package watchdog
 import (
 	"context"
 	"fmt"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/go-github/v32/github"
 	"google.golang.org/api/compute/v1"
@@ -26,13 +27,14 @@ func deduplicateInstances(instances []OnDemandInstance) []OnDemandInstance {
 	return uniqueInstances
 }
 
-func deduplicateRunners(runners []string) []string {
+func deduplicateRunners(runners []RunsOn) []RunsOn {
 	runnersEncountered := make(map[string]bool)
-	var uniqueRunners []string
+	var uniqueRunners []RunsOn
 
 	for _, runner := range runners {
-		if _, exists := runnersEncountered[runner]; !exists {
-			runnersEncountered[runner] = true
+		key := fmt.Sprintf("%s/%s", runner.Group, strings.Join(runner.Labels, ","))
+		if _, exists := runnersEncountered[key]; !exists {
+			runnersEncountered[key] = true
 			uniqueRunners = append(uniqueRunners, runner)
 		}
 	}
@@ -40,19 +42,147 @@ func deduplicateRunners(runners []string) []string {
 	return uniqueRunners
 }
 
-func getRunnersRequiredByWorkflowRun(jobs []*github.WorkflowJob, jobsAndRunnersInWorkflowFile map[string]RunsOn) []string {
+// Returns the github.ref and github.ref_name of a workflow run, or "" when they cannot be known from the run
+// For pull_request events, the ref is the pull request's merge ref, and for pull_request_target it is the base branch,
+// rather than the run's head branch; these are only known when the run lists exactly one pull request
+// For release events the head branch is the release's tag; for other events it is taken to be a branch,
+// since the workflow runs API does not say whether a push was of a branch or of a tag
+func getRef(run *github.WorkflowRun) (string, string) {
+
+	switch run.GetEvent() {
+	case "pull_request":
+		if len(run.PullRequests) != 1 || run.PullRequests[0].GetNumber() == 0 {
+			return "", ""
+		}
+		refName := fmt.Sprintf("%v/merge", run.PullRequests[0].GetNumber())
+		return "refs/pull/" + refName, refName
+	case "pull_request_target":
+		if len(run.PullRequests) != 1 || run.PullRequests[0].GetBase().GetRef() == "" {
+			return "", ""
+		}
+		refName := run.PullRequests[0].GetBase().GetRef()
+		return "refs/heads/" + refName, refName
+	}
+
+	if strings.HasPrefix(run.GetEvent(), "pull_request") || run.GetHeadBranch() == "" {
+		return "", ""
+	}
+
+	if run.GetEvent() == "release" {
+		return "refs/tags/" + run.GetHeadBranch(), run.GetHeadBranch()
+	}
+	return "refs/heads/" + run.GetHeadBranch(), run.GetHeadBranch()
+}
+
+// Splits the jobs that GitHub reports as not yet completed into jobs that can run now,
+// and jobs that are waiting for the jobs they need to complete
+// Jobs whose "if:" condition is known to be false (including the implicit success() check
+// against the jobs they need) will be skipped by GitHub, and are in neither list
+func classifyJobs(run *github.WorkflowRun, jobs []*github.WorkflowJob, workflowFileJobs map[string]WorkflowFileJob) ([]string, []string) {
+
+	jobsByName := make(map[string]*github.WorkflowJob)
+	for _, job := range jobs {
+		jobsByName[*job.Name] = job
+	}
+
+	var runnableJobs []string
+	var pendingJobs []string
+
+	for _, job := range jobs {
+		if *job.Status == "completed" {
+			continue
+		}
 
-	var runnersRequired []string
+		workflowFileJob, exists := workflowFileJobs[*job.Name]
+		if !exists {
+			continue
+		}
+
+		ref, refName := getRef(run)
+		context := expressionContext{EventName: run.GetEvent(), Ref: ref, RefName: refName, NeedsCompleted: true}
+
+		for _, need := range workflowFileJob.Needs {
+			// Jobs that GitHub does not report (for example, matrix jobs) are assumed to have completed successfully
+			if neededJob, exists := jobsByName[need]; exists {
+				if *neededJob.Status != "completed" {
+					context.NeedsCompleted = false
+				} else if neededJob.Conclusion == nil || *neededJob.Conclusion != "success" {
+					context.NeedsFailed = true
+				}
+			}
+		}
+
+		if !mightJobRun(workflowFileJob.If, context) {
+			continue
+		} else if !context.NeedsCompleted {
+			pendingJobs = append(pendingJobs, *job.Name)
+		} else {
+			runnableJobs = append(runnableJobs, *job.Name)
+		}
+	}
+
+	return runnableJobs, pendingJobs
+}
+
+// Selects the pending jobs whose needed jobs are all either completed or expected to complete within preWarmLeadTime
+// The expected completion time of a job is based on how long it took during a previous run of the workflow
+func getJobsToPreWarm(pendingJobs []string, jobs []*github.WorkflowJob, workflowFileJobs map[string]WorkflowFileJob, jobDurations map[string]time.Duration, now time.Time, preWarmLeadTime time.Duration) []string {
 
+	jobsByName := make(map[string]*github.WorkflowJob)
 	for _, job := range jobs {
-		if *job.Status != "completed" {
-			if _, exists := jobsAndRunnersInWorkflowFile[*job.Name]; exists {
-				runnersRequired = append(runnersRequired, jobsAndRunnersInWorkflowFile[*job.Name]...)
+		jobsByName[*job.Name] = job
+	}
+
+	var jobsToPreWarm []string
+
+	for _, pendingJob := range pendingJobs {
+
+		closeToRunnable := true
+
+		for _, need := range workflowFileJobs[pendingJob].Needs {
+			neededJob, exists := jobsByName[need]
+			if !exists || *neededJob.Status == "completed" {
+				continue
+			}
+
+			duration, durationKnown := jobDurations[need]
+			if *neededJob.Status != "in_progress" || neededJob.StartedAt == nil || !durationKnown {
+				closeToRunnable = false
+				break
+			}
+
+			remaining := duration - now.Sub(neededJob.StartedAt.Time)
+			if remaining > preWarmLeadTime {
+				closeToRunnable = false
+				break
 			}
 		}
+
+		if closeToRunnable {
+			jobsToPreWarm = append(jobsToPreWarm, pendingJob)
+		}
+	}
+
+	return jobsToPreWarm
+}
+
+// Returns one entry per job; jobs that run on the same runners result in duplicate entries
+func getRunnersForJobs(jobNames []string, workflowFileJobs map[string]WorkflowFileJob) []RunsOn {
+
+	var runners []RunsOn
+
+	for _, jobName := range jobNames {
+		runners = append(runners, workflowFileJobs[jobName].RunsOn)
 	}
 
-	return deduplicateRunners(runnersRequired)
+	return runners
+}
+
+func getRunnersRequiredByWorkflowRun(run *github.WorkflowRun, jobs []*github.WorkflowJob, workflowFileJobs map[string]WorkflowFileJob) []RunsOn {
+
+	runnableJobs, _ := classifyJobs(run, jobs, workflowFileJobs)
+
+	return deduplicateRunners(getRunnersForJobs(runnableJobs, workflowFileJobs))
 }
 
 func getWorkflowIdFromURL(url *string) (int64, error) {
@@ -66,54 +196,181 @@ func getWorkflowIdFromURL(url *string) (int64, error) {
 	return workflowId, nil
 }
 
-func getRunnersRequired(ctx context.Context, httpClient *http.Client, gitHubClient *github.Client, gitHubOrganization string, gitHubRepository string) ([]string, error) {
+// A job that needs a runner, either now or soon; kept so that decisions to start instances can be explained
+type jobDemand struct {
+	RunID        int64
+	WorkflowPath string
+	Job          string
+	RunsOn       RunsOn
+	PreWarm      bool
 
-	activeWorkflowRuns, err := getActiveWorkflowRuns(ctx, gitHubClient, gitHubOrganization, gitHubRepository)
+	// Set for jobs that are queued, waiting for a runner
+	QueuedAt time.Time
+
+	// Set for jobs that GitHub reports as running on a runner, along with the name of that runner, if reported
+	InProgress bool
+	RunnerName string
+}
+
+func getJobDemands(runID int64, workflowPath string, jobNames []string, jobs []*github.WorkflowJob, runnerNames map[string]string, workflowFileJobs map[string]WorkflowFileJob, preWarm bool) []jobDemand {
+
+	queuedAt := make(map[string]time.Time)
+	inProgress := make(map[string]bool)
+	for _, job := range jobs {
+		// GitHub sets a job's started_at when the job is queued
+		if job.Name != nil && job.GetStatus() == "queued" && job.StartedAt != nil {
+			queuedAt[*job.Name] = job.StartedAt.Time
+		}
+		if job.Name != nil && job.GetStatus() == "in_progress" {
+			inProgress[*job.Name] = true
+		}
+	}
+
+	var demands []jobDemand
+
+	for _, jobName := range jobNames {
+		demand := jobDemand{RunID: runID, WorkflowPath: workflowPath, Job: jobName, RunsOn: workflowFileJobs[jobName].RunsOn, PreWarm: preWarm, QueuedAt: queuedAt[jobName], InProgress: inProgress[jobName]}
+		if demand.InProgress {
+			demand.RunnerName = runnerNames[jobName]
+		}
+		demands = append(demands, demand)
+	}
+
+	return demands
+}
+
+// Returns the jobs that can run now, followed by the jobs that will be able to run soon and should have their runners pre-warmed
+func getRunnersRequiredByActiveWorkflowRun(ctx context.Context, httpClient *http.Client, gitHubClient *github.Client, gitHubOrganization string, gitHubRepository string, activeWorkflowRun *github.WorkflowRun, fetchWorkflowFile workflowFileFetcher, preWarmLeadTime time.Duration) ([]jobDemand, string, error) {
+
+	workflowId, err := getWorkflowIdFromURL(activeWorkflowRun.WorkflowURL)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	var runnersRequired []string
+	workflow, err := getWorkflow(ctx, gitHubClient, gitHubOrganization, gitHubRepository, workflowId)
+	if err != nil {
+		return nil, "", err
+	}
 
-	for _, activeWorkflowRun := range activeWorkflowRuns {
+	workflowFile, err := getWorkflowFile(ctx, httpClient, gitHubOrganization, gitHubRepository, *activeWorkflowRun.HeadSHA, *workflow.Path)
+	if err != nil {
+		return nil, *workflow.Path, err
+	}
 
-		log.Printf("Workflow run id: %v\n", *activeWorkflowRun.ID)
+	workflowFileLocation := workflowLocation{Organization: gitHubOrganization, Repository: gitHubRepository, Ref: *activeWorkflowRun.HeadSHA, Path: *workflow.Path}
 
-		workflowId, err := getWorkflowIdFromURL(activeWorkflowRun.WorkflowURL)
-		if err != nil {
-			return nil, err
-		}
+	jobsAndRunnersInWorkflowFile, err := getJobsAndRunnersInWorkflowFile(workflowFile, workflowFileLocation, fetchWorkflowFile)
+	if err != nil {
+		return nil, *workflow.Path, err
+	}
 
-		workflow, err := getWorkflow(ctx, gitHubClient, gitHubOrganization, gitHubRepository, workflowId)
-		if err != nil {
-			return nil, err
-		}
+	logger := GetLogger(ctx)
+	logger.Debugf("Jobs and runners in workflow file: %v", jobsAndRunnersInWorkflowFile)
+
+	jobs, runnerNames, err := getJobsForRun(ctx, gitHubClient, gitHubOrganization, gitHubRepository, *activeWorkflowRun.ID)
+	if err != nil {
+		return nil, *workflow.Path, err
+	}
+
+	jobQueueLatencyTracker.recordJobs(getJobQueueWaits(jobs, jobsAndRunnersInWorkflowFile), time.Now())
+
+	runnableJobs, pendingJobs := classifyJobs(activeWorkflowRun, jobs, jobsAndRunnersInWorkflowFile)
+
+	logger.Infof("Runnable jobs: %v, pending jobs: %v", runnableJobs, pendingJobs)
 
-		workflowFile, err := getWorkflowFile(httpClient, gitHubOrganization, gitHubRepository, *activeWorkflowRun.HeadSHA, *workflow.Path)
+	var jobsToPreWarm []string
+	if len(pendingJobs) != 0 {
+		// Without historical durations, there is no basis for pre-warming; the pending jobs' runners will be started once they become runnable
+		jobDurations, err := getJobDurationsForWorkflow(ctx, gitHubClient, gitHubOrganization, gitHubRepository, workflowId)
 		if err != nil {
-			return nil, err
+			logger.Warningf("Unable to fetch historical job durations for workflow %v: %v", *workflow.Path, err)
+		} else {
+			jobsToPreWarm = getJobsToPreWarm(pendingJobs, jobs, jobsAndRunnersInWorkflowFile, jobDurations, time.Now(), preWarmLeadTime)
 		}
+	}
 
-		jobsAndRunnersInWorkflowFile, err := getJobsAndRunnersInWorkflowFile(workflowFile)
-		if err != nil {
-			return nil, err
+	logger.Infof("Jobs to pre-warm: %v", jobsToPreWarm)
+
+	demands := getJobDemands(*activeWorkflowRun.ID, *workflow.Path, runnableJobs, jobs, runnerNames, jobsAndRunnersInWorkflowFile, false)
+	demands = append(demands, getJobDemands(*activeWorkflowRun.ID, *workflow.Path, jobsToPreWarm, jobs, runnerNames, jobsAndRunnersInWorkflowFile, true)...)
+
+	return demands, *workflow.Path, nil
+}
+
+// Describes the runners needed by the active workflow runs of a repository
+type runnerRequirements struct {
+	Required []RunsOn
+	PreWarm  []RunsOn
+
+	// One entry per job that can run now or is being pre-warmed for; pools of identical instances are sized based on this
+	Jobs []RunsOn
+
+	// The jobs behind the runners above
+	Demands []jobDemand
+
+	Warnings []Warning
+}
+
+func newRunnerRequirements(demands []jobDemand, warnings []Warning) *runnerRequirements {
+
+	requirements := &runnerRequirements{Demands: demands, Warnings: warnings}
+
+	for _, demand := range demands {
+		if demand.PreWarm {
+			requirements.PreWarm = append(requirements.PreWarm, demand.RunsOn)
+		} else {
+			requirements.Required = append(requirements.Required, demand.RunsOn)
 		}
+		requirements.Jobs = append(requirements.Jobs, demand.RunsOn)
+	}
+
+	requirements.Required = deduplicateRunners(requirements.Required)
+	requirements.PreWarm = deduplicateRunners(requirements.PreWarm)
+
+	return requirements
+}
+
+// Failure to process an individual workflow run does not abort the entire operation;
+// the failure is instead recorded as a warning, and the list of runners required is then incomplete
+func getRunnersRequired(ctx context.Context, httpClient *http.Client, gitHubClient *github.Client, gitHubOrganization string, gitHubRepository string, preWarmLeadTime time.Duration) (*runnerRequirements, error) {
+
+	activeWorkflowRuns, err := getActiveWorkflowRuns(ctx, gitHubClient, gitHubOrganization, gitHubRepository)
+	if err != nil {
+		return nil, err
+	}
+
+	var demands []jobDemand
+	var warnings []Warning
+
+	for _, activeWorkflowRun := range activeWorkflowRuns {
 
-		log.Printf("jobs and runners in workflow file: %v\n", jobsAndRunnersInWorkflowFile)
+		runLogger := GetLogger(ctx).With(logFieldRunID, *activeWorkflowRun.ID)
+		runLogger.Debugf("Processing workflow run %v", *activeWorkflowRun.ID)
 
-		jobs, err := getJobsForRun(ctx, gitHubClient, gitHubOrganization, gitHubRepository, *activeWorkflowRun.ID)
+		runCtx, runSpan := startSpan(WithLogger(ctx, runLogger), "WorkflowRun", attributeRepository.String(gitHubOrganization+"/"+gitHubRepository), attributeRunID.Int64(*activeWorkflowRun.ID))
+		fetchWorkflowFile := func(location workflowLocation) (string, error) {
+			return getWorkflowFile(runCtx, httpClient, location.Organization, location.Repository, location.Ref, location.Path)
+		}
+
+		runDemands, workflowPath, err := getRunnersRequiredByActiveWorkflowRun(runCtx, httpClient, gitHubClient, gitHubOrganization, gitHubRepository, activeWorkflowRun, fetchWorkflowFile, preWarmLeadTime)
+		if workflowPath != "" {
+			runSpan.SetAttributes(attributeWorkflowPath.String(workflowPath))
+		}
+		endSpan(runSpan, err)
 		if err != nil {
-			return nil, err
+			runLogger.With(logFieldWorkflowPath, workflowPath).Warningf("Unable to determine runners required by workflow run %v: %v", *activeWorkflowRun.ID, err)
+			warnings = append(warnings, Warning{RunID: *activeWorkflowRun.ID, WorkflowPath: workflowPath, Message: err.Error()})
+			continue
 		}
 
-		runnersRequired = append(runnersRequired, getRunnersRequiredByWorkflowRun(jobs, jobsAndRunnersInWorkflowFile)...)
+		demands = append(demands, runDemands...)
 	}
 
-	return deduplicateRunners(runnersRequired), nil
+	return newRunnerRequirements(demands, warnings), nil
 }
 
-func getOnDemandInstancesForRepository(computeService *compute.Service, project string, zone string, gitHubOrganization string, gitHubRepository string) ([]OnDemandInstance, error) {
-	onDemandInstances, err := getOnDemandInstances(computeService, project, zone)
+func getOnDemandInstancesForRepository(ctx context.Context, computeService *compute.Service, config Config, gitHubOrganization string, gitHubRepository string) ([]OnDemandInstance, error) {
+	onDemandInstances, err := getOnDemandInstances(ctx, computeService, config.Project, config.Zones, config.InstanceFilter)
 	if err != nil {
 		return nil, err
 	}
@@ -122,8 +379,12 @@ func getOnDemandInstancesForRepository(computeService *compute.Service, project
 
 	expectedScope := fmt.Sprintf("%s/%s", gitHubOrganization, gitHubRepository)
 
+	// GitHub organization and repository names are case-insensitive
 	for _, instance := range onDemandInstances {
-		if instance.GitHubScope == expectedScope {
+		if strings.EqualFold(instance.GitHubScope, expectedScope) {
+			if instance.StopMode == "" {
+				instance.StopMode = config.stopModeForRunner(instance.RunnerName)
+			}
 			onDemandInstancesForRepository = append(onDemandInstancesForRepository, instance)
 		}
 	}
@@ -131,76 +392,420 @@ func getOnDemandInstancesForRepository(computeService *compute.Service, project
 	return onDemandInstancesForRepository, nil
 }
 
-func getInstancesToStart(runnersRequired []string, onDemandInstances []OnDemandInstance) []OnDemandInstance {
+func isInstanceRequired(runnersRequired []RunsOn, onDemandInstance OnDemandInstance) bool {
+
+	for _, runnerRequired := range runnersRequired {
+		if runnerRequired.MatchesRunner(onDemandInstance.RunnerName, onDemandInstance.RunnerGroup) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the instances that need to be started (or resumed) for the jobs that need runners; there is one entry per job
+// At most one instance is started per runner, and none if an instance for the runner is already awake
+// A job that only names a runner group can run on any instance in the group, so one instance is started per such job,
+// counting the group's instances that are already awake but not needed for jobs that name their runner
+func getInstancesToStart(jobRunners []RunsOn, onDemandInstances []OnDemandInstance) []OnDemandInstance {
+
+	runnersAwake := make(map[string]bool)
+	for _, onDemandInstance := range onDemandInstances {
+		if isInstanceAwake(onDemandInstance.Status) {
+			runnersAwake[onDemandInstance.RunnerName] = true
+		}
+	}
+
+	var runnersRequired []RunsOn
+	groupJobs := make(map[string]int)
+	for _, runsOn := range jobRunners {
+		if runsOn.matchesAnyRunnerInGroup() {
+			groupJobs[runsOn.Group]++
+		} else {
+			runnersRequired = append(runnersRequired, runsOn)
+		}
+	}
 
 	var instancesToStart []OnDemandInstance
-	onDemandInstancesMap := make(map[string]OnDemandInstance)
 
 	for _, onDemandInstance := range onDemandInstances {
-		onDemandInstancesMap[onDemandInstance.RunnerName] = onDemandInstance
+		if runnersAwake[onDemandInstance.RunnerName] {
+			continue
+		}
+		if getInstanceAction(onDemandInstance.Status, isInstanceRequired(runnersRequired, onDemandInstance)) == instanceActionStart {
+			instancesToStart = append(instancesToStart, onDemandInstance)
+		}
 	}
 
-	for _, runnerRequired := range runnersRequired {
-		if onDemandInstance, exists := onDemandInstancesMap[runnerRequired]; exists {
-			if onDemandInstance.Status == "TERMINATED" {
-				instancesToStart = append(instancesToStart, onDemandInstance)
-			}
+	instancesToStart = deduplicateInstances(instancesToStart)
+
+	if len(groupJobs) == 0 {
+		return instancesToStart
+	}
+
+	starting := make(map[string]bool)
+	for _, onDemandInstance := range instancesToStart {
+		starting[onDemandInstance.RunnerName] = true
+	}
+	groupInstances := make(map[string]int)
+	for _, onDemandInstance := range onDemandInstances {
+		if isInstanceAwake(onDemandInstance.Status) && !isInstanceRequired(runnersRequired, onDemandInstance) {
+			groupInstances[onDemandInstance.RunnerGroup]++
+		}
+	}
+
+	for _, onDemandInstance := range onDemandInstances {
+		group := onDemandInstance.RunnerGroup
+		if group == "" || groupInstances[group] >= groupJobs[group] || runnersAwake[onDemandInstance.RunnerName] || starting[onDemandInstance.RunnerName] {
+			continue
+		}
+		if getInstanceAction(onDemandInstance.Status, true) == instanceActionStart {
+			instancesToStart = append(instancesToStart, onDemandInstance)
+			starting[onDemandInstance.RunnerName] = true
+			groupInstances[group]++
 		}
 	}
 
-	return deduplicateInstances(instancesToStart)
+	return instancesToStart
 }
 
-func getInstancesToStop(runnersRequired []string, onDemandInstances []OnDemandInstance) []OnDemandInstance {
+// Returns the instances that are no longer needed, leaving enough awake to satisfy the pools' scheduled minimums
+func getInstancesToStop(runnersRequired []RunsOn, onDemandInstances []OnDemandInstance, minimums []scheduledMinimum) []OnDemandInstance {
 
 	var instancesToStop []OnDemandInstance
-	runnersRequiredMap := make(map[string]string)
 
-	for _, runner := range runnersRequired {
-		runnersRequiredMap[runner] = runner
+	for _, onDemandInstance := range onDemandInstances {
+		if getInstanceAction(onDemandInstance.Status, isInstanceRequired(runnersRequired, onDemandInstance)) == instanceActionStop {
+			instancesToStop = append(instancesToStop, onDemandInstance)
+		}
 	}
 
-	for _, onDemandInstance := range onDemandInstances {
-		if _, exists := runnersRequiredMap[onDemandInstance.RunnerName]; !exists {
-			if onDemandInstance.Status == "RUNNING" {
-				instancesToStop = append(instancesToStop, onDemandInstance)
-			}
+	return applyScheduledMinimums(minimums, onDemandInstances, deduplicateInstances(instancesToStop))
+}
+
+// Remembers since when each running instance has been idle, across invocations
+// Instances are keyed by zone and name, since equivalent instances in different zones can share a name
+type idleTracker struct {
+	mutex     sync.Mutex
+	idleSince map[string]time.Time
+}
+
+var instanceIdleTracker = &idleTracker{idleSince: make(map[string]time.Time)}
+
+// Returns since when each of the idle instances has been idle, without recording anything
+func (tracker *idleTracker) getIdleSince(idleInstances []OnDemandInstance, now time.Time) map[string]time.Time {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	idleSince := make(map[string]time.Time)
+
+	for _, instance := range idleInstances {
+		key := getInstanceKey(instance.Zone, instance.InstanceName)
+		if since, exists := tracker.idleSince[key]; exists {
+			idleSince[key] = since
+		} else {
+			idleSince[key] = now
 		}
 	}
 
-	return deduplicateInstances(instancesToStop)
+	return idleSince
 }
 
-func Process(ctx context.Context, computeService *compute.Service, httpClient *http.Client, gitHubClient *github.Client, project string, zone string, gitHubOrganization string, gitHubRepository string) ([]string, []OnDemandInstance, []OnDemandInstance, []OnDemandInstance, error) {
+// Records which of the given instances are currently idle
+func (tracker *idleTracker) update(onDemandInstances []OnDemandInstance, idleInstances []OnDemandInstance, now time.Time) {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	idle := make(map[string]bool)
+	for _, instance := range idleInstances {
+		idle[getInstanceKey(instance.Zone, instance.InstanceName)] = true
+	}
+
+	for _, instance := range onDemandInstances {
+		key := getInstanceKey(instance.Zone, instance.InstanceName)
+		if !idle[key] {
+			delete(tracker.idleSince, key)
+			continue
+		}
+
+		if _, exists := tracker.idleSince[key]; !exists {
+			tracker.idleSince[key] = now
+		}
+	}
+}
+
+// What Plan observed about the instances of a repository
+// Process records this in the trackers that carry state across invocations; Plan does not,
+// so that dry runs do not change what later reconcile cycles decide
+type planObservations struct {
+	now                 time.Time
+	repository          string
+	demands             []jobDemand
+	onDemandInstances   []OnDemandInstance
+	individualInstances []OnDemandInstance
+	idleInstances       []OnDemandInstance
+}
+
+func (observations planObservations) record(config Config) {
+
+	instanceCostTracker.update(config, observations.individualInstances, observations.now)
+	instanceIdleTracker.update(observations.individualInstances, observations.idleInstances, observations.now)
+	instanceTransitionTracker.update(observations.onDemandInstances, observations.now)
+	instanceAwakeTracker.update(observations.individualInstances, observations.now)
+	staleJobs.forgetInactive(observations.repository, observations.demands)
+}
+
+// Removes instances that have not yet been idle for their pool's grace period
+func applyIdleGracePeriods(ctx context.Context, config Config, idleInstances []OnDemandInstance, idleSince map[string]time.Time, now time.Time) []OnDemandInstance {
+
+	var instancesToStop []OnDemandInstance
+
+	for _, instance := range idleInstances {
+		gracePeriod := config.idleGracePeriodForRunner(instance.RunnerName)
+		if since, exists := idleSince[getInstanceKey(instance.Zone, instance.InstanceName)]; exists && now.Sub(since) < gracePeriod {
+			GetLogger(ctx).WithInstance(instance).Infof("Instance %v has been idle for %v, which is less than its grace period of %v; it will not be stopped yet", instance.InstanceName, now.Sub(since), gracePeriod)
+			continue
+		}
+		instancesToStop = append(instancesToStop, instance)
+	}
+
+	return instancesToStop
+}
+
+// Determines which instances should be started and stopped, without starting or stopping anything
+// The returned result's StartedInstances and StoppedInstances list the instances that Process would start and stop
+func Plan(ctx context.Context, computeService *compute.Service, httpClient *http.Client, gitHubClient *github.Client, config Config, repository RepositoryConfig) (result *Result, err error) {
+
+	ctx, span := startSpan(ctx, "Plan", attributeRepository.String(repository.String()))
+	defer func() { endSpan(span, err) }()
+
+	logger := GetLogger(ctx).With(logFieldRepository, repository.String())
+	ctx = WithLogger(ctx, logger)
+
+	requirements, err := getRunnersRequired(ctx, httpClient, gitHubClient, repository.Organization, repository.Repository, time.Duration(config.Policies.PreWarmLeadTime))
+	if err != nil {
+		return nil, err
+	}
+
+	// Jobs that kept an instance running beyond its pool's max-runtime no longer require runners
+	activeDemands := requirements.Demands
+	if demands, staleDemands := staleJobs.exclude(repository.String(), requirements.Demands); len(staleDemands) != 0 {
+		for _, demand := range staleDemands {
+			logger.With(logFieldRunID, demand.RunID).Infof("Ignoring job %v of workflow run %v, which has been flagged as stale", demand.Job, demand.RunID)
+		}
+		requirements = newRunnerRequirements(demands, requirements.Warnings)
+	}
+
+	runnersRequired, runnersToPreWarm, warnings := requirements.Required, requirements.PreWarm, requirements.Warnings
+
+	logger.Infof("Runners required: %v", runnersRequired)
+	logger.Infof("Runners to pre-warm: %v", runnersToPreWarm)
 
-	runnersRequired, err := getRunnersRequired(ctx, httpClient, gitHubClient, gitHubOrganization, gitHubRepository)
+	// Pre-warmed runners are started and kept running just like runners that are required right now
+	runnersNeeded := deduplicateRunners(append(append([]RunsOn{}, runnersRequired...), runnersToPreWarm...))
+
+	onDemandInstances, err := getOnDemandInstancesForRepository(ctx, computeService, config, repository.Organization, repository.Repository)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, err
+	}
+
+	logger.Infof("On-demand instances available in GCE project %v zones %v: %v", config.Project, config.Zones, getInstanceNames(onDemandInstances))
+
+	// Instances in Managed Instance Group pools are created and deleted by resizing their instance group instead
+	var individualInstances []OnDemandInstance
+	for _, instance := range onDemandInstances {
+		if !config.isRunnerInManagedInstanceGroup(instance.RunnerName) {
+			individualInstances = append(individualInstances, instance)
+		}
+	}
+
+	instancesToStart := getInstancesToStart(requirements.Jobs, individualInstances)
+
+	// Pools with an active schedule keep a minimum number of instances awake, whether or not any job needs them
+	now := time.Now()
+	scheduledMinimums := config.getScheduledMinimums(now)
+	instancesToKeepWarm := getInstancesToKeepWarm(scheduledMinimums, individualInstances, instancesToStart)
+	if len(instancesToKeepWarm) != 0 {
+		logger.Infof("Instances to start for scheduled minimums: %v", getInstanceNames(instancesToKeepWarm))
+		instancesToStart = append(instancesToStart, instancesToKeepWarm...)
+	}
+
+	var spotFailovers []Failover
+	if config.Policies.SpotPreemptionLimit > 0 && hasSpotInstances(instancesToStart) {
+		preemptionWindow := time.Duration(config.Policies.SpotPreemptionWindow)
+		preemptionCounts, err := getPreemptionCounts(ctx, computeService, config.Project, time.Now().Add(-preemptionWindow))
+		if err != nil {
+			return nil, err
+		}
+		instancesToStart, spotFailovers = applySpotFallback(ctx, instancesToStart, individualInstances, preemptionCounts, config.Policies.SpotPreemptionLimit, preemptionWindow)
+	}
+
+	// Pools that have used up their monthly budget do not get any more instances started
+	poolSpend := instanceCostTracker.withUpdate(config, individualInstances, now).getPoolSpend(config, now)
+	instancesToStart, budgetRefusals := applyBudgets(ctx, config, repository.String(), instancesToStart, poolSpend)
+
+	logger.Infof("Instances to start: %v", getInstanceNames(instancesToStart))
+
+	idleInstances := getInstancesToStop(runnersNeeded, individualInstances, scheduledMinimums)
+	idleSince := instanceIdleTracker.getIdleSince(idleInstances, now)
+
+	// When some workflow runs could not be processed, the list of runners required is incomplete;
+	// stopping instances based on it could interrupt jobs, so by default leave all running instances alone
+	var instancesToStop []OnDemandInstance
+	if len(warnings) == 0 || config.Policies.StopOnIncompleteRequirements {
+		instancesToStop = applyIdleGracePeriods(ctx, config, idleInstances, idleSince, now)
+	} else {
+		logger.Warningf("Requirements are incomplete due to %v warning(s); no instances will be stopped", len(warnings))
+	}
+
+	// A job that GitHub reports as in progress forever would otherwise keep its instance running indefinitely
+	runningSince := instanceAwakeTracker.getRunningSince(individualInstances, now)
+	stopping := make(map[string]bool)
+	for _, instance := range instancesToStop {
+		stopping[getInstanceKey(instance.Zone, instance.InstanceName)] = true
+	}
+	runaway := make(map[string]bool)
+	var staleRuns []StaleRun
+	runawayInstances := getRunawayInstances(config, individualInstances, runningSince, now)
+	for _, instance := range runawayInstances {
+		key := getInstanceKey(instance.Zone, instance.InstanceName)
+		runaway[key] = true
+		logger.WithInstance(instance).Warningf("Instance %v has been running since %v, which exceeds its pool's max-runtime; it will be stopped", instance.InstanceName, runningSince[key].UTC().Format(time.RFC3339))
+
+		staleRuns = append(staleRuns, getStaleRuns(instance, onDemandInstances, requirements.Demands, runningSince[key])...)
+		if !stopping[key] {
+			instancesToStop = append(instancesToStop, instance)
+		}
 	}
 
-	log.Printf("Runners required for GitHub repo %v/%v: %v\n", gitHubOrganization, gitHubRepository, runnersRequired)
+	logger.Infof("Instances to stop: %v", getInstanceNames(instancesToStop))
+
+	// An instance can be running while its runner failed to register; jobs then stay queued although the instance is up
+	var unhealthyInstances []UnhealthyInstance
+	if gracePeriod := time.Duration(config.Policies.RunnerBootGracePeriod); gracePeriod > 0 {
+		var instancesToKeep []OnDemandInstance
+		for _, instance := range individualInstances {
+			if key := getInstanceKey(instance.Zone, instance.InstanceName); !stopping[key] && !runaway[key] {
+				instancesToKeep = append(instancesToKeep, instance)
+			}
+		}
+
+		if unhealthyInstances, err = findUnhealthyInstances(ctx, computeService, gitHubClient, config, repository, instancesToKeep, onDemandInstances, runningSince, now); err != nil {
+			logger.Warningf("Unable to check whether runners are online: %v", err)
+		}
 
-	onDemandInstances, err := getOnDemandInstancesForRepository(computeService, project, zone, gitHubOrganization, gitHubRepository)
+		for _, unhealthyInstance := range unhealthyInstances {
+			logger.WithInstance(unhealthyInstance.OnDemandInstance).Warningf("Instance %v is running, but its runner is %v in GitHub", unhealthyInstance.InstanceName, unhealthyInstance.RunnerStatus)
+		}
+	}
+
+	var auditEvents []AuditEvent
+	keptWarm := make(map[string]bool)
+	for _, instance := range instancesToKeepWarm {
+		keptWarm[getInstanceKey(instance.Zone, instance.InstanceName)] = true
+	}
+	for _, instance := range instancesToStart {
+		reason := getStartReason(instance, requirements.Demands, spotFailovers)
+		if keptWarm[getInstanceKey(instance.Zone, instance.InstanceName)] {
+			reason = getKeepWarmReason(instance, scheduledMinimums)
+		}
+		auditEvents = append(auditEvents, newAuditEvent(ctx, repository.String(), getStartOperationName(instance), instance, reason))
+	}
+	auditEvents = append(auditEvents, budgetRefusals...)
+	for _, instance := range instancesToStop {
+		reason := getStopReason(instance, idleSince, config.idleGracePeriodForRunner(instance.RunnerName))
+		if key := getInstanceKey(instance.Zone, instance.InstanceName); runaway[key] {
+			reason = getMaxRuntimeReason(config, instance, runningSince[key])
+		}
+		auditEvents = append(auditEvents, newAuditEvent(ctx, repository.String(), getStopOperationName(instance), instance, reason))
+	}
+
+	for _, unhealthyInstance := range unhealthyInstances {
+		if unhealthyInstance.Action != UnhealthyRunnerActionReport {
+			auditEvents = append(auditEvents, newAuditEvent(ctx, repository.String(), unhealthyInstance.Action, unhealthyInstance.OnDemandInstance, getUnhealthyRunnerReason(unhealthyInstance, time.Duration(config.Policies.RunnerBootGracePeriod))))
+		}
+	}
+
+	stuckInstances := instanceTransitionTracker.getStuckInstances(onDemandInstances, now, time.Duration(config.Policies.StuckInstanceThreshold))
+	for _, stuckInstance := range stuckInstances {
+		logger.WithInstance(stuckInstance.OnDemandInstance).Warningf("Instance %v has been %v since %v", stuckInstance.InstanceName, stuckInstance.Status, stuckInstance.StatusSince)
+	}
+
+	return &Result{RunnersRequired: runnersRequired, RunnersPreWarmed: runnersToPreWarm, OnDemandInstances: onDemandInstances, StartedInstances: instancesToStart, StoppedInstances: instancesToStop, Failovers: spotFailovers, StuckInstances: stuckInstances, UnhealthyInstances: unhealthyInstances, StaleRuns: staleRuns, AuditEvents: auditEvents, Warnings: warnings, jobRunners: requirements.Jobs, jobDemands: requirements.Demands, runawayInstances: runawayInstances, observations: planObservations{now: now, repository: repository.String(), demands: activeDemands, onDemandInstances: onDemandInstances, individualInstances: individualInstances, idleInstances: idleInstances}}, nil
+}
+
+func Process(ctx context.Context, computeService *compute.Service, httpClient *http.Client, gitHubClient *github.Client, config Config, repository RepositoryConfig) (result *Result, err error) {
+
+	ctx, span := startSpan(ctx, "Process", attributeRepository.String(repository.String()))
+	defer func() { endSpan(span, err) }()
+
+	ctx = WithLogger(ctx, GetLogger(ctx).With(logFieldRepository, repository.String()))
+
+	result, err = Plan(ctx, computeService, httpClient, gitHubClient, config, repository)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, err
 	}
 
-	log.Printf("On-demand instances available in GCE project %v zone %v: %v\n", project, zone, onDemandInstances)
+	result.observations.record(config)
+
+	// Stopping an instance whose runner is busy interrupts a job, so such instances are left running,
+	// unless they have exceeded their pool's max-runtime
+	// When GitHub cannot be asked, the instances are stopped as planned
+	var skippedStops, forcedStops []OnDemandInstance
+	if len(result.StoppedInstances) != 0 {
+		if runners, err := getSelfHostedRunnersForRepositories(ctx, gitHubClient, []RepositoryConfig{repository}, usesOrganizationRunners(config, result.StoppedInstances)); err != nil {
+			GetLogger(ctx).Warningf("Unable to determine whether instances to stop are busy; they will be stopped regardless: %v", err)
+		} else {
+			busyInstances := getBusyInstances(result.StoppedInstances, result.OnDemandInstances, runners)
+			result.StoppedInstances, skippedStops, forcedStops = skipBusyInstances(result.StoppedInstances, busyInstances, result.runawayInstances)
+			for _, instance := range skippedStops {
+				GetLogger(ctx).WithInstance(instance).Warningf("Instance %v is idle according to its jobs, but GitHub reports its runner as busy; it will not be stopped", instance.InstanceName)
+			}
+		}
+	}
 
-	instancesToStart := getInstancesToStart(runnersRequired, onDemandInstances)
+	// Audit events are written, and notifications sent, even when carrying out the plan fails part-way
+	jobDemands, onDemandInstances := result.jobDemands, result.OnDemandInstances
+	trail := newAuditTrail(result.AuditEvents)
+	ctx = withAuditTrail(ctx, trail)
+	defer func() {
+		auditEvents := trail.finish(err)
+		writeAuditEvents(ctx, config.Audit, auditEvents)
+		instanceCostTracker.recordAuditEvents(config, onDemandInstances, auditEvents)
+
+		now := time.Now()
+		notificationEvents := getNotificationEvents(repository.String(), auditEvents, jobDemands, skippedStops, forcedStops, time.Duration(config.Notifications.JobWaitThreshold), now)
+		sendNotifications(ctx, config.Notifications, sentNotificationTracker, notificationHTTPClient, notificationEvents, now)
+
+		if result != nil {
+			result.AuditEvents = auditEvents
+		}
+	}()
 
-	log.Printf("Instances to start: %v\n", instancesToStart)
+	startedInstances, failovers, err := startInstancesWithFailover(ctx, computeService, config.Project, result.StartedInstances, result.OnDemandInstances)
+	result.StartedInstances = startedInstances
+	result.Failovers = append(result.Failovers, failovers...)
+	jobQueueLatencyTracker.recordInstanceStarts(startedInstances, time.Now())
+	if err != nil {
+		return nil, err
+	}
 
-	instancesToStop := getInstancesToStop(runnersRequired, onDemandInstances)
-	log.Printf("Instances to stop: %v\n", instancesToStop)
+	if err := stopInstances(ctx, computeService, config.Project, result.StoppedInstances); err != nil {
+		return nil, err
+	}
 
-	if err := startInstances(computeService, project, zone, instancesToStart); err != nil {
-		return nil, nil, nil, nil, err
+	staleJobs.flag(repository.String(), result.StaleRuns)
+	if config.Policies.CancelStaleRuns && len(result.StaleRuns) != 0 {
+		result.StaleRuns = cancelStaleRuns(ctx, gitHubClient, repository, result.StaleRuns)
 	}
 
-	if err := stopInstances(computeService, project, zone, instancesToStop); err != nil {
-		return nil, nil, nil, nil, err
+	completePendingRestarts(ctx, computeService, config.Project, result.OnDemandInstances, result.StartedInstances)
+
+	if err := recoverUnhealthyInstances(ctx, computeService, config.Project, result.UnhealthyInstances); err != nil {
+		return nil, err
 	}
 
-	return runnersRequired, onDemandInstances, instancesToStart, instancesToStop, nil
+	return result, nil
 }
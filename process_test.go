@@ -1,8 +1,12 @@
 package watchdog
 
 import (
+	"context"
+	"fmt"
+	"net/http"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/google/go-github/v32/github"
 )
@@ -12,6 +16,7 @@ func TestGetRunnersRequiredByWorkflowRun(t *testing.T) {
 	job1Name := "job1"
 	job2Name := "job2"
 	job3Name := "job3"
+	job4Name := "job4"
 	queuedStatus := "queued"
 	inProgressStatus := "in_progress"
 	completedStatus := "completed"
@@ -20,18 +25,273 @@ func TestGetRunnersRequiredByWorkflowRun(t *testing.T) {
 		{Name: &job1Name, Status: &queuedStatus},
 		{Name: &job2Name, Status: &inProgressStatus},
 		{Name: &job3Name, Status: &completedStatus},
+		{Name: &job4Name, Status: &queuedStatus},
 	}
 
-	jobsAndRunnersInWorkflowFile := map[string]RunsOn{
-		"job1": {"runner1", "runner3"},
-		"job2": {"runner2", "runner3"},
-		"job3": {"runner2", "runner4"},
+	jobsAndRunnersInWorkflowFile := map[string]WorkflowFileJob{
+		"job1": {RunsOn: RunsOn{Labels: []string{"runner1", "runner3"}}},
+		"job2": {RunsOn: RunsOn{Labels: []string{"runner2", "runner3"}}},
+		"job3": {RunsOn: RunsOn{Labels: []string{"runner2", "runner4"}}},
+		"job4": {RunsOn: RunsOn{Labels: []string{"runner1", "runner3"}}},
 	}
 
-	runnersRequired := getRunnersRequiredByWorkflowRun(jobs, jobsAndRunnersInWorkflowFile)
+	pushEvent := "push"
+	run := &github.WorkflowRun{Event: &pushEvent}
 
-	expectedRunnersRequired := []string{"runner1", "runner3", "runner2"}
+	runnersRequired := getRunnersRequiredByWorkflowRun(run, jobs, jobsAndRunnersInWorkflowFile)
+
+	expectedRunnersRequired := []RunsOn{{Labels: []string{"runner1", "runner3"}}, {Labels: []string{"runner2", "runner3"}}}
+	if !reflect.DeepEqual(expectedRunnersRequired, runnersRequired) {
+		t.Fatalf("Runners required diff. Expected: %v, actual: %v", expectedRunnersRequired, runnersRequired)
+	}
+}
+
+func TestClassifyJobsAndGetJobsToPreWarm(t *testing.T) {
+
+	queuedStatus := "queued"
+	inProgressStatus := "in_progress"
+	completedStatus := "completed"
+	successConclusion := "success"
+	failureConclusion := "failure"
+
+	now := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+	startedRecently := &github.Timestamp{Time: now.Add(-2 * time.Minute)}
+	startedLongAgo := &github.Timestamp{Time: now.Add(-28 * time.Minute)}
+
+	name := func(name string) *string { return &name }
+
+	jobs := []*github.WorkflowJob{
+		{Name: name("setup"), Status: &completedStatus, Conclusion: &successConclusion},
+		{Name: name("lint"), Status: &completedStatus, Conclusion: &failureConclusion},
+		{Name: name("build-win64"), Status: &inProgressStatus, StartedAt: startedLongAgo},
+		{Name: name("build-linux"), Status: &inProgressStatus, StartedAt: startedRecently},
+		{Name: name("package-win64"), Status: &queuedStatus},
+		{Name: name("package-linux"), Status: &queuedStatus},
+		{Name: name("publish"), Status: &queuedStatus},
+		{Name: name("report-lint"), Status: &queuedStatus},
+		{Name: name("report-lint-failure"), Status: &queuedStatus},
+		{Name: name("release-notes"), Status: &queuedStatus},
+	}
+
+	workflowFileJobs := map[string]WorkflowFileJob{
+		"setup":               {RunsOn: RunsOn{Labels: []string{"ubuntu-latest"}}},
+		"lint":                {RunsOn: RunsOn{Labels: []string{"ubuntu-latest"}}},
+		"build-win64":         {RunsOn: RunsOn{Labels: []string{"build_agent_win64"}}, Needs: []string{"setup"}},
+		"build-linux":         {RunsOn: RunsOn{Labels: []string{"build_agent_linux"}}, Needs: []string{"setup"}},
+		"package-win64":       {RunsOn: RunsOn{Labels: []string{"package_agent_win64"}}, Needs: []string{"build-win64"}},
+		"package-linux":       {RunsOn: RunsOn{Labels: []string{"package_agent_linux"}}, Needs: []string{"build-linux"}},
+		"publish":             {RunsOn: RunsOn{Labels: []string{"publish_agent"}}, Needs: []string{"package-win64", "package-linux"}},
+		"report-lint":         {RunsOn: RunsOn{Labels: []string{"ubuntu-latest"}}, Needs: []string{"lint"}},
+		"report-lint-failure": {RunsOn: RunsOn{Labels: []string{"ubuntu-latest"}}, Needs: []string{"lint"}, If: "${{ failure() }}"},
+		"release-notes":       {RunsOn: RunsOn{Labels: []string{"ubuntu-latest"}}, If: "github.event_name == 'release'"},
+	}
+
+	pushEvent := "push"
+	run := &github.WorkflowRun{Event: &pushEvent}
+
+	runnableJobs, pendingJobs := classifyJobs(run, jobs, workflowFileJobs)
+
+	expectedRunnableJobs := []string{"build-win64", "build-linux", "report-lint-failure"}
+	if !reflect.DeepEqual(expectedRunnableJobs, runnableJobs) {
+		t.Fatalf("Runnable jobs diff. Expected: %v, actual: %v", expectedRunnableJobs, runnableJobs)
+	}
+
+	expectedPendingJobs := []string{"package-win64", "package-linux", "publish"}
+	if !reflect.DeepEqual(expectedPendingJobs, pendingJobs) {
+		t.Fatalf("Pending jobs diff. Expected: %v, actual: %v", expectedPendingJobs, pendingJobs)
+	}
+
+	jobDurations := map[string]time.Duration{
+		"build-win64": 30 * time.Minute,
+		"build-linux": 30 * time.Minute,
+	}
+
+	jobsToPreWarm := getJobsToPreWarm(pendingJobs, jobs, workflowFileJobs, jobDurations, now, 5*time.Minute)
+
+	expectedJobsToPreWarm := []string{"package-win64"}
+	if !reflect.DeepEqual(expectedJobsToPreWarm, jobsToPreWarm) {
+		t.Fatalf("Jobs to pre-warm diff. Expected: %v, actual: %v", expectedJobsToPreWarm, jobsToPreWarm)
+	}
+}
+
+func TestClassifyJobsForPullRequest(t *testing.T) {
+
+	queuedStatus := "queued"
+	name := func(name string) *string { return &name }
+
+	jobs := []*github.WorkflowJob{
+		{Name: name("build"), Status: &queuedStatus},
+		{Name: name("deploy"), Status: &queuedStatus},
+	}
+
+	workflowFileJobs := map[string]WorkflowFileJob{
+		"build":  {RunsOn: RunsOn{Labels: []string{"build_agent"}}, If: "github.ref_name != 'feature'"},
+		"deploy": {RunsOn: RunsOn{Labels: []string{"deploy_agent"}}, If: "github.event_name == 'push'"},
+	}
+
+	// The ref_name of a pull request run is "<pr number>/merge", not the head branch, so the build job's condition cannot be evaluated
+	pullRequestEvent := "pull_request"
+	headBranch := "feature"
+	run := &github.WorkflowRun{Event: &pullRequestEvent, HeadBranch: &headBranch}
+
+	runnableJobs, _ := classifyJobs(run, jobs, workflowFileJobs)
+
+	expectedRunnableJobs := []string{"build"}
+	if !reflect.DeepEqual(expectedRunnableJobs, runnableJobs) {
+		t.Fatalf("Runnable jobs diff. Expected: %v, actual: %v", expectedRunnableJobs, runnableJobs)
+	}
+
+	t.Run("The merge ref is known when the run lists its pull request", func(t *testing.T) {
+
+		workflowFileJobs := map[string]WorkflowFileJob{
+			"build":  {RunsOn: RunsOn{Labels: []string{"build_agent"}}, If: "github.ref == 'refs/pull/42/merge'"},
+			"deploy": {RunsOn: RunsOn{Labels: []string{"deploy_agent"}}, If: "github.ref_name == 'feature'"},
+		}
+
+		number := 42
+		run := &github.WorkflowRun{Event: &pullRequestEvent, HeadBranch: &headBranch, PullRequests: []*github.PullRequest{{Number: &number}}}
+
+		runnableJobs, _ := classifyJobs(run, jobs, workflowFileJobs)
+
+		expectedRunnableJobs := []string{"build"}
+		if !reflect.DeepEqual(expectedRunnableJobs, runnableJobs) {
+			t.Fatalf("Runnable jobs diff. Expected: %v, actual: %v", expectedRunnableJobs, runnableJobs)
+		}
+	})
+}
+
+func TestGetRef(t *testing.T) {
+
+	str := func(s string) *string { return &s }
+	number := 42
+
+	testCases := []struct {
+		run             *github.WorkflowRun
+		expectedRef     string
+		expectedRefName string
+	}{
+		{&github.WorkflowRun{Event: str("push"), HeadBranch: str("main")}, "refs/heads/main", "main"},
+		{&github.WorkflowRun{Event: str("schedule"), HeadBranch: str("main")}, "refs/heads/main", "main"},
+		{&github.WorkflowRun{Event: str("release"), HeadBranch: str("v1.0")}, "refs/tags/v1.0", "v1.0"},
+		{&github.WorkflowRun{Event: str("pull_request"), HeadBranch: str("feature")}, "", ""},
+		{&github.WorkflowRun{Event: str("pull_request"), HeadBranch: str("feature"), PullRequests: []*github.PullRequest{{Number: &number}}}, "refs/pull/42/merge", "42/merge"},
+		{&github.WorkflowRun{Event: str("pull_request_target"), HeadBranch: str("feature"), PullRequests: []*github.PullRequest{{Number: &number, Base: &github.PullRequestBranch{Ref: str("main")}}}}, "refs/heads/main", "main"},
+		{&github.WorkflowRun{Event: str("pull_request_review"), HeadBranch: str("feature")}, "", ""},
+	}
+
+	for _, testCase := range testCases {
+		if ref, refName := getRef(testCase.run); ref != testCase.expectedRef || refName != testCase.expectedRefName {
+			t.Errorf("Event %v: ref expected: %v (%v), actual: %v (%v)", testCase.run.GetEvent(), testCase.expectedRef, testCase.expectedRefName, ref, refName)
+		}
+	}
+}
+
+func TestGetInstancesToStartAndStop(t *testing.T) {
+
+	onDemandInstances := []OnDemandInstance{
+		{InstanceName: "instance1", RunnerName: "runner1", Status: "TERMINATED"},
+		{InstanceName: "instance2", RunnerName: "runner2", Status: "RUNNING"},
+		{InstanceName: "instance3", RunnerName: "runner3", RunnerGroup: "group1", Status: "TERMINATED"},
+		{InstanceName: "instance4", RunnerName: "runner4", RunnerGroup: "group2", Status: "RUNNING"},
+		{InstanceName: "instance5", RunnerName: "runner5", RunnerGroup: "group2", Status: "RUNNING"},
+		{InstanceName: "instance6", RunnerName: "runner6", Status: "SUSPENDED"},
+	}
+
+	runnersRequired := []RunsOn{
+		{Labels: []string{"self-hosted", "runner1"}},
+		{Group: "group1", Labels: []string{"runner3"}},
+		{Group: "group1", Labels: []string{"runner4"}},
+		{Group: "group2"},
+		{Labels: []string{"runner6"}},
+	}
+
+	instancesToStart := getInstancesToStart(runnersRequired, onDemandInstances)
+
+	expectedInstancesToStart := []OnDemandInstance{onDemandInstances[0], onDemandInstances[2], onDemandInstances[5]}
+	if !reflect.DeepEqual(expectedInstancesToStart, instancesToStart) {
+		t.Fatalf("Instances to start diff. Expected: %v, actual: %v", expectedInstancesToStart, instancesToStart)
+	}
+
+	instancesToStop := getInstancesToStop(runnersRequired, onDemandInstances, nil)
+
+	expectedInstancesToStop := []OnDemandInstance{onDemandInstances[1]}
+	if !reflect.DeepEqual(expectedInstancesToStop, instancesToStop) {
+		t.Fatalf("Instances to stop diff. Expected: %v, actual: %v", expectedInstancesToStop, instancesToStop)
+	}
+}
+
+func TestGetInstancesToStartForRunnerGroupJobs(t *testing.T) {
+
+	onDemandInstances := []OnDemandInstance{
+		{InstanceName: "instance1", RunnerName: "runner1", RunnerGroup: "group1", Status: "RUNNING"},
+		{InstanceName: "instance2", RunnerName: "runner2", RunnerGroup: "group1", Status: "TERMINATED"},
+		{InstanceName: "instance3", RunnerName: "runner3", RunnerGroup: "group1", Status: "TERMINATED"},
+		{InstanceName: "instance4", RunnerName: "runner4", RunnerGroup: "group1", Status: "TERMINATED"},
+		{InstanceName: "instance5", RunnerName: "runner5", RunnerGroup: "group2", Status: "TERMINATED"},
+		{InstanceName: "instance6", RunnerName: "runner6", RunnerGroup: "group2", Status: "TERMINATED"},
+	}
+
+	t.Run("One instance is started per job that only names a runner group", func(t *testing.T) {
+
+		jobRunners := []RunsOn{{Group: "group2"}}
+
+		expectedInstancesToStart := []OnDemandInstance{onDemandInstances[4]}
+		if instancesToStart := getInstancesToStart(jobRunners, onDemandInstances); !reflect.DeepEqual(expectedInstancesToStart, instancesToStart) {
+			t.Fatalf("Instances to start diff. Expected: %v, actual: %v", expectedInstancesToStart, instancesToStart)
+		}
+	})
+
+	t.Run("Awake instances count towards the group's jobs, unless a job needs their runner", func(t *testing.T) {
+
+		jobRunners := []RunsOn{{Group: "group1"}, {Group: "group1"}, {Group: "group1"}, {Group: "group1", Labels: []string{"runner3"}}}
+
+		expectedInstancesToStart := []OnDemandInstance{onDemandInstances[2], onDemandInstances[1], onDemandInstances[3]}
+		if instancesToStart := getInstancesToStart(jobRunners, onDemandInstances); !reflect.DeepEqual(expectedInstancesToStart, instancesToStart) {
+			t.Fatalf("Instances to start diff. Expected: %v, actual: %v", expectedInstancesToStart, instancesToStart)
+		}
+	})
+}
+
+func TestGetRunnersRequiredWithUnparseableWorkflowFile(t *testing.T) {
+
+	httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		switch {
+		case r.URL.Path == "/repos/MyOrg/MyRepo/actions/runs" && r.URL.Query().Get("status") == "queued":
+			fmt.Fprintln(w, `{ "total_count": 1, "workflow_runs": [ { "id": 1, "head_sha": "aaaa", "workflow_url": "https://api.github.com/repos/MyOrg/MyRepo/actions/workflows/10" } ] }`)
+		case r.URL.Path == "/repos/MyOrg/MyRepo/actions/runs" && r.URL.Query().Get("status") == "in_progress":
+			fmt.Fprintln(w, `{ "total_count": 1, "workflow_runs": [ { "id": 2, "head_sha": "bbbb", "workflow_url": "https://api.github.com/repos/MyOrg/MyRepo/actions/workflows/20" } ] }`)
+		case r.URL.Path == "/repos/MyOrg/MyRepo/actions/workflows/10":
+			fmt.Fprintln(w, `{ "id": 10, "path": ".github/workflows/good.yml" }`)
+		case r.URL.Path == "/repos/MyOrg/MyRepo/actions/workflows/20":
+			fmt.Fprintln(w, `{ "id": 20, "path": ".github/workflows/bad.yml" }`)
+		case r.URL.Path == "/MyOrg/MyRepo/aaaa/.github/workflows/good.yml":
+			fmt.Fprintln(w, "jobs:\n  build:\n    runs-on: build_agent")
+		case r.URL.Path == "/MyOrg/MyRepo/bbbb/.github/workflows/bad.yml":
+			fmt.Fprintln(w, "jobs:\n  build:\n    runs-on: { labels: { nested: true } }")
+		case r.URL.Path == "/repos/MyOrg/MyRepo/actions/runs/1/jobs":
+			fmt.Fprintln(w, `{ "total_count": 1, "jobs": [ { "id": 100, "name": "build", "status": "queued" } ] }`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer teardown()
+
+	gitHubClient := github.NewClient(httpClient)
+
+	requirements, err := getRunnersRequired(context.Background(), httpClient, gitHubClient, "MyOrg", "MyRepo", 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runnersRequired, warnings := requirements.Required, requirements.Warnings
+
+	expectedRunnersRequired := []RunsOn{{Labels: []string{"build_agent"}}}
 	if !reflect.DeepEqual(expectedRunnersRequired, runnersRequired) {
 		t.Fatalf("Runners required diff. Expected: %v, actual: %v", expectedRunnersRequired, runnersRequired)
 	}
+
+	if len(warnings) != 1 || warnings[0].RunID != 2 || warnings[0].WorkflowPath != ".github/workflows/bad.yml" {
+		t.Fatalf("Expected a single warning for run 2 (.github/workflows/bad.yml), actual: %v", warnings)
+	}
 }
@@ -0,0 +1,221 @@
+package watchdog
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+)
+
+// Queue-wait statistics cover jobs that started running within this window
+const queueLatencyWindow = 24 * time.Hour
+
+// Describes how long jobs for a runner have been waiting in the queue, within the last 24 hours
+// Cold start is the part of the wait between the watchdog starting an instance for the runner and the job starting to run
+type QueueLatency struct {
+	Runner             string  `json:"runner"`
+	Jobs               int     `json:"jobs"`
+	P50Seconds         float64 `json:"p50_seconds"`
+	P95Seconds         float64 `json:"p95_seconds"`
+	ColdStartShare     float64 `json:"cold_start_share"`
+	ColdStartDominated bool    `json:"cold_start_dominated"`
+}
+
+type jobQueueWait struct {
+	JobID     int64
+	RunsOn    RunsOn
+	QueuedAt  time.Time
+	StartedAt time.Time
+}
+
+// Returns the queue wait of each job that has started running
+// GitHub sets a job's started_at when the job is queued; the job has actually started once its first step has started
+func getJobQueueWaits(jobs []*github.WorkflowJob, workflowFileJobs map[string]WorkflowFileJob) []jobQueueWait {
+
+	var queueWaits []jobQueueWait
+
+	for _, job := range jobs {
+		if job.ID == nil || job.Name == nil || job.StartedAt == nil || len(job.Steps) == 0 || job.Steps[0].StartedAt == nil {
+			continue
+		}
+
+		workflowFileJob, exists := workflowFileJobs[*job.Name]
+		if !exists {
+			continue
+		}
+
+		queueWaits = append(queueWaits, jobQueueWait{JobID: *job.ID, RunsOn: workflowFileJob.RunsOn, QueuedAt: job.StartedAt.Time, StartedAt: job.Steps[0].StartedAt.Time})
+	}
+
+	return queueWaits
+}
+
+func formatRunsOn(runsOn RunsOn) string {
+
+	labels := strings.Join(runsOn.Labels, ",")
+	if runsOn.Group != "" {
+		return fmt.Sprintf("%s/%s", runsOn.Group, labels)
+	}
+	return labels
+}
+
+type instanceStart struct {
+	instance  OnDemandInstance
+	startedAt time.Time
+}
+
+type queueWaitSample struct {
+	runner    string
+	startedAt time.Time
+	wait      time.Duration
+	coldStart time.Duration
+}
+
+// Remembers queue waits of recent jobs, and recent instance starts, across invocations
+type queueLatencyTracker struct {
+	mutex          sync.Mutex
+	samples        []queueWaitSample
+	jobsRecorded   map[int64]time.Time
+	instanceStarts []instanceStart
+}
+
+var jobQueueLatencyTracker = newQueueLatencyTracker()
+
+func newQueueLatencyTracker() *queueLatencyTracker {
+	return &queueLatencyTracker{jobsRecorded: make(map[int64]time.Time)}
+}
+
+// Forgets everything that happened before the statistics window
+func (tracker *queueLatencyTracker) prune(now time.Time) {
+
+	cutoff := now.Add(-queueLatencyWindow)
+
+	var samples []queueWaitSample
+	for _, sample := range tracker.samples {
+		if !sample.startedAt.Before(cutoff) {
+			samples = append(samples, sample)
+		}
+	}
+	tracker.samples = samples
+
+	for jobID, startedAt := range tracker.jobsRecorded {
+		if startedAt.Before(cutoff) {
+			delete(tracker.jobsRecorded, jobID)
+		}
+	}
+
+	var instanceStarts []instanceStart
+	for _, start := range tracker.instanceStarts {
+		if !start.startedAt.Before(cutoff) {
+			instanceStarts = append(instanceStarts, start)
+		}
+	}
+	tracker.instanceStarts = instanceStarts
+}
+
+func (tracker *queueLatencyTracker) recordInstanceStarts(instances []OnDemandInstance, now time.Time) {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	for _, instance := range instances {
+		tracker.instanceStarts = append(tracker.instanceStarts, instanceStart{instance: instance, startedAt: now})
+	}
+}
+
+// Records the queue wait of each job that has not been recorded before
+// If an instance that can serve the job was started while the job was queued, the time from the latest such start
+// until the job started counts as cold start
+func (tracker *queueLatencyTracker) recordJobs(queueWaits []jobQueueWait, now time.Time) {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.prune(now)
+
+	for _, queueWait := range queueWaits {
+		if _, exists := tracker.jobsRecorded[queueWait.JobID]; exists || queueWait.StartedAt.Before(now.Add(-queueLatencyWindow)) {
+			continue
+		}
+		tracker.jobsRecorded[queueWait.JobID] = queueWait.StartedAt
+
+		var coldStart time.Duration
+		for _, start := range tracker.instanceStarts {
+			if queueWait.RunsOn.MatchesRunner(start.instance.RunnerName, start.instance.RunnerGroup) &&
+				!start.startedAt.Before(queueWait.QueuedAt) && !start.startedAt.After(queueWait.StartedAt) {
+				if instanceColdStart := queueWait.StartedAt.Sub(start.startedAt); coldStart == 0 || instanceColdStart < coldStart {
+					coldStart = instanceColdStart
+				}
+			}
+		}
+
+		sample := queueWaitSample{runner: formatRunsOn(queueWait.RunsOn), startedAt: queueWait.StartedAt, wait: queueWait.StartedAt.Sub(queueWait.QueuedAt), coldStart: coldStart}
+		tracker.samples = append(tracker.samples, sample)
+
+		observeJobQueueWait(sample.runner, sample.wait, sample.coldStart)
+	}
+}
+
+// Returns the value below which the given fraction of the sorted durations fall (nearest-rank method)
+func getPercentile(sortedDurations []time.Duration, fraction float64) time.Duration {
+
+	rank := int(math.Ceil(fraction*float64(len(sortedDurations)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sortedDurations[rank]
+}
+
+// Summarizes the queue waits within the statistics window, per runner
+func (tracker *queueLatencyTracker) statistics(now time.Time) []QueueLatency {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.prune(now)
+
+	samplesByRunner := make(map[string][]queueWaitSample)
+	var runners []string
+	for _, sample := range tracker.samples {
+		if _, exists := samplesByRunner[sample.runner]; !exists {
+			runners = append(runners, sample.runner)
+		}
+		samplesByRunner[sample.runner] = append(samplesByRunner[sample.runner], sample)
+	}
+	sort.Strings(runners)
+
+	var queueLatencies []QueueLatency
+
+	for _, runner := range runners {
+		samples := samplesByRunner[runner]
+
+		var waits []time.Duration
+		var totalWait, totalColdStart time.Duration
+		for _, sample := range samples {
+			waits = append(waits, sample.wait)
+			totalWait += sample.wait
+			totalColdStart += sample.coldStart
+		}
+		sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+
+		var coldStartShare float64
+		if totalWait > 0 {
+			coldStartShare = float64(totalColdStart) / float64(totalWait)
+		}
+
+		queueLatencies = append(queueLatencies, QueueLatency{
+			Runner:             runner,
+			Jobs:               len(samples),
+			P50Seconds:         getPercentile(waits, 0.50).Seconds(),
+			P95Seconds:         getPercentile(waits, 0.95).Seconds(),
+			ColdStartShare:     coldStartShare,
+			ColdStartDominated: coldStartShare > 0.5,
+		})
+	}
+
+	return queueLatencies
+}
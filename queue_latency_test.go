@@ -0,0 +1,84 @@
+package watchdog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+)
+
+func TestGetJobQueueWaits(t *testing.T) {
+
+	now := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	int64Value := func(value int64) *int64 { return &value }
+	stringValue := func(value string) *string { return &value }
+	timestamp := func(value time.Time) *github.Timestamp { return &github.Timestamp{Time: value} }
+
+	jobs := []*github.WorkflowJob{
+		{ID: int64Value(1), Name: stringValue("build"), Status: stringValue("in_progress"), StartedAt: timestamp(now.Add(-5 * time.Minute)),
+			Steps: []*github.TaskStep{{StartedAt: timestamp(now.Add(-1 * time.Minute))}}},
+		{ID: int64Value(2), Name: stringValue("package"), Status: stringValue("queued"), StartedAt: timestamp(now.Add(-1 * time.Minute))},
+	}
+
+	workflowFileJobs := map[string]WorkflowFileJob{
+		"build":   {RunsOn: RunsOn{Labels: []string{"build_agent"}}},
+		"package": {RunsOn: RunsOn{Labels: []string{"package_agent"}}},
+	}
+
+	queueWaits := getJobQueueWaits(jobs, workflowFileJobs)
+
+	expectedQueueWaits := []jobQueueWait{{JobID: 1, RunsOn: RunsOn{Labels: []string{"build_agent"}}, QueuedAt: now.Add(-5 * time.Minute), StartedAt: now.Add(-1 * time.Minute)}}
+	if !reflect.DeepEqual(expectedQueueWaits, queueWaits) {
+		t.Fatalf("Queue waits diff. Expected: %v, actual: %v", expectedQueueWaits, queueWaits)
+	}
+}
+
+func TestQueueLatencyTracker(t *testing.T) {
+
+	now := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	tracker := newQueueLatencyTracker()
+
+	buildAgent := RunsOn{Labels: []string{"build_agent"}}
+	cookAgent := RunsOn{Labels: []string{"cook_agent"}}
+
+	// The build agent was started by the watchdog 8 minutes into a 10 minute wait
+	tracker.recordInstanceStarts([]OnDemandInstance{{InstanceName: "build-agent", RunnerName: "build_agent"}}, now.Add(-12*time.Minute))
+
+	queueWaits := []jobQueueWait{
+		{JobID: 1, RunsOn: buildAgent, QueuedAt: now.Add(-20 * time.Minute), StartedAt: now.Add(-10 * time.Minute)},
+		{JobID: 2, RunsOn: cookAgent, QueuedAt: now.Add(-10 * time.Minute), StartedAt: now.Add(-9 * time.Minute)},
+		{JobID: 3, RunsOn: cookAgent, QueuedAt: now.Add(-5 * time.Minute), StartedAt: now.Add(-2 * time.Minute)},
+		{JobID: 4, RunsOn: cookAgent, QueuedAt: now.Add(-30 * time.Hour), StartedAt: now.Add(-25 * time.Hour)},
+	}
+
+	tracker.recordJobs(queueWaits, now)
+
+	// Jobs are only recorded once, even though they are seen in several cycles
+	tracker.recordJobs(queueWaits, now)
+
+	queueLatencies := tracker.statistics(now)
+
+	expectedQueueLatencies := []QueueLatency{
+		{Runner: "build_agent", Jobs: 1, P50Seconds: 600, P95Seconds: 600, ColdStartShare: 0.2, ColdStartDominated: false},
+		{Runner: "cook_agent", Jobs: 2, P50Seconds: 60, P95Seconds: 180, ColdStartShare: 0, ColdStartDominated: false},
+	}
+	if !reflect.DeepEqual(expectedQueueLatencies, queueLatencies) {
+		t.Fatalf("Queue latencies diff. Expected: %+v, actual: %+v", expectedQueueLatencies, queueLatencies)
+	}
+
+	t.Run("Cold start dominated", func(t *testing.T) {
+
+		tracker := newQueueLatencyTracker()
+
+		tracker.recordInstanceStarts([]OnDemandInstance{{InstanceName: "build-agent", RunnerName: "build_agent"}}, now.Add(-9*time.Minute))
+		tracker.recordJobs([]jobQueueWait{{JobID: 1, RunsOn: buildAgent, QueuedAt: now.Add(-10 * time.Minute), StartedAt: now.Add(-1 * time.Minute)}}, now)
+
+		queueLatencies := tracker.statistics(now)
+		if len(queueLatencies) != 1 || !queueLatencies[0].ColdStartDominated {
+			t.Fatalf("Cold start should dominate the queue wait, actual: %+v", queueLatencies)
+		}
+	})
+}
@@ -0,0 +1,244 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+)
+
+// What the watchdog does with instances whose runner has not come online in GitHub
+const (
+	// List the instance among the unhealthy instances in the result, and do nothing else
+	UnhealthyRunnerActionReport = "report"
+
+	// Reset the instance, as if its power had been cycled
+	UnhealthyRunnerActionReset = "reset"
+
+	// Stop the instance and start it again
+	UnhealthyRunnerActionRestart = "restart"
+)
+
+// GitHub reports runners as either online or offline; instances without a registered runner are reported as missing
+const runnerStatusMissing = "missing"
+
+// A running instance whose runner has not come online in GitHub within the boot grace period
+type UnhealthyInstance struct {
+	OnDemandInstance
+	RunningSince time.Time `json:"running_since"`
+	RunnerStatus string    `json:"runner_status"`
+	Action       string    `json:"action"`
+}
+
+// GCE records an operation of this type whenever an instance is reset
+const resetOperationType = "reset"
+
+// Returns when each instance was last reset since the given time, according to the project's operation history
+// Restarted instances need no such lookup, since a restart updates the time that GCE reports as the instance's last start
+func getLastResetTimes(ctx context.Context, computeService *compute.Service, project string, since time.Time) (map[string]time.Time, error) {
+
+	lastResets := make(map[string]time.Time)
+
+	filter := fmt.Sprintf("operationType=\"%s\"", resetOperationType)
+
+	listCtx, call := startAPICall(ctx, apiCompute, "GlobalOperations.AggregatedList")
+	err := computeService.GlobalOperations.AggregatedList(project).Filter(filter).Pages(listCtx, func(operations *compute.OperationAggregatedList) error {
+
+		for _, scopedList := range operations.Items {
+			for _, operation := range scopedList.Operations {
+
+				insertTime, err := time.Parse(time.RFC3339, operation.InsertTime)
+				if err != nil {
+					GetLogger(ctx).Warningf("Unable to parse insert time of operation %v: %v", operation.Name, err)
+					continue
+				}
+				if insertTime.Before(since) {
+					continue
+				}
+
+				key := getInstanceKey(getResourceNameFromURL(operation.Zone), getResourceNameFromURL(operation.TargetLink))
+				if lastReset, exists := lastResets[key]; !exists || insertTime.After(lastReset) {
+					lastResets[key] = insertTime
+				}
+			}
+		}
+
+		return nil
+	})
+	call.end(err)
+	if err != nil {
+		return nil, errors.Wrapf(err, "compute.Service.GlobalOperations.AggregatedList(%v) with filter \"%v\" failed", project, filter)
+	}
+
+	return lastResets, nil
+}
+
+// Returns the running instances that have been up for longer than the boot grace period, and should by now have an online runner
+// A reset instance gets another boot grace period from when it was reset
+func getInstancesToCheck(onDemandInstances []OnDemandInstance, runningSince map[string]time.Time, lastResets map[string]time.Time, gracePeriod time.Duration, now time.Time) []OnDemandInstance {
+
+	var instancesToCheck []OnDemandInstance
+
+	for _, instance := range onDemandInstances {
+		if instance.Status != instanceStatusRunning {
+			continue
+		}
+
+		key := getInstanceKey(instance.Zone, instance.InstanceName)
+		bootedAt, exists := runningSince[key]
+		if !exists {
+			continue
+		}
+		if lastReset, exists := lastResets[key]; exists && lastReset.After(bootedAt) {
+			bootedAt = lastReset
+		}
+
+		if now.Sub(bootedAt) > gracePeriod {
+			instancesToCheck = append(instancesToCheck, instance)
+		}
+	}
+
+	return instancesToCheck
+}
+
+// Checks the runners of the instances that have been up for longer than the boot grace period
+// Resets are only looked up in the operation history, and runners in GitHub, when there are instances that might need checking
+// allInstances are all of the repository's on-demand instances, which decide whether a runner name refers to a single instance
+func findUnhealthyInstances(ctx context.Context, computeService *compute.Service, gitHubClient *github.Client, config Config, repository RepositoryConfig, onDemandInstances []OnDemandInstance, allInstances []OnDemandInstance, runningSince map[string]time.Time, now time.Time) ([]UnhealthyInstance, error) {
+
+	gracePeriod := time.Duration(config.Policies.RunnerBootGracePeriod)
+
+	instancesToCheck := getInstancesToCheck(onDemandInstances, runningSince, nil, gracePeriod, now)
+	if len(instancesToCheck) == 0 {
+		return nil, nil
+	}
+
+	lastResets, err := getLastResetTimes(ctx, computeService, config.Project, now.Add(-gracePeriod))
+	if err != nil {
+		return nil, err
+	}
+
+	instancesToCheck = getInstancesToCheck(instancesToCheck, runningSince, lastResets, gracePeriod, now)
+	if len(instancesToCheck) == 0 {
+		return nil, nil
+	}
+
+	runners, err := getSelfHostedRunnersForRepositories(ctx, gitHubClient, []RepositoryConfig{repository}, usesOrganizationRunners(config, instancesToCheck))
+	if err != nil {
+		return nil, err
+	}
+
+	return getUnhealthyInstances(instancesToCheck, allInstances, runners, runningSince, config.Policies.getUnhealthyRunnerAction()), nil
+}
+
+// Returns the instances whose runner GitHub does not report as online
+// Instances whose runner GitHub reports as busy are running a job, and are never considered unhealthy
+func getUnhealthyInstances(instances []OnDemandInstance, onDemandInstances []OnDemandInstance, runners []gitHubRunner, runningSince map[string]time.Time, action string) []UnhealthyInstance {
+
+	var unhealthyInstances []UnhealthyInstance
+
+	for _, instance := range instances {
+		runnerStatus := runnerStatusMissing
+		if runner := findGitHubRunner(instance, onDemandInstances, runners); runner != nil && runner.Busy {
+			continue
+		} else if runner != nil {
+			runnerStatus = runner.Status
+		}
+
+		if runnerStatus != "online" {
+			unhealthyInstances = append(unhealthyInstances, UnhealthyInstance{OnDemandInstance: instance, RunningSince: runningSince[getInstanceKey(instance.Zone, instance.InstanceName)], RunnerStatus: runnerStatus, Action: action})
+		}
+	}
+
+	return unhealthyInstances
+}
+
+func getUnhealthyRunnerReason(instance UnhealthyInstance, gracePeriod time.Duration) string {
+	return fmt.Sprintf("Runner %v has not come online in GitHub (status: %v) although the instance has been running since %v, which exceeds the boot grace period of %v", instance.RunnerName, instance.RunnerStatus, instance.RunningSince.UTC().Format(time.RFC3339), gracePeriod)
+}
+
+// Remembers restarted instances that were still stopping when the restart stopped waiting for them, across invocations
+// These are started by the next reconcile cycle, whether or not their runner is needed by then
+type pendingRestartTracker struct {
+	mutex   sync.Mutex
+	pending map[string]bool
+}
+
+var pendingRestarts = &pendingRestartTracker{pending: make(map[string]bool)}
+
+func (tracker *pendingRestartTracker) add(instance OnDemandInstance) {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.pending[getInstanceKey(instance.Zone, instance.InstanceName)] = true
+}
+
+// Returns the instances whose restart is still to be completed, and forgets those that are no longer asleep or falling asleep
+// Instances that have already been started by this reconcile cycle are forgotten as well
+func (tracker *pendingRestartTracker) take(onDemandInstances []OnDemandInstance, startedInstances []OnDemandInstance) []OnDemandInstance {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	for _, instance := range startedInstances {
+		delete(tracker.pending, getInstanceKey(instance.Zone, instance.InstanceName))
+	}
+
+	var instancesToStart []OnDemandInstance
+
+	for _, instance := range onDemandInstances {
+		key := getInstanceKey(instance.Zone, instance.InstanceName)
+		if !tracker.pending[key] {
+			continue
+		}
+
+		if isInstanceFallingAsleep(instance.Status) || isInstanceAsleep(instance.Status) {
+			instancesToStart = append(instancesToStart, instance)
+		}
+		delete(tracker.pending, key)
+	}
+
+	return instancesToStart
+}
+
+// Starts the instances whose restart was left to this reconcile cycle
+// An instance that is still stopping, or that cannot be started, is tried again by a later reconcile cycle
+func completePendingRestarts(ctx context.Context, computeService *compute.Service, project string, onDemandInstances []OnDemandInstance, startedInstances []OnDemandInstance) {
+
+	for _, instance := range pendingRestarts.take(onDemandInstances, startedInstances) {
+
+		GetLogger(ctx).WithInstance(instance).Infof("Completing the restart of instance %v", instance.InstanceName)
+		if err := startInstance(ctx, computeService, project, instance); err != nil {
+			GetLogger(ctx).WithInstance(instance).Warningf("Unable to complete the restart of instance %v: %v", instance.InstanceName, err)
+			pendingRestarts.add(instance)
+		}
+	}
+}
+
+// Resets or restarts unhealthy instances, as decided when they were found
+func recoverUnhealthyInstances(ctx context.Context, computeService *compute.Service, project string, unhealthyInstances []UnhealthyInstance) error {
+
+	for _, unhealthyInstance := range unhealthyInstances {
+
+		var err error
+		switch unhealthyInstance.Action {
+		case UnhealthyRunnerActionReset:
+			err = resetInstance(ctx, computeService, project, unhealthyInstance.OnDemandInstance)
+		case UnhealthyRunnerActionRestart:
+			err = restartInstance(ctx, computeService, project, unhealthyInstance.OnDemandInstance)
+		default:
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
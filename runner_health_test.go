@@ -0,0 +1,223 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+func TestGetUnhealthyInstances(t *testing.T) {
+
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	gracePeriod := 10 * time.Minute
+
+	onDemandInstances := []OnDemandInstance{
+		{InstanceName: "online-agent", Zone: "europe-west1-b", RunnerName: "agent1", Status: "RUNNING"},
+		{InstanceName: "offline-agent", Zone: "europe-west1-b", RunnerName: "agent2", Status: "RUNNING"},
+		{InstanceName: "unregistered-agent", Zone: "europe-west1-b", RunnerName: "agent3", Status: "RUNNING"},
+		{InstanceName: "booting-agent", Zone: "europe-west1-b", RunnerName: "agent4", Status: "RUNNING"},
+		{InstanceName: "stopped-agent", Zone: "europe-west1-b", RunnerName: "agent5", Status: "TERMINATED"},
+		{InstanceName: "busy-agent", Zone: "europe-west1-b", RunnerName: "agent6", Status: "RUNNING"},
+	}
+
+	runningSince := map[string]time.Time{
+		"europe-west1-b/online-agent":       now.Add(-time.Hour),
+		"europe-west1-b/offline-agent":      now.Add(-time.Hour),
+		"europe-west1-b/unregistered-agent": now.Add(-time.Hour),
+		"europe-west1-b/booting-agent":      now.Add(-5 * time.Minute),
+		"europe-west1-b/busy-agent":         now.Add(-time.Hour),
+	}
+
+	runners := []gitHubRunner{
+		{Name: "online-agent", Status: "online"},
+		{Name: "offline-agent", Status: "offline"},
+		{Name: "booting-agent", Status: "offline"},
+		{Name: "busy-agent", Status: "offline", Busy: true},
+	}
+
+	instancesToCheck := getInstancesToCheck(onDemandInstances, runningSince, nil, gracePeriod, now)
+	if expectedInstances := []OnDemandInstance{onDemandInstances[0], onDemandInstances[1], onDemandInstances[2], onDemandInstances[5]}; !reflect.DeepEqual(expectedInstances, instancesToCheck) {
+		t.Fatalf("Instances to check expected: %v, actual: %v", expectedInstances, instancesToCheck)
+	}
+
+	unhealthyInstances := getUnhealthyInstances(instancesToCheck, onDemandInstances, runners, runningSince, UnhealthyRunnerActionReset)
+
+	expectedUnhealthyInstances := []UnhealthyInstance{
+		{OnDemandInstance: onDemandInstances[1], RunningSince: now.Add(-time.Hour), RunnerStatus: "offline", Action: UnhealthyRunnerActionReset},
+		{OnDemandInstance: onDemandInstances[2], RunningSince: now.Add(-time.Hour), RunnerStatus: runnerStatusMissing, Action: UnhealthyRunnerActionReset},
+	}
+	if !reflect.DeepEqual(expectedUnhealthyInstances, unhealthyInstances) {
+		t.Fatalf("Unhealthy instances expected: %+v, actual: %+v", expectedUnhealthyInstances, unhealthyInstances)
+	}
+
+	t.Run("Reset instances get another boot grace period", func(t *testing.T) {
+
+		lastResets := map[string]time.Time{"europe-west1-b/offline-agent": now}
+
+		instancesToCheck := getInstancesToCheck(onDemandInstances, runningSince, lastResets, gracePeriod, now.Add(5*time.Minute))
+		if expectedInstances := []OnDemandInstance{onDemandInstances[0], onDemandInstances[2], onDemandInstances[5]}; !reflect.DeepEqual(expectedInstances, instancesToCheck) {
+			t.Fatalf("Instances to check expected: %v, actual: %v", expectedInstances, instancesToCheck)
+		}
+	})
+}
+
+func TestRecoverUnhealthyInstances(t *testing.T) {
+
+	var requests []string
+
+	httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		fmt.Fprintln(w, `{ "name": "operation-1", "status": "DONE" }`)
+	}))
+	defer teardown()
+
+	ctx := context.Background()
+
+	computeService, err := compute.NewService(ctx, option.WithHTTPClient(httpClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unhealthyInstances := []UnhealthyInstance{
+		{OnDemandInstance: OnDemandInstance{InstanceName: "reset-agent", Zone: "europe-west1-b", RunnerName: "agent1", Status: "RUNNING"}, Action: UnhealthyRunnerActionReset},
+		{OnDemandInstance: OnDemandInstance{InstanceName: "restart-agent", Zone: "europe-west1-b", RunnerName: "agent2", Status: "RUNNING"}, Action: UnhealthyRunnerActionRestart},
+		{OnDemandInstance: OnDemandInstance{InstanceName: "reported-agent", Zone: "europe-west1-b", RunnerName: "agent3", Status: "RUNNING"}, Action: UnhealthyRunnerActionReport},
+	}
+
+	if err := recoverUnhealthyInstances(ctx, computeService, "my-project", unhealthyInstances); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restarted instances are started again once they have stopped
+	expectedRequests := []string{
+		"POST /compute/v1/projects/my-project/zones/europe-west1-b/instances/reset-agent/reset",
+		"POST /compute/v1/projects/my-project/zones/europe-west1-b/instances/restart-agent/stop",
+		"POST /compute/v1/projects/my-project/zones/europe-west1-b/instances/restart-agent/start",
+	}
+	if !reflect.DeepEqual(expectedRequests, requests) {
+		t.Fatalf("Requests expected: %v, actual: %v", expectedRequests, requests)
+	}
+
+	t.Run("Instances still stopping are started by the next reconcile cycle", func(t *testing.T) {
+
+		timeout := instanceTransitionTimeout
+		instanceTransitionTimeout = 10 * time.Millisecond
+		defer func() { instanceTransitionTimeout = timeout }()
+
+		var requests []string
+
+		httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			switch r.URL.Path {
+			case "/compute/v1/projects/my-project/zones/europe-west1-b/instances/restart-agent/stop":
+				fmt.Fprintln(w, `{ "name": "operation-1", "status": "RUNNING" }`)
+			case "/compute/v1/projects/my-project/zones/europe-west1-b/operations/operation-1/wait":
+				// The stop takes longer than the restart is willing to wait
+				select {
+				case <-r.Context().Done():
+				case <-time.After(time.Second):
+				}
+				fmt.Fprintln(w, `{ "name": "operation-1", "status": "RUNNING" }`)
+			default:
+				fmt.Fprintln(w, `{ "name": "operation-2", "status": "DONE" }`)
+			}
+		}))
+		defer teardown()
+
+		computeService, err := compute.NewService(ctx, option.WithHTTPClient(httpClient))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		instance := OnDemandInstance{InstanceName: "restart-agent", Zone: "europe-west1-b", RunnerName: "agent2", Status: "RUNNING"}
+		if err := restartInstance(ctx, computeService, "my-project", instance); err != nil {
+			t.Fatal(err)
+		}
+
+		otherInstance := OnDemandInstance{InstanceName: "other-agent", Zone: "europe-west1-b", RunnerName: "agent3", Status: "TERMINATED"}
+		stoppedInstance := instance
+		stoppedInstance.Status = "TERMINATED"
+		completePendingRestarts(ctx, computeService, "my-project", []OnDemandInstance{otherInstance, stoppedInstance}, nil)
+
+		// Once started, the instance is no longer pending
+		completePendingRestarts(ctx, computeService, "my-project", []OnDemandInstance{otherInstance, stoppedInstance}, nil)
+
+		expectedRequests := []string{
+			"POST /compute/v1/projects/my-project/zones/europe-west1-b/instances/restart-agent/stop",
+			"POST /compute/v1/projects/my-project/zones/europe-west1-b/operations/operation-1/wait",
+			"POST /compute/v1/projects/my-project/zones/europe-west1-b/instances/restart-agent/start",
+		}
+		if !reflect.DeepEqual(expectedRequests, requests) {
+			t.Fatalf("Requests expected: %v, actual: %v", expectedRequests, requests)
+		}
+	})
+}
+
+func TestFindUnhealthyInstancesWithOrganizationRunners(t *testing.T) {
+
+	now := time.Now().UTC().Truncate(time.Second)
+
+	httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		switch r.URL.Path {
+		case "/compute/v1/projects/my-project/aggregated/operations":
+			fmt.Fprintf(w, `{ "items": { "zones/europe-west1-b": { "operations": [
+				{ "name": "operation-1", "operationType": "reset", "zone": "https://www.googleapis.com/compute/v1/projects/my-project/zones/europe-west1-b", "targetLink": "https://www.googleapis.com/compute/v1/projects/my-project/zones/europe-west1-b/instances/reset-agent", "insertTime": "%v" }
+			] } } }`, now.Add(-time.Minute).Format(time.RFC3339))
+		case "/repos/MyOrg/MyRepo/actions/runners":
+			fmt.Fprintln(w, `{ "total_count": 1, "runners": [ { "id": 1, "name": "repo-agent", "status": "offline", "busy": false } ] }`)
+		case "/orgs/MyOrg/actions/runners":
+			fmt.Fprintln(w, `{ "total_count": 2, "runners": [ { "id": 2, "name": "org-agent", "status": "online", "busy": false }, { "id": 3, "name": "org-busy-agent", "status": "offline", "busy": true } ] }`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer teardown()
+
+	ctx := context.Background()
+
+	computeService, err := compute.NewService(ctx, option.WithHTTPClient(httpClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{
+		Project:  "my-project",
+		Pools:    []PoolConfig{{Name: "builders", Runners: []string{"builder"}, RunnerGroup: "builders"}},
+		Policies: PolicyConfig{RunnerBootGracePeriod: Duration(10 * time.Minute), UnhealthyRunnerAction: UnhealthyRunnerActionRestart},
+	}
+
+	onDemandInstances := []OnDemandInstance{
+		{InstanceName: "repo-agent", Zone: "europe-west1-b", RunnerName: "builder", RunnerGroup: "builders", Status: "RUNNING"},
+		{InstanceName: "org-agent", Zone: "europe-west1-b", RunnerName: "builder", RunnerGroup: "builders", Status: "RUNNING"},
+		{InstanceName: "org-busy-agent", Zone: "europe-west1-b", RunnerName: "builder", RunnerGroup: "builders", Status: "RUNNING"},
+		{InstanceName: "reset-agent", Zone: "europe-west1-b", RunnerName: "builder", RunnerGroup: "builders", Status: "RUNNING"},
+	}
+
+	runningSince := make(map[string]time.Time)
+	for _, instance := range onDemandInstances {
+		runningSince[getInstanceKey(instance.Zone, instance.InstanceName)] = now.Add(-time.Hour)
+	}
+
+	unhealthyInstances, err := findUnhealthyInstances(ctx, computeService, github.NewClient(httpClient), config, RepositoryConfig{Organization: "MyOrg", Repository: "MyRepo"}, onDemandInstances, onDemandInstances, runningSince, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// org-agent is online at the organization level, org-busy-agent is running a job, and reset-agent was reset within the grace period
+	expectedUnhealthyInstances := []UnhealthyInstance{
+		{OnDemandInstance: onDemandInstances[0], RunningSince: now.Add(-time.Hour), RunnerStatus: "offline", Action: UnhealthyRunnerActionRestart},
+	}
+	if !reflect.DeepEqual(expectedUnhealthyInstances, unhealthyInstances) {
+		t.Fatalf("Unhealthy instances expected: %+v, actual: %+v", expectedUnhealthyInstances, unhealthyInstances)
+	}
+}
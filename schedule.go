@@ -0,0 +1,298 @@
+package watchdog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var cronMonthNames = map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}
+
+var cronDayOfWeekNames = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+
+// The set of values that one field of a cron expression matches
+type cronField struct {
+	values     map[int]bool
+	restricted bool
+}
+
+func parseCronValue(text string, names map[string]int) (int, error) {
+
+	if value, exists := names[strings.ToLower(text)]; exists {
+		return value, nil
+	}
+
+	value, err := strconv.Atoi(text)
+	if err != nil {
+		return 0, errors.Errorf("%v is neither a number nor a name", text)
+	}
+	return value, nil
+}
+
+// Parses a comma-separated list of values, ranges ("1-5") and steps ("*/15", "8-18/2", "5/15")
+// As in cron, a step from a single value ("5/15") runs from that value up to the maximum
+func parseCronField(text string, min int, max int, names map[string]int) (cronField, error) {
+
+	field := cronField{values: make(map[int]bool), restricted: text != "*"}
+
+	for _, item := range strings.Split(text, ",") {
+
+		rangeText, step, stepped := item, 1, false
+		if slash := strings.Index(item, "/"); slash != -1 {
+			rangeText = item[:slash]
+			var err error
+			if step, err = strconv.Atoi(item[slash+1:]); err != nil || step <= 0 {
+				return cronField{}, errors.Errorf("invalid step in %v", item)
+			}
+			stepped = true
+		}
+
+		first, last := min, max
+		if rangeText != "*" {
+			bounds := strings.SplitN(rangeText, "-", 2)
+			var err error
+			if first, err = parseCronValue(bounds[0], names); err != nil {
+				return cronField{}, err
+			}
+			last = first
+			if len(bounds) == 2 {
+				if last, err = parseCronValue(bounds[1], names); err != nil {
+					return cronField{}, err
+				}
+			} else if stepped {
+				last = max
+			}
+		}
+
+		if first < min || last > max || first > last {
+			return cronField{}, errors.Errorf("%v is outside of %v-%v", item, min, max)
+		}
+
+		for value := first; value <= last; value += step {
+			field.values[value] = true
+		}
+	}
+
+	return field, nil
+}
+
+// A five-field cron expression: minute, hour, day of month, month, day of week
+type cronExpression struct {
+	minutes     cronField
+	hours       cronField
+	daysOfMonth cronField
+	months      cronField
+	daysOfWeek  cronField
+}
+
+func parseCronExpression(text string) (*cronExpression, error) {
+
+	fields := strings.Fields(text)
+	if len(fields) != 5 {
+		return nil, errors.Errorf("%v should have 5 fields (minute hour day-of-month month day-of-week), but has %v", text, len(fields))
+	}
+
+	var expression cronExpression
+	var err error
+
+	if expression.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, errors.Wrap(err, "minute")
+	}
+	if expression.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, errors.Wrap(err, "hour")
+	}
+	if expression.daysOfMonth, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, errors.Wrap(err, "day of month")
+	}
+	if expression.months, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return nil, errors.Wrap(err, "month")
+	}
+	// 7 is accepted for Sunday, as in most cron implementations
+	if expression.daysOfWeek, err = parseCronField(fields[4], 0, 7, cronDayOfWeekNames); err != nil {
+		return nil, errors.Wrap(err, "day of week")
+	}
+	if expression.daysOfWeek.values[7] {
+		expression.daysOfWeek.values[0] = true
+	}
+
+	return &expression, nil
+}
+
+// As in cron, a day matches if either the day of month or the day of week matches, when both are restricted
+func (expression *cronExpression) matches(t time.Time) bool {
+
+	if !expression.minutes.values[t.Minute()] || !expression.hours.values[t.Hour()] || !expression.months.values[int(t.Month())] {
+		return false
+	}
+
+	dayOfMonthMatches := expression.daysOfMonth.values[t.Day()]
+	dayOfWeekMatches := expression.daysOfWeek.values[int(t.Weekday())]
+
+	if expression.daysOfMonth.restricted && expression.daysOfWeek.restricted {
+		return dayOfMonthMatches || dayOfWeekMatches
+	}
+	return dayOfMonthMatches && dayOfWeekMatches
+}
+
+func (schedule ScheduleConfig) getLocation() (*time.Location, error) {
+
+	if schedule.Timezone == "" {
+		return time.UTC, nil
+	}
+
+	location, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unknown timezone %v", schedule.Timezone)
+	}
+	return location, nil
+}
+
+// A schedule is active during every minute that its window matches, in the schedule's timezone
+func (schedule ScheduleConfig) isActive(now time.Time) (bool, error) {
+
+	expression, err := parseCronExpression(schedule.Window)
+	if err != nil {
+		return false, err
+	}
+
+	location, err := schedule.getLocation()
+	if err != nil {
+		return false, err
+	}
+
+	return expression.matches(now.In(location)), nil
+}
+
+// Returns the largest minimum warm count among the pool's active schedules
+func (pool PoolConfig) getScheduledMinimum(now time.Time) int64 {
+
+	var minimum int64
+
+	for _, schedule := range pool.Schedules {
+		// Schedules are validated along with the rest of the configuration
+		if active, err := schedule.isActive(now); err == nil && active && schedule.MinWarm > minimum {
+			minimum = schedule.MinWarm
+		}
+	}
+
+	return minimum
+}
+
+// The number of instances that a pool's schedules require to be awake right now
+type scheduledMinimum struct {
+	Pool    string
+	Runners []string
+	MinWarm int64
+}
+
+func (minimum scheduledMinimum) includes(instance OnDemandInstance) bool {
+
+	for _, runner := range minimum.Runners {
+		if runner == instance.RunnerName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the scheduled minimums of pools of individual instances; pools without an active schedule are left out
+func (config Config) getScheduledMinimums(now time.Time) []scheduledMinimum {
+
+	var minimums []scheduledMinimum
+
+	for _, pool := range config.Pools {
+		if pool.isManagedInstanceGroup() {
+			continue
+		}
+
+		if minWarm := pool.getScheduledMinimum(now); minWarm > 0 {
+			minimums = append(minimums, scheduledMinimum{Pool: pool.Name, Runners: pool.Runners, MinWarm: minWarm})
+		}
+	}
+
+	return minimums
+}
+
+// Returns additional instances to start, so that each pool has at least its scheduled minimum of instances awake
+// Instances that are awake or already about to be started count towards the minimum
+func getInstancesToKeepWarm(minimums []scheduledMinimum, onDemandInstances []OnDemandInstance, instancesToStart []OnDemandInstance) []OnDemandInstance {
+
+	starting := make(map[string]bool)
+	for _, instance := range instancesToStart {
+		starting[getInstanceKey(instance.Zone, instance.InstanceName)] = true
+	}
+
+	var instancesToKeepWarm []OnDemandInstance
+
+	for _, minimum := range minimums {
+
+		warmCount := int64(0)
+		for _, instance := range onDemandInstances {
+			if minimum.includes(instance) && (isInstanceAwake(instance.Status) || starting[getInstanceKey(instance.Zone, instance.InstanceName)]) {
+				warmCount++
+			}
+		}
+
+		for _, instance := range onDemandInstances {
+			if warmCount >= minimum.MinWarm {
+				break
+			}
+			key := getInstanceKey(instance.Zone, instance.InstanceName)
+			if minimum.includes(instance) && !starting[key] && getInstanceAction(instance.Status, true) == instanceActionStart {
+				instancesToKeepWarm = append(instancesToKeepWarm, instance)
+				starting[key] = true
+				warmCount++
+			}
+		}
+	}
+
+	return instancesToKeepWarm
+}
+
+// Removes instances from the list of instances to stop, where stopping them would leave fewer awake than the pool's scheduled minimum
+func applyScheduledMinimums(minimums []scheduledMinimum, onDemandInstances []OnDemandInstance, instancesToStop []OnDemandInstance) []OnDemandInstance {
+
+	stoppable := make(map[string]int64)
+	for _, minimum := range minimums {
+		awakeCount := int64(0)
+		for _, instance := range onDemandInstances {
+			if minimum.includes(instance) && isInstanceAwake(instance.Status) {
+				awakeCount++
+			}
+		}
+		stoppable[minimum.Pool] = awakeCount - minimum.MinWarm
+	}
+
+	var remainingInstances []OnDemandInstance
+
+instances:
+	for _, instance := range instancesToStop {
+		for _, minimum := range minimums {
+			if !minimum.includes(instance) {
+				continue
+			}
+			if stoppable[minimum.Pool] <= 0 {
+				continue instances
+			}
+			stoppable[minimum.Pool]--
+		}
+		remainingInstances = append(remainingInstances, instance)
+	}
+
+	return remainingInstances
+}
+
+func getKeepWarmReason(instance OnDemandInstance, minimums []scheduledMinimum) string {
+
+	for _, minimum := range minimums {
+		if minimum.includes(instance) {
+			return fmt.Sprintf("The schedule of pool %v keeps at least %v instance(s) awake", minimum.Pool, minimum.MinWarm)
+		}
+	}
+
+	return fmt.Sprintf("Runner %v is scheduled to be kept awake", instance.RunnerName)
+}
@@ -0,0 +1,135 @@
+package watchdog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCronExpression(t *testing.T) {
+
+	// 2021-03-01 is a Monday
+	monday := func(hour int, minute int) time.Time {
+		return time.Date(2021, 3, 1, hour, minute, 0, 0, time.UTC)
+	}
+
+	testCases := []struct {
+		expression string
+		time       time.Time
+		matches    bool
+	}{
+		{"* * * * *", monday(3, 17), true},
+		{"* 8-17 * * mon-fri", monday(8, 0), true},
+		{"* 8-17 * * mon-fri", monday(17, 59), true},
+		{"* 8-17 * * mon-fri", monday(18, 0), false},
+		{"* 8-17 * * sat,sun", monday(12, 0), false},
+		{"*/15 * * * *", monday(12, 30), true},
+		{"*/15 * * * *", monday(12, 31), false},
+		{"0-30/10 12 * * *", monday(12, 20), true},
+		{"5/15 * * * *", monday(12, 5), true},
+		{"5/15 * * * *", monday(12, 50), true},
+		{"5/15 * * * *", monday(12, 0), false},
+		{"5/15 * * * *", monday(12, 6), false},
+		{"* * 1 * *", monday(12, 0), true},
+		{"* * * feb *", monday(12, 0), false},
+		{"* * 15 * 1", monday(12, 0), true},
+		{"* * 15 * 0,7", monday(12, 0), false},
+		{"* * * * 7", time.Date(2021, 3, 7, 12, 0, 0, 0, time.UTC), true},
+	}
+
+	for _, testCase := range testCases {
+		expression, err := parseCronExpression(testCase.expression)
+		if err != nil {
+			t.Fatalf("%v: %v", testCase.expression, err)
+		}
+		if matches := expression.matches(testCase.time); matches != testCase.matches {
+			t.Errorf("%v at %v expected: %v, actual: %v", testCase.expression, testCase.time, testCase.matches, matches)
+		}
+	}
+
+	t.Run("Step from a single value", func(t *testing.T) {
+
+		field, err := parseCronField("5/15", 0, 59, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedValues := map[int]bool{5: true, 20: true, 35: true, 50: true}
+		if !reflect.DeepEqual(expectedValues, field.values) {
+			t.Fatalf("Values expected: %v, actual: %v", expectedValues, field.values)
+		}
+	})
+
+	t.Run("Invalid expressions", func(t *testing.T) {
+		for _, text := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "* * * * fri-mon", "*/0 * * * *", "* * * * weekday"} {
+			if _, err := parseCronExpression(text); err == nil {
+				t.Errorf("%v should have failed", text)
+			}
+		}
+	})
+}
+
+func TestScheduleTimezone(t *testing.T) {
+
+	schedule := ScheduleConfig{Window: "* 8-17 * * mon-fri", Timezone: "America/New_York", MinWarm: 1}
+
+	// 12:00 UTC is 07:00 in New York
+	if active, err := schedule.isActive(time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)); err != nil || active {
+		t.Fatalf("Schedule should not be active before 08:00 in New York, actual: %v, error: %v", active, err)
+	}
+
+	if active, err := schedule.isActive(time.Date(2021, 3, 1, 13, 0, 0, 0, time.UTC)); err != nil || !active {
+		t.Fatalf("Schedule should be active at 08:00 in New York, actual: %v, error: %v", active, err)
+	}
+}
+
+func TestScheduledMinimums(t *testing.T) {
+
+	config := Config{
+		Pools: []PoolConfig{
+			{Name: "win64", Runners: []string{"build_agent", "package_agent"}, Schedules: []ScheduleConfig{
+				{Window: "* 8-17 * * mon-fri", MinWarm: 1},
+				{Window: "* 9-11 * * mon-fri", MinWarm: 2},
+			}},
+			{Name: "linux", Runners: []string{"cook_agent"}},
+		},
+	}
+
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	minimums := config.getScheduledMinimums(now)
+
+	expectedMinimums := []scheduledMinimum{{Pool: "win64", Runners: []string{"build_agent", "package_agent"}, MinWarm: 2}}
+	if !reflect.DeepEqual(expectedMinimums, minimums) {
+		t.Fatalf("Scheduled minimums expected: %v, actual: %v", expectedMinimums, minimums)
+	}
+
+	onDemandInstances := []OnDemandInstance{
+		{InstanceName: "build-agent", Zone: "europe-west1-b", RunnerName: "build_agent", Status: "RUNNING"},
+		{InstanceName: "package-agent", Zone: "europe-west1-b", RunnerName: "package_agent", Status: "TERMINATED"},
+		{InstanceName: "cook-agent", Zone: "europe-west1-b", RunnerName: "cook_agent", Status: "RUNNING"},
+	}
+
+	t.Run("Asleep instances are started up to the minimum", func(t *testing.T) {
+
+		expectedInstances := []OnDemandInstance{onDemandInstances[1]}
+		if instances := getInstancesToKeepWarm(minimums, onDemandInstances, nil); !reflect.DeepEqual(expectedInstances, instances) {
+			t.Fatalf("Instances to keep warm expected: %v, actual: %v", expectedInstances, instances)
+		}
+
+		if instances := getInstancesToKeepWarm(minimums, onDemandInstances, onDemandInstances[1:2]); len(instances) != 0 {
+			t.Fatalf("Instances already being started should count towards the minimum, actual: %v", instances)
+		}
+	})
+
+	t.Run("Idle instances are not stopped below the minimum", func(t *testing.T) {
+
+		expectedInstances := []OnDemandInstance{onDemandInstances[2]}
+		if instances := getInstancesToStop(nil, onDemandInstances, minimums); !reflect.DeepEqual(expectedInstances, instances) {
+			t.Fatalf("Instances to stop expected: %v, actual: %v", expectedInstances, instances)
+		}
+
+		if instances := getInstancesToStop(nil, onDemandInstances, config.getScheduledMinimums(now.Add(12*time.Hour))); len(instances) != 2 {
+			t.Fatalf("Both running instances should be stopped outside of the schedule, actual: %v", instances)
+		}
+	})
+}
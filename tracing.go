@@ -0,0 +1,113 @@
+package watchdog
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/falldamagestudio/UE4-GHA-BuildAgentWatchdog"
+
+// Attributes attached to spans
+const (
+	attributeRepository    = attribute.Key("github.repository")
+	attributeRunID         = attribute.Key("github.run_id")
+	attributeWorkflowID    = attribute.Key("github.workflow_id")
+	attributeWorkflowPath  = attribute.Key("github.workflow_path")
+	attributeAPI           = attribute.Key("watchdog.api")
+	attributeRunner        = attribute.Key("watchdog.runner")
+	attributeInstance      = attribute.Key("gce.instance")
+	attributeZone          = attribute.Key("gce.zone")
+	attributeInstanceGroup = attribute.Key("gce.instance_group")
+)
+
+// Set when spans are exported via OTLP; nil when tracing is disabled
+var tracerProvider *sdktrace.TracerProvider
+
+// Exports spans via OTLP/gRPC when OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set
+// The exporter reads the remaining OTEL_EXPORTER_OTLP_* settings, and the SDK reads OTEL_SERVICE_NAME, from the environment
+func initTracing(ctx context.Context) error {
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return nil
+	}
+
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return errors.Wrap(err, "otlptracegrpc.New failed")
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(tracerProvider)
+
+	return nil
+}
+
+// Exports all spans that have ended but not yet been exported
+// A Cloud Function may be frozen right after responding, so spans are flushed before the response is sent
+func FlushTraces(ctx context.Context) error {
+
+	if tracerProvider == nil {
+		return nil
+	}
+
+	return tracerProvider.ForceFlush(ctx)
+}
+
+// Flushes remaining spans and stops exporting; call before the process exits
+func ShutdownTracing(ctx context.Context) error {
+
+	if tracerProvider == nil {
+		return nil
+	}
+
+	return tracerProvider.Shutdown(ctx)
+}
+
+// Starts a span as a child of any span in the context, using the tracer provider that is currently registered
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// Ends the span, marking it as failed if an error occurred
+func endSpan(span trace.Span, err error) {
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func instanceAttributes(instance OnDemandInstance) []attribute.KeyValue {
+	return []attribute.KeyValue{attributeInstance.String(instance.InstanceName), attributeZone.String(instance.Zone)}
+}
+
+// Tracks a single GitHub or GCE API call, both as a span and in the API call metrics
+type apiCall struct {
+	span   trace.Span
+	api    string
+	method string
+	start  time.Time
+}
+
+// Starts tracking an API call; the returned context should be passed to the call, so that it is part of the span
+func startAPICall(ctx context.Context, api string, method string, attributes ...attribute.KeyValue) (context.Context, *apiCall) {
+
+	ctx, span := startSpan(ctx, api+"."+method, append(attributes, attributeAPI.String(api))...)
+	return ctx, &apiCall{span: span, api: api, method: method, start: time.Now()}
+}
+
+func (call *apiCall) end(err error) {
+
+	observeAPICall(call.api, call.method, call.start, err)
+	endSpan(call.span, err)
+}
@@ -0,0 +1,141 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-github/v32/github"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+// Records all spans in memory for the duration of a test
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+
+	exporter := tracetest.NewInMemoryExporter()
+	previousTracerProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(previousTracerProvider) })
+
+	return exporter
+}
+
+func getSpanAttribute(span tracetest.SpanStub, key attribute.Key) string {
+
+	for _, keyValue := range span.Attributes {
+		if keyValue.Key == key {
+			return keyValue.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestStopInstancesIsTraced(t *testing.T) {
+
+	exporter := recordSpans(t)
+
+	httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path == "/compute/v1/projects/my-project/zones/europe-west1-b/instances/broken-agent/stop" {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, `{ "error": { "code": 500, "message": "Internal error" } }`)
+			return
+		}
+		fmt.Fprintln(w, `{ "name": "operation-1", "status": "DONE" }`)
+	}))
+	defer teardown()
+
+	ctx := context.Background()
+
+	computeService, err := compute.NewService(ctx, option.WithHTTPClient(httpClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, span := startSpan(ctx, "Process")
+
+	instancesToStop := []OnDemandInstance{
+		{InstanceName: "suspended-agent", Zone: "europe-west1-b", RunnerName: "agent1", Status: "RUNNING", StopMode: StopModeSuspend},
+		{InstanceName: "broken-agent", Zone: "europe-west1-b", RunnerName: "agent2", Status: "RUNNING", StopMode: StopModeStop},
+	}
+
+	err = stopInstances(ctx, computeService, "my-project", instancesToStop)
+	endSpan(span, err)
+	if err == nil {
+		t.Fatalf("Stopping broken-agent should fail")
+	}
+
+	spans := exporter.GetSpans()
+
+	expectedSpanNames := []string{"compute.Instances.Suspend", "compute.Instances.Stop", "Process"}
+	if len(spans) != len(expectedSpanNames) {
+		t.Fatalf("Spans expected: %v, actual: %v", expectedSpanNames, spans)
+	}
+
+	for index, expectedSpanName := range expectedSpanNames {
+		if spans[index].Name != expectedSpanName {
+			t.Fatalf("Span %v name expected: %v, actual: %v", index, expectedSpanName, spans[index].Name)
+		}
+	}
+
+	t.Run("API call spans are children of the span in the context", func(t *testing.T) {
+		for _, apiSpan := range spans[:2] {
+			if apiSpan.Parent.SpanID() != spans[2].SpanContext.SpanID() {
+				t.Fatalf("Span %v parent expected: %v, actual: %v", apiSpan.Name, spans[2].SpanContext.SpanID(), apiSpan.Parent.SpanID())
+			}
+		}
+	})
+
+	t.Run("API call spans carry the instance name and zone", func(t *testing.T) {
+		if instance := getSpanAttribute(spans[0], attributeInstance); instance != "suspended-agent" {
+			t.Fatalf("Instance attribute expected: %v, actual: %v", "suspended-agent", instance)
+		}
+		if zone := getSpanAttribute(spans[0], attributeZone); zone != "europe-west1-b" {
+			t.Fatalf("Zone attribute expected: %v, actual: %v", "europe-west1-b", zone)
+		}
+	})
+
+	t.Run("Failed calls are marked as errors", func(t *testing.T) {
+		if spans[0].Status.Code != codes.Unset {
+			t.Fatalf("Status of successful call expected: %v, actual: %v", codes.Unset, spans[0].Status.Code)
+		}
+		if spans[1].Status.Code != codes.Error || spans[2].Status.Code != codes.Error {
+			t.Fatalf("Status of failed call and its parent expected: %v, actual: %v and %v", codes.Error, spans[1].Status.Code, spans[2].Status.Code)
+		}
+	})
+}
+
+func TestGetJobsForRunIsTraced(t *testing.T) {
+
+	exporter := recordSpans(t)
+
+	httpClient, teardown := testingHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{ "total_count": 0, "jobs": [] }`)
+	}))
+	defer teardown()
+
+	gitHubClient := github.NewClient(httpClient)
+
+	if _, _, err := getJobsForRun(context.Background(), gitHubClient, "MyOrg", "MyRepo", 1234); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "github.Actions.ListWorkflowJobs" {
+		t.Fatalf("A single github.Actions.ListWorkflowJobs span expected, actual: %v", spans)
+	}
+
+	if runID := getSpanAttribute(spans[0], attributeRunID); runID != "1234" {
+		t.Fatalf("Run ID attribute expected: %v, actual: %v", "1234", runID)
+	}
+	if repository := getSpanAttribute(spans[0], attributeRepository); repository != "MyOrg/MyRepo" {
+		t.Fatalf("Repository attribute expected: %v, actual: %v", "MyOrg/MyRepo", repository)
+	}
+}